@@ -0,0 +1,175 @@
+package main
+
+import (
+	"firefly-iii-email-scanner/anonymize"
+	"firefly-iii-email-scanner/common"
+	"firefly-iii-email-scanner/email"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"slices"
+	"strings"
+)
+
+// The fields of an extracted transaction which hold personal data, and so
+// are expected to change when the email is anonymized.
+var personalFields = []string{"accountNumber", "cardLast4", "cardholder", "reference"}
+
+// A flag which can be given more than once.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ", ")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// Rewrites an email with its personal data replaced, so that it can be shared
+// as a fixture, and optionally checks that it is still extracted the same way.
+func runAnonymize(args []string) {
+	flags := flag.NewFlagSet("anonymize", flag.ExitOnError)
+	configFile := flags.String("config", "", "A configuration file to check the anonymized email is extracted the same way with")
+	output := flags.String("o", "", "The file to write the anonymized email to. Defaults to standard output")
+	var names, scrub, keepHeaders stringList
+	flags.Var(&names, "name", "A name to replace besides those of the recipients, e.g. a cardholder's. Can be given more than once")
+	flags.Var(&scrub, "scrub", "Text to replace wherever it appears, e.g. a street address. Can be given more than once")
+	flags.Var(&keepHeaders, "keep-header", "A header to keep besides From, To, Cc, Subject and Date. Can be given more than once")
+	verbose := flags.Bool("verbose", false, "Show log output from processing the email")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: firefly-iii-email-scanner anonymize [flags] [alert.eml]")
+		fmt.Fprintln(flags.Output(), "The email is read from standard input if no file is given.")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	var raw []byte
+	var err error
+	if path := flags.Arg(0); path != "" && path != "-" {
+		raw, err = os.ReadFile(path)
+	} else {
+		raw, err = io.ReadAll(os.Stdin)
+	}
+	if err != nil {
+		log.Fatalf("Failed to read email: %v", err)
+	}
+
+	var config *common.Config
+	if *configFile != "" {
+		config, err = common.GetConfig(*configFile)
+		if err != nil {
+			log.Fatalf("Failed to load config: %v", err)
+		}
+		// Keep the headers the processing steps match against
+		keepHeaders = append(keepHeaders, configuredHeaders(config.ProcessEmails)...)
+	}
+
+	anonymized, err := anonymize.Anonymize(raw, anonymize.Options{Names: names, Scrub: scrub, KeepHeaders: keepHeaders})
+	if err != nil {
+		log.Fatalf("Failed to anonymize email: %v", err)
+	}
+
+	if *output != "" {
+		err = os.WriteFile(*output, anonymized, 0644)
+	} else {
+		_, err = os.Stdout.Write(anonymized)
+	}
+	if err != nil {
+		log.Fatalf("Failed to write anonymized email: %v", err)
+	}
+
+	if config == nil {
+		return
+	}
+	if !*verbose {
+		log.SetOutput(io.Discard)
+	}
+	if !verifyAnonymized(raw, anonymized, config.ProcessEmails) {
+		os.Exit(1)
+	}
+}
+
+// Reports whether the anonymized email is extracted the same way as the
+// original, other than the fields holding personal data, and prints any
+// differences to standard error.
+func verifyAnonymized(original []byte, anonymized []byte, configs []common.EmailProcessingConfig) bool {
+	before := email.ProcessRawMessage(email.RawMessage{Id: "original", Body: original}, configs)
+	after := email.ProcessRawMessage(email.RawMessage{Id: "anonymized", Body: anonymized}, configs)
+	if before == nil {
+		fmt.Fprintln(os.Stderr, "Not verified: no process_emails entry is for the sender")
+		return false
+	}
+
+	diffs := diffTransactionInfo(before, after)
+	if beforeErr, afterErr := extractionError(before), extractionError(after); beforeErr != afterErr {
+		diffs = append(diffs, fieldDiff{"error", beforeErr, afterErr})
+	}
+
+	verified := true
+	for _, d := range diffs {
+		field := d.field[strings.LastIndex(d.field, " ")+1:]
+		note := ""
+		if slices.Contains(personalFields, field) {
+			note = " (personal data, expected to change)"
+		} else {
+			verified = false
+		}
+		fmt.Fprintf(os.Stderr, "  %-16s %s -> %s%s\n", d.field+":", d.before, d.after, note)
+	}
+
+	if verified {
+		fmt.Fprintln(os.Stderr, "Verified: the anonymized email is extracted the same way")
+	} else {
+		fmt.Fprintln(os.Stderr, "The anonymized email is extracted differently; use --name, --scrub or --keep-header, or edit it by hand")
+	}
+	return verified
+}
+
+func extractionError(info *common.EmailTransactionInfo) string {
+	if info == nil {
+		return "no process_emails entry is for the sender"
+	}
+	if info.Err != nil {
+		return info.Err.Error()
+	}
+	return ""
+}
+
+// Returns the headers that discriminators and extraction steps match
+// against.
+func configuredHeaders(configs []common.EmailProcessingConfig) []string {
+	var headers []string
+	add := func(header string) {
+		if header != "" && !slices.Contains(headers, header) {
+			headers = append(headers, header)
+		}
+	}
+
+	var addDiscriminator func(d common.Discriminator)
+	addDiscriminator = func(d common.Discriminator) {
+		add(d.Header)
+		for _, child := range d.Discriminators {
+			addDiscriminator(child)
+		}
+	}
+
+	for _, config := range configs {
+		for _, step := range config.ProcessingSteps {
+			addDiscriminator(step.Discriminator)
+			for _, extractionStep := range step.ExtractionSteps {
+				add(extractionStep.Header)
+			}
+			if step.Repeat != nil {
+				add(step.Repeat.Header)
+				for _, extractionStep := range step.Repeat.ExtractionSteps {
+					add(extractionStep.Header)
+				}
+			}
+		}
+	}
+	return headers
+}
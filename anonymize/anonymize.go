@@ -0,0 +1,407 @@
+// Package anonymize rewrites bank alert emails so that they can be shared,
+// e.g. as test fixtures, replacing personal data with fake values while
+// keeping the amounts, dates and layout that processing steps depend on.
+package anonymize
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/emersion/go-message/mail"
+)
+
+// The headers kept in the anonymized email, along with any the caller asks
+// for. Every other header, e.g. Received and DKIM-Signature, is dropped.
+var keptHeaders = []string{"From", "To", "Cc", "Delivered-To", "X-Original-To", "Subject", "Date"}
+
+// The headers whose addresses are replaced. The From address is kept, as it
+// is the bank's and processing configurations are chosen by it.
+var recipientHeaders = []string{"To", "Cc", "Delivered-To", "X-Original-To"}
+
+// The fake names that names are replaced with, in order of first use.
+var fakeNames = []string{"Alex", "Jordan", "Taylor", "Morgan", "Casey", "Riley", "Jamie", "Avery", "Quinn", "Parker", "Rowan", "Reese", "Sasha", "Drew", "Emery", "Hayden"}
+
+var (
+	emailAddressRegex = regexp.MustCompile(`[A-Za-z0-9._%+\-]+@[A-Za-z0-9.\-]+\.[A-Za-z]{2,}`)
+	urlRegex          = regexp.MustCompile(`(https?://[^\s/"'<>]+)[^\s"'<>]*`)
+	digitsRegex       = regexp.MustCompile(`\d{4,}`)
+	yearRegex         = regexp.MustCompile(`^(19|20)\d{2}$`)
+	// A month name, and perhaps a day, just before a year, e.g. "Mar 14, " or
+	// "14 March "
+	monthBeforeRegex = regexp.MustCompile(`(?i)\b(jan|feb|mar|apr|may|jun|jul|aug|sep|oct|nov|dec)[a-z]*\.?(\s+\d{1,2}(st|nd|rd|th)?)?,?\s+$`)
+)
+
+// Options for anonymizing an email.
+type Options struct {
+	// Further names to replace, e.g. a cardholder's name the email does not
+	// address. The names of the recipients are always replaced.
+	Names []string
+	// Further text to replace wherever it appears, e.g. a street address.
+	Scrub []string
+	// Further headers to keep, e.g. those a headerRegex discriminator
+	// matches against.
+	KeepHeaders []string
+}
+
+// Replaces personal data with fake values, the same fake value each time the
+// same original appears, so that the email reads as it did.
+type anonymizer struct {
+	from    string
+	names   map[string]string
+	numbers map[string]string
+	emails  map[string]string
+	scrub   []string
+}
+
+// Rewrites a raw email with its personal data replaced. Only the headers,
+// plain text part and HTML part which processing steps use are kept, and any
+// attachments are dropped.
+//
+// What is replaced:
+//   - email addresses, other than the sender's
+//   - the names of the recipients and those given in the options, as whole words
+//   - numbers of 4 or more digits, other than the years of dates and
+//     amounts. Numbers ending in the same 4 digits still do after they are
+//     replaced, so that card and account number suffixes still match each
+//     other
+//   - the paths and queries of links, which often identify the recipient
+//   - the text given in the options
+func Anonymize(raw []byte, options Options) ([]byte, error) {
+	m, err := mail.CreateReader(bytes.NewReader(raw))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse email: %w", err)
+	}
+	plainText, html, err := readText(m)
+	if err != nil {
+		return nil, err
+	}
+
+	a := &anonymizer{
+		names:   make(map[string]string),
+		numbers: make(map[string]string),
+		emails:  make(map[string]string),
+		scrub:   options.Scrub,
+	}
+	if from, err := m.Header.AddressList("From"); err == nil && len(from) > 0 {
+		a.from = strings.ToLower(from[0].Address)
+	}
+	for _, header := range recipientHeaders {
+		addresses, _ := m.Header.AddressList(header)
+		for _, address := range addresses {
+			a.addName(address.Name)
+		}
+	}
+	for _, name := range options.Names {
+		a.addName(name)
+	}
+
+	header := a.header(m.Header, options.KeepHeaders)
+	var out bytes.Buffer
+	if err := writeEmail(&out, header, a.replace(plainText), a.replace(html)); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+// Reads the first inline plain text and HTML parts of an email.
+func readText(m *mail.Reader) (string, string, error) {
+	var plainText, html string
+	for {
+		part, err := m.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", "", fmt.Errorf("failed to read email part: %w", err)
+		}
+		if _, ok := part.Header.(*mail.InlineHeader); !ok {
+			continue
+		}
+
+		contentType := part.Header.Get("Content-Type")
+		isPlainText := strings.Contains(contentType, "text/plain") && plainText == ""
+		isHtml := strings.Contains(contentType, "text/html") && html == ""
+		if !isPlainText && !isHtml {
+			continue
+		}
+		body, err := io.ReadAll(part.Body)
+		if err != nil {
+			return "", "", fmt.Errorf("failed to read email part: %w", err)
+		}
+		if isPlainText {
+			plainText = string(body)
+		} else {
+			html = string(body)
+		}
+	}
+
+	if plainText == "" && html == "" {
+		return "", "", fmt.Errorf("the email has no text or HTML part")
+	}
+	return plainText, html, nil
+}
+
+// Returns the headers to keep, with the recipients' addresses and the
+// subject anonymized and a new Message-ID.
+func (a *anonymizer) header(original mail.Header, keepHeaders []string) mail.Header {
+	var header mail.Header
+	keys := slices.Clone(keptHeaders)
+	for _, key := range keepHeaders {
+		if !slices.ContainsFunc(keys, func(k string) bool { return strings.EqualFold(k, key) }) {
+			keys = append(keys, key)
+		}
+	}
+	for _, key := range keys {
+		for _, value := range original.Values(key) {
+			header.Add(key, value)
+		}
+	}
+
+	for _, key := range recipientHeaders {
+		addresses, err := original.AddressList(key)
+		if err != nil || len(addresses) == 0 {
+			continue
+		}
+		for _, address := range addresses {
+			address.Name = a.replace(address.Name)
+			address.Address = a.replaceEmail(address.Address)
+		}
+		header.SetAddressList(key, addresses)
+	}
+
+	if subject, err := original.Subject(); err == nil && subject != "" {
+		header.SetSubject(a.replace(subject))
+	}
+	for _, key := range keepHeaders {
+		if values := header.Values(key); len(values) > 0 {
+			header.Del(key)
+			for _, value := range values {
+				header.Add(key, a.replace(value))
+			}
+		}
+	}
+
+	domain := "example.com"
+	if at := strings.LastIndex(a.from, "@"); at >= 0 {
+		domain = a.from[at+1:]
+	}
+	header.SetMessageID(fmt.Sprintf("anonymized-%s@%s", randomDigits(12), domain))
+	return header
+}
+
+// Writes an email with the given plain text and HTML parts, leaving out
+// either if it is empty.
+func writeEmail(w io.Writer, header mail.Header, plainText string, html string) error {
+	type textPart struct {
+		contentType string
+		body        string
+	}
+	var parts []textPart
+	if plainText != "" {
+		parts = append(parts, textPart{"text/plain", plainText})
+	}
+	if html != "" {
+		parts = append(parts, textPart{"text/html", html})
+	}
+
+	if len(parts) == 1 {
+		header.SetContentType(parts[0].contentType, map[string]string{"charset": "utf-8"})
+		body, err := mail.CreateSingleInlineWriter(w, header)
+		if err != nil {
+			return err
+		}
+		if _, err := io.WriteString(body, parts[0].body); err != nil {
+			return err
+		}
+		return body.Close()
+	}
+
+	inline, err := mail.CreateInlineWriter(w, header)
+	if err != nil {
+		return err
+	}
+	for _, part := range parts {
+		var partHeader mail.InlineHeader
+		partHeader.SetContentType(part.contentType, map[string]string{"charset": "utf-8"})
+		body, err := inline.CreatePart(partHeader)
+		if err != nil {
+			return err
+		}
+		if _, err := io.WriteString(body, part.body); err != nil {
+			return err
+		}
+		if err := body.Close(); err != nil {
+			return err
+		}
+	}
+	return inline.Close()
+}
+
+// Registers the words of a name to be replaced with fake names.
+func (a *anonymizer) addName(name string) {
+	for _, word := range strings.FieldsFunc(name, func(r rune) bool { return !unicode.IsLetter(r) && r != '\'' }) {
+		key := strings.ToLower(word)
+		if len([]rune(word)) < 2 || a.names[key] != "" {
+			continue
+		}
+		fake := fakeNames[len(a.names)%len(fakeNames)]
+		if len(a.names) >= len(fakeNames) {
+			fake += strconv.Itoa(len(a.names) / len(fakeNames))
+		}
+		a.names[key] = fake
+	}
+}
+
+// Replaces the personal data in a text.
+func (a *anonymizer) replace(text string) string {
+	for i, scrub := range a.scrub {
+		if scrub != "" {
+			text = replaceFold(text, scrub, fmt.Sprintf("Redacted %d", i+1))
+		}
+	}
+
+	text = emailAddressRegex.ReplaceAllStringFunc(text, a.replaceEmail)
+	text = urlRegex.ReplaceAllString(text, "$1/")
+	text = a.replaceNames(text)
+
+	return replaceAllIndexFunc(digitsRegex, text, func(start, end int) string {
+		number := text[start:end]
+		if isYearInDate(text, start, end) || isAmount(text, start, end) {
+			return number
+		}
+		return a.replaceNumber(number)
+	})
+}
+
+func (a *anonymizer) replaceEmail(address string) string {
+	key := strings.ToLower(address)
+	if key == a.from || key == "" {
+		return address
+	}
+	if fake, ok := a.emails[key]; ok {
+		return fake
+	}
+	fake := fmt.Sprintf("person%d@example.com", len(a.emails)+1)
+	a.emails[key] = fake
+	return fake
+}
+
+// Replaces the registered names where they appear as whole words, keeping
+// the case they are written in, e.g. "JANE" becomes "ALEX".
+func (a *anonymizer) replaceNames(text string) string {
+	if len(a.names) == 0 {
+		return text
+	}
+
+	var result strings.Builder
+	runes := []rune(text)
+	for i := 0; i < len(runes); {
+		if !unicode.IsLetter(runes[i]) {
+			result.WriteRune(runes[i])
+			i++
+			continue
+		}
+		j := i
+		for j < len(runes) && (unicode.IsLetter(runes[j]) || runes[j] == '\'') {
+			j++
+		}
+		word := string(runes[i:j])
+		if fake, ok := a.names[strings.ToLower(word)]; ok {
+			if word == strings.ToUpper(word) {
+				fake = strings.ToUpper(fake)
+			}
+			word = fake
+		}
+		result.WriteString(word)
+		i = j
+	}
+	return result.String()
+}
+
+// Replaces a number with random digits of the same length. The last 4
+// digits are replaced the same way wherever they appear, so that a card
+// number and its suffix still match.
+func (a *anonymizer) replaceNumber(number string) string {
+	if fake, ok := a.numbers[number]; ok {
+		return fake
+	}
+
+	var fake string
+	if len(number) > 4 {
+		fake = randomDigits(len(number)-4) + a.replaceNumber(number[len(number)-4:])
+	} else {
+		fake = randomDigits(len(number))
+	}
+	a.numbers[number] = fake
+	return fake
+}
+
+// Reports whether the number at text[start:end] is the year of a date, next
+// to a month name or a date separator, e.g. "Mar 14, 2024" or "03/14/2024".
+// Other numbers that look like years, e.g. "ending in 2019", are replaced.
+func isYearInDate(text string, start int, end int) bool {
+	if !yearRegex.MatchString(text[start:end]) {
+		return false
+	}
+	if (start > 0 && (text[start-1] == '/' || text[start-1] == '-')) ||
+		(end < len(text) && (text[end] == '/' || text[end] == '-')) {
+		return true
+	}
+	return monthBeforeRegex.MatchString(text[max(0, start-32):start])
+}
+
+// Reports whether the digits at text[start:end] are part of an amount,
+// i.e. they follow a currency symbol or are followed by a decimal part.
+func isAmount(text string, start int, end int) bool {
+	before := strings.TrimRight(text[:start], " ")
+	for _, symbol := range []string{"$", "€", "£", "¥", "₹"} {
+		if strings.HasSuffix(before, symbol) {
+			return true
+		}
+	}
+	after := text[end:]
+	return len(after) >= 3 && (after[0] == '.' || after[0] == ',') &&
+		unicode.IsDigit(rune(after[1])) && unicode.IsDigit(rune(after[2])) &&
+		(len(after) == 3 || !unicode.IsDigit(rune(after[3])))
+}
+
+// Replaces every match of the regex with the result of replace, which is
+// given the position of the match in the text.
+func replaceAllIndexFunc(re *regexp.Regexp, text string, replace func(start, end int) string) string {
+	var result strings.Builder
+	last := 0
+	for _, match := range re.FindAllStringIndex(text, -1) {
+		result.WriteString(text[last:match[0]])
+		result.WriteString(replace(match[0], match[1]))
+		last = match[1]
+	}
+	result.WriteString(text[last:])
+	return result.String()
+}
+
+// Replaces every occurrence of old in the text, ignoring case.
+func replaceFold(text string, old string, replacement string) string {
+	re := regexp.MustCompile(`(?i)` + regexp.QuoteMeta(old))
+	return re.ReplaceAllLiteralString(text, replacement)
+}
+
+// Returns random digits, which do not start with 0 so that the number keeps
+// its length however it is parsed.
+func randomDigits(n int) string {
+	digits := make([]byte, n)
+	for i := range digits {
+		if i == 0 {
+			digits[i] = byte('1' + rand.IntN(9))
+		} else {
+			digits[i] = byte('0' + rand.IntN(10))
+		}
+	}
+	return string(digits)
+}
@@ -0,0 +1,125 @@
+package anonymize
+
+import (
+	"bytes"
+	"io"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-message/mail"
+)
+
+const sample = "From: Example Bank <alerts@examplebank.com>\r\n" +
+	"To: \"Jane Q. Doe\" <jane.doe@mail.example>\r\n" +
+	"Subject: Jane, your card ending in 4321 was used\r\n" +
+	"Date: Thu, 14 Mar 2024 19:02:11 -0400\r\n" +
+	"Message-ID: <abc123@examplebank.com>\r\n" +
+	"Received: from mx.mail.example by jane-laptop\r\n" +
+	"X-Alert-Type: card-4321\r\n" +
+	"Content-Type: text/plain; charset=utf-8\r\n" +
+	"\r\n" +
+	"Hello JANE DOE,\r\n" +
+	"A charge of $1234.56 at BLUE BOTTLE on Mar 14, 2024 was made with card 4111111111114321.\r\n" +
+	"Questions? Write to jane.doe@mail.example or alerts@examplebank.com.\r\n" +
+	"Manage alerts: https://bank.example/alerts?user=jane.doe&token=98765\r\n" +
+	"Billing address: 12 Elm Street\r\n"
+
+func TestAnonymize(t *testing.T) {
+	raw, err := Anonymize([]byte(sample), Options{Scrub: []string{"12 Elm Street"}, KeepHeaders: []string{"X-Alert-Type"}})
+	if err != nil {
+		t.Fatalf("Anonymize returned an error: %v", err)
+	}
+
+	m, err := mail.CreateReader(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatalf("Failed to parse the anonymized email: %v", err)
+	}
+	part, err := m.NextPart()
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(part.Body)
+	text := string(body)
+	subject, _ := m.Header.Subject()
+
+	everything := string(raw) + subject + text
+	for _, personal := range []string{"Jane", "JANE", "Doe", "DOE", "jane.doe", "4321", "4111111111114321", "98765", "Elm Street", "jane-laptop"} {
+		if strings.Contains(everything, personal) {
+			t.Errorf("Expected %q to be replaced, got\n%s", personal, everything)
+		}
+	}
+
+	for _, kept := range []string{"$1234.56", "BLUE BOTTLE", "Mar 14, 2024", "alerts@examplebank.com", "https://bank.example/", "Redacted 1"} {
+		if !strings.Contains(text, kept) {
+			t.Errorf("Expected %q to be kept, got\n%s", kept, text)
+		}
+	}
+	if !strings.HasPrefix(text, "Hello ALEX JORDAN,") {
+		t.Errorf("Expected the names to be replaced in the case they were written, got\n%s", text)
+	}
+	if from := m.Header.Get("From"); !strings.Contains(from, "alerts@examplebank.com") {
+		t.Errorf("Expected the sender to be kept, got %q", from)
+	}
+	if date := m.Header.Get("Date"); date != "Thu, 14 Mar 2024 19:02:11 -0400" {
+		t.Errorf("Expected the date to be kept, got %q", date)
+	}
+
+	// The card number and its suffix are replaced with numbers that still
+	// end the same way
+	suffix := regexp.MustCompile(`card ending in (\d{4})`).FindStringSubmatch(subject)
+	card := regexp.MustCompile(`card (\d{16})`).FindStringSubmatch(text)
+	if suffix == nil || card == nil || !strings.HasSuffix(card[1], suffix[1]) {
+		t.Errorf("Expected the card number to end with the replaced suffix, got %q and %q", subject, text)
+	}
+	if alert := m.Header.Get("X-Alert-Type"); alert != "card-"+suffix[1] {
+		t.Errorf("Expected the kept header to be anonymized the same way, got %q", alert)
+	}
+}
+
+func TestAnonymize_MultipartKeepsBothParts(t *testing.T) {
+	multipart := "From: alerts@examplebank.com\r\n" +
+		"To: sam@mail.example\r\n" +
+		"Content-Type: multipart/alternative; boundary=b\r\n" +
+		"\r\n" +
+		"--b\r\nContent-Type: text/plain\r\n\r\nPaid $5.00\r\n" +
+		"--b\r\nContent-Type: text/html\r\n\r\n<p>Paid $5.00</p>\r\n" +
+		"--b\r\nContent-Type: application/pdf\r\nContent-Disposition: attachment; filename=statement.pdf\r\n\r\nsecret\r\n" +
+		"--b--\r\n"
+
+	raw, err := Anonymize([]byte(multipart), Options{})
+	if err != nil {
+		t.Fatalf("Anonymize returned an error: %v", err)
+	}
+
+	m, err := mail.CreateReader(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var contentTypes []string
+	for {
+		part, err := m.NextPart()
+		if err != nil {
+			break
+		}
+		contentType, _, _ := part.Header.(*mail.InlineHeader).ContentType()
+		contentTypes = append(contentTypes, contentType)
+	}
+	if strings.Join(contentTypes, ",") != "text/plain,text/html" {
+		t.Errorf("Expected the text and HTML parts without the attachment, got %v", contentTypes)
+	}
+}
+
+func TestAnonymize_YearsOnlyKeptInDates(t *testing.T) {
+	a := &anonymizer{numbers: make(map[string]string)}
+	text := a.replace("Card ending in 2019 was charged on Mar 14, 2024, 14 March 2023, 03/14/2022 and 2021-03-14.")
+
+	if strings.Contains(text, "2019") {
+		t.Errorf("Expected the card number that looks like a year to be replaced, got %q", text)
+	}
+	for _, kept := range []string{"Mar 14, 2024", "14 March 2023", "03/14/2022", "2021-03-14"} {
+		if !strings.Contains(text, kept) {
+			t.Errorf("Expected %q to be kept, got %q", kept, text)
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package archive
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const extension = ".eml"
+
+// A content-addressed store of raw emails on the local disk. Each email is
+// saved once, under the SHA-256 hash of its content, so archiving the same
+// email again is a no-op.
+type Archive struct {
+	dir string
+}
+
+// Returns an archive rooted at the given directory, creating the directory
+// if it does not exist.
+func Open(dir string) (*Archive, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create archive directory %s: %w", dir, err)
+	}
+	return &Archive{dir: dir}, nil
+}
+
+// Returns the hash that the given content is stored under.
+func Hash(content []byte) string {
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
+
+// Emails are sharded into subdirectories by the first two characters of
+// their hash to keep directories small.
+func (a *Archive) path(hash string) string {
+	return filepath.Join(a.dir, hash[:2], hash+extension)
+}
+
+// Saves the raw email and returns its hash.
+func (a *Archive) Put(content []byte) (string, error) {
+	hash := Hash(content)
+	path := a.path(hash)
+
+	if _, err := os.Stat(path); err == nil {
+		return hash, nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return "", fmt.Errorf("failed to create archive directory: %w", err)
+	}
+
+	// Write to a temporary file first so a crash cannot leave a partial email
+	// under a hash that does not match its content.
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, content, 0600); err != nil {
+		return "", fmt.Errorf("failed to archive email: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return "", fmt.Errorf("failed to archive email: %w", err)
+	}
+
+	return hash, nil
+}
+
+// Returns the raw email with the given hash.
+func (a *Archive) Get(hash string) ([]byte, error) {
+	if len(hash) < 2 {
+		return nil, fmt.Errorf("invalid archive hash %q", hash)
+	}
+	return os.ReadFile(a.path(hash))
+}
+
+// Returns the hashes of all archived emails, sorted.
+func (a *Archive) List() ([]string, error) {
+	var hashes []string
+	err := filepath.WalkDir(a.dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if !d.IsDir() && strings.HasSuffix(d.Name(), extension) {
+			hashes = append(hashes, strings.TrimSuffix(d.Name(), extension))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list archive: %w", err)
+	}
+
+	sort.Strings(hashes)
+	return hashes, nil
+}
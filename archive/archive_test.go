@@ -0,0 +1,47 @@
+package archive
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestArchive_PutGetList(t *testing.T) {
+	a, err := Open(filepath.Join(t.TempDir(), "archive"))
+	if err != nil {
+		t.Fatalf("Open returned an error: %v", err)
+	}
+
+	first := []byte("Subject: one\r\n\r\nbody")
+	second := []byte("Subject: two\r\n\r\nbody")
+
+	hash, err := a.Put(first)
+	if err != nil {
+		t.Fatalf("Put returned an error: %v", err)
+	}
+	if hash != Hash(first) {
+		t.Errorf("Expected hash %s, got %s", Hash(first), hash)
+	}
+
+	if again, err := a.Put(first); err != nil || again != hash {
+		t.Errorf("Expected archiving the same email to return the same hash, got %s, %v", again, err)
+	}
+	if _, err := a.Put(second); err != nil {
+		t.Fatalf("Put returned an error: %v", err)
+	}
+
+	hashes, err := a.List()
+	if err != nil {
+		t.Fatalf("List returned an error: %v", err)
+	}
+	if len(hashes) != 2 {
+		t.Fatalf("Expected 2 archived emails, got %v", hashes)
+	}
+
+	content, err := a.Get(hash)
+	if err != nil {
+		t.Fatalf("Get returned an error: %v", err)
+	}
+	if string(content) != string(first) {
+		t.Errorf("Expected archived content %q, got %q", string(first), string(content))
+	}
+}
@@ -1,14 +1,49 @@
 package common
 
 import (
+	"fmt"
 	"io/ioutil"
 
 	"gopkg.in/yaml.v3"
 )
 
 type Config struct {
-	Notifier      *string                 `yaml:"notifier"`
-	ProcessEmails []EmailProcessingConfig `yaml:"process_emails"`
+	Notifier   *string `yaml:"notifier"`
+	Source     *string `yaml:"source"`
+	StateFile  *string `yaml:"stateFile"`
+	ArchiveDir *string `yaml:"archiveDir"`
+	// Maps the last digits of account and card numbers, as extracted by the
+	// accountNumberSuffix target field, to the ID or name of a Firefly account.
+	AccountNumbers map[string]string       `yaml:"accountNumbers,omitempty"`
+	Graph          *GraphConfig            `yaml:"graph"`
+	Jmap           *JmapConfig             `yaml:"jmap"`
+	Pop3           *Pop3Config             `yaml:"pop3"`
+	ProcessEmails  []EmailProcessingConfig `yaml:"process_emails"`
+}
+
+// Returns the configured state store location, or the default if none is set.
+func (c *Config) GetStateFile() string {
+	if c.StateFile != nil && *c.StateFile != "" {
+		return *c.StateFile
+	}
+	return "scanner-state.db"
+}
+
+// Returns the configured raw email archive directory, or the default if none is set.
+func (c *Config) GetArchiveDir() string {
+	if c.ArchiveDir != nil && *c.ArchiveDir != "" {
+		return *c.ArchiveDir
+	}
+	return "archive"
+}
+
+// Options for the Microsoft Graph mail source. Credentials are read from
+// the environment rather than the config file.
+type GraphConfig struct {
+	// The display name or well-known name (e.g. "inbox") of the folder to read. Defaults to "inbox".
+	Folder string `yaml:"folder"`
+	// The category added to messages once processed. Defaults to "Firefly Processed".
+	ProcessedCategory string `yaml:"processedCategory"`
 }
 
 type EmailProcessingConfig struct {
@@ -17,28 +52,145 @@ type EmailProcessingConfig struct {
 }
 
 type ProcessingStep struct {
-	OptionName      string           `yaml:"optionName"`
-	Discriminator   Discriminator    `yaml:"discriminator"`
-	SourceAccountId int              `yaml:"sourceAccountId"`
+	// The name of a built-in preset whose discriminator and extraction steps
+	// this step uses, e.g. "chase-credit-card". Any other fields set here
+	// override the preset's.
+	Preset          string        `yaml:"preset,omitempty"`
+	OptionName      string        `yaml:"optionName"`
+	Discriminator   Discriminator `yaml:"discriminator"`
+	SourceAccountId int           `yaml:"sourceAccountId"`
+	// The name of the asset or liability account the email will be about,
+	// instead of its ID.
+	SourceAccountName string `yaml:"sourceAccountName,omitempty"`
+	// The type of the transactions this step extracts, e.g. "deposit" for
+	// refunds or payroll, unless a transactionType target field sets it.
+	// Defaults to inferring withdrawal or transfer from the destination account.
+	TransactionType string           `yaml:"transactionType,omitempty"`
 	ExtractionSteps []ExtractionStep `yaml:"extractionSteps"`
+	// Extracts a transaction for each match of a regex, for emails which list
+	// several transactions. The extraction steps above set the fields which
+	// all of the transactions share.
+	Repeat *RepeatingExtraction `yaml:"repeat,omitempty"`
+
+	// Values for the transaction's metadata, which override any extracted
+	// from the email. Each is a Go text/template over the extracted fields,
+	// e.g. "{{.Destination}} ({{.CardLast4}})", or simply a fixed value.
+	Description string   `yaml:"description,omitempty"`
+	Notes       string   `yaml:"notes,omitempty"`
+	Category    string   `yaml:"category,omitempty"`
+	Budget      string   `yaml:"budget,omitempty"`
+	Bill        string   `yaml:"bill,omitempty"`
+	Tags        []string `yaml:"tags,omitempty"`
 }
 
 type Discriminator struct {
 	Type  string `yaml:"type"`
 	Regex string `yaml:"regex"`
+	// The name of the header to match, for the headerRegex type.
+	Header string `yaml:"header,omitempty"`
+	// The discriminators combined by the all, any and not types.
+	Discriminators []Discriminator `yaml:"discriminators,omitempty"`
 }
 
 type ExtractionStep struct {
-	Type         string        `yaml:"type"`
-	Regex        string        `yaml:"regex"`
+	Type  string `yaml:"type"`
+	Regex string `yaml:"regex"`
+	// The name of the header to search, for the headerRegex type.
+	Header       string        `yaml:"header,omitempty"`
 	TargetFields []TargetField `yaml:"targetFields"`
 }
 
+// An extraction step whose regex is matched as many times as it is found,
+// e.g. once per row of a table of transactions. Each match is one transaction.
+type RepeatingExtraction struct {
+	ExtractionStep `yaml:",inline"`
+	// Steps to run against the text of each match, e.g. to pick the fields
+	// out of an HTML table row. Their plainTextBodyRegex and htmlBodyRegex
+	// types search the match rather than the whole body.
+	ExtractionSteps []ExtractionStep `yaml:"extractionSteps,omitempty"`
+}
+
 type TargetField struct {
-	GroupNumber int     `yaml:"groupNumber"`
+	GroupNumber int `yaml:"groupNumber"`
+	// The name of the regex group to use instead of GroupNumber, e.g. "merchant" for `(?P<merchant>...)`.
+	GroupName   string  `yaml:"groupName,omitempty"`
 	TargetField string  `yaml:"targetField"`
 	Format      *string `yaml:"format"`
-	TimeZone    *string `yaml:"timeZone,omitempty"`
+	// Further date layouts to try in order when the date does not match Format.
+	Formats  []string `yaml:"formats,omitempty"`
+	TimeZone *string  `yaml:"timeZone,omitempty"`
+	// The locale the amount or date is written in, e.g. "de-DE" for "1.234,56"
+	// or "3. März 2024". Defaults to "en-US".
+	Locale *string `yaml:"locale,omitempty"`
+	// Overrides the decimal separator of the locale for the amount.
+	DecimalSeparator *string `yaml:"decimalSeparator,omitempty"`
+	// Overrides the thousands separators of the locale for the amount. Any of the characters is accepted.
+	GroupSeparator *string `yaml:"groupSeparator,omitempty"`
+	// Changes applied in order to the captured text before it is used, e.g.
+	// to clean up a merchant name.
+	Transforms []Transform `yaml:"transforms,omitempty"`
+}
+
+// A change to a value extracted from an email.
+type Transform struct {
+	// One of trim, lowercase, uppercase, titlecase, replace, stripPrefixes,
+	// truncate, lookup or normalize.
+	Type string `yaml:"type"`
+	// The regex to replace, for the replace type.
+	Regex string `yaml:"regex,omitempty"`
+	// The text to replace the regex with, for the replace type. It can refer
+	// to groups of the regex, e.g. "$1".
+	Replacement string `yaml:"replacement,omitempty"`
+	// The prefixes to remove, for the stripPrefixes type. Defaults to those
+	// of common payment processors, such as "SQ *" and "PAYPAL *".
+	Prefixes []string `yaml:"prefixes,omitempty"`
+	// The maximum number of characters to keep, for the truncate type.
+	Length int `yaml:"length,omitempty"`
+	// The values to map to, keyed by the value or the start of the value, for
+	// the lookup type.
+	Values map[string]string `yaml:"values,omitempty"`
+	// The name of the built-in normalizer to apply, for the normalize type.
+	Name string `yaml:"name,omitempty"`
+}
+
+// Returns the separators to parse the amount with, from the locale and any
+// separators that override it.
+func (tf *TargetField) GetAmountFormat() (AmountFormat, error) {
+	format := DefaultAmountFormat
+	if tf.Locale != nil && *tf.Locale != "" {
+		var err error
+		format, err = AmountFormatForLocale(*tf.Locale)
+		if err != nil {
+			return AmountFormat{}, err
+		}
+	}
+	if tf.DecimalSeparator != nil {
+		format.DecimalSeparator = *tf.DecimalSeparator
+	}
+	if tf.GroupSeparator != nil {
+		format.GroupSeparators = *tf.GroupSeparator
+	}
+	return format, nil
+}
+
+// Options for the JMAP mail source. Credentials are read from the
+// environment rather than the config file.
+type JmapConfig struct {
+	// The name or role (e.g. "inbox") of the mailbox to read. Defaults to "inbox".
+	Mailbox string `yaml:"mailbox"`
+	// The keyword set on messages once processed. Defaults to "$seen".
+	ProcessedKeyword string `yaml:"processedKeyword"`
+	// The name or role of a mailbox to move messages to once processed. Optional.
+	ProcessedMailbox string `yaml:"processedMailbox"`
+}
+
+// Options for the POP3 mail source. Credentials are read from the
+// environment rather than the config file.
+type Pop3Config struct {
+	// The file used to track processed messages. Defaults to "pop3-state.json".
+	StateFile string `yaml:"stateFile"`
+	// Whether to delete messages from the server once they are processed.
+	DeleteAfterProcessing bool `yaml:"deleteAfterProcessing"`
 }
 
 func GetConfig(configFileLocation string) (*Config, error) {
@@ -53,5 +205,11 @@ func GetConfig(configFileLocation string) (*Config, error) {
 		return nil, err
 	}
 
+	for i := range config.ProcessEmails {
+		if err := config.ProcessEmails[i].ApplyPresets(); err != nil {
+			return nil, fmt.Errorf("process_emails entry %d: %w", i+1, err)
+		}
+	}
+
 	return &config, nil
 }
@@ -0,0 +1,292 @@
+package common
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	noBreakSpace       = "\u00a0"
+	narrowNoBreakSpace = "\u202f"
+)
+
+// The way amounts are written in each supported locale, by language and
+// optionally region. Regions are only listed when they differ from their
+// language.
+var localeAmountFormats = map[string]AmountFormat{
+	"en":    {DecimalSeparator: ".", GroupSeparators: ","},
+	"ja":    {DecimalSeparator: ".", GroupSeparators: ","},
+	"zh":    {DecimalSeparator: ".", GroupSeparators: ","},
+	"ko":    {DecimalSeparator: ".", GroupSeparators: ","},
+	"de":    {DecimalSeparator: ",", GroupSeparators: "."},
+	"de-ch": {DecimalSeparator: ".", GroupSeparators: "'’"},
+	"es":    {DecimalSeparator: ",", GroupSeparators: "."},
+	"es-mx": {DecimalSeparator: ".", GroupSeparators: ","},
+	"es-us": {DecimalSeparator: ".", GroupSeparators: ","},
+	"it":    {DecimalSeparator: ",", GroupSeparators: "."},
+	"nl":    {DecimalSeparator: ",", GroupSeparators: "."},
+	"pt":    {DecimalSeparator: ",", GroupSeparators: ". " + noBreakSpace},
+	"da":    {DecimalSeparator: ",", GroupSeparators: "."},
+	"tr":    {DecimalSeparator: ",", GroupSeparators: "."},
+	"id":    {DecimalSeparator: ",", GroupSeparators: "."},
+	"fr":    {DecimalSeparator: ",", GroupSeparators: " " + noBreakSpace + narrowNoBreakSpace},
+	"fr-ch": {DecimalSeparator: ".", GroupSeparators: "'’ " + noBreakSpace + narrowNoBreakSpace},
+	"sv":    {DecimalSeparator: ",", GroupSeparators: " " + noBreakSpace + narrowNoBreakSpace},
+	"nb":    {DecimalSeparator: ",", GroupSeparators: " " + noBreakSpace + narrowNoBreakSpace},
+	"fi":    {DecimalSeparator: ",", GroupSeparators: " " + noBreakSpace + narrowNoBreakSpace},
+	"pl":    {DecimalSeparator: ",", GroupSeparators: " " + noBreakSpace + narrowNoBreakSpace},
+	"cs":    {DecimalSeparator: ",", GroupSeparators: " " + noBreakSpace + narrowNoBreakSpace},
+	"ru":    {DecimalSeparator: ",", GroupSeparators: " " + noBreakSpace + narrowNoBreakSpace},
+}
+
+// Normalizes a locale such as "de_DE" or "de-DE" and returns it along with
+// its language, e.g. "de-de" and "de".
+func normalizeLocale(locale string) (string, string) {
+	normalized := strings.ToLower(strings.ReplaceAll(strings.TrimSpace(locale), "_", "-"))
+	language, _, _ := strings.Cut(normalized, "-")
+	return normalized, language
+}
+
+// Returns how amounts are written in the given locale, e.g. "en-US" or "de-DE".
+// A locale whose region is not known uses the format of its language.
+func AmountFormatForLocale(locale string) (AmountFormat, error) {
+	normalized, language := normalizeLocale(locale)
+	if format, ok := localeAmountFormats[normalized]; ok {
+		return format, nil
+	}
+	if format, ok := localeAmountFormats[language]; ok {
+		return format, nil
+	}
+	return AmountFormat{}, fmt.Errorf("unknown locale %q", locale)
+}
+
+// The names of months and weekdays in a language, in lower case, so that
+// dates written in it can be parsed with English layouts.
+type dateNames struct {
+	// January first, with any alternative spellings after the usual one.
+	months             [12][]string
+	monthAbbreviations [12][]string
+	// Sunday first, with any alternative spellings after the usual one.
+	weekdays             [7][]string
+	weekdayAbbreviations [7][]string
+	// The words for "today" and "yesterday".
+	today     []string
+	yesterday []string
+}
+
+// The month and weekday names of each supported language. Abbreviations which
+// are ambiguous, like "mar" for both martes and marzo in Spanish, are only
+// listed for the month.
+var localeDateNames = map[string]dateNames{
+	"de": {
+		months: [12][]string{
+			{"januar", "jänner"}, {"februar"}, {"märz"}, {"april"},
+			{"mai"}, {"juni"}, {"juli"}, {"august"},
+			{"september"}, {"oktober"}, {"november"}, {"dezember"},
+		},
+		monthAbbreviations: [12][]string{
+			{"jan", "jän"}, {"feb"}, {"mär", "mrz"}, {"apr"}, {}, {"jun"},
+			{"jul"}, {"aug"}, {"sept", "sep"}, {"okt"}, {"nov"}, {"dez"},
+		},
+		weekdays: [7][]string{
+			{"sonntag"}, {"montag"}, {"dienstag"}, {"mittwoch"},
+			{"donnerstag"}, {"freitag"}, {"samstag", "sonnabend"},
+		},
+		weekdayAbbreviations: [7][]string{
+			{"so"}, {"mo"}, {"di"}, {"mi"}, {"do"}, {"fr"}, {"sa"},
+		},
+		today:     []string{"heute"},
+		yesterday: []string{"gestern"},
+	},
+	"es": {
+		months: [12][]string{
+			{"enero"}, {"febrero"}, {"marzo"}, {"abril"},
+			{"mayo"}, {"junio"}, {"julio"}, {"agosto"},
+			{"septiembre", "setiembre"}, {"octubre"}, {"noviembre"}, {"diciembre"},
+		},
+		monthAbbreviations: [12][]string{
+			{"ene"}, {"feb"}, {"mar"}, {"abr"}, {"may"}, {"jun"},
+			{"jul"}, {"ago"}, {"sept", "sep", "set"}, {"oct"}, {"nov"}, {"dic"},
+		},
+		weekdays: [7][]string{
+			{"domingo"}, {"lunes"}, {"martes"}, {"miércoles", "miercoles"},
+			{"jueves"}, {"viernes"}, {"sábado", "sabado"},
+		},
+		weekdayAbbreviations: [7][]string{
+			{"dom"}, {"lun"}, {}, {"mié", "mie"}, {"jue"}, {"vie"}, {"sáb", "sab"},
+		},
+		today:     []string{"hoy"},
+		yesterday: []string{"ayer"},
+	},
+	"fr": {
+		months: [12][]string{
+			{"janvier"}, {"février", "fevrier"}, {"mars"}, {"avril"},
+			{"mai"}, {"juin"}, {"juillet"}, {"août", "aout"},
+			{"septembre"}, {"octobre"}, {"novembre"}, {"décembre", "decembre"},
+		},
+		monthAbbreviations: [12][]string{
+			{"janv"}, {"févr", "fév", "fevr", "fev"}, {}, {"avr"}, {}, {},
+			{"juil"}, {}, {"sept"}, {"oct"}, {"nov"}, {"déc", "dec"},
+		},
+		weekdays: [7][]string{
+			{"dimanche"}, {"lundi"}, {"mardi"}, {"mercredi"},
+			{"jeudi"}, {"vendredi"}, {"samedi"},
+		},
+		weekdayAbbreviations: [7][]string{
+			{"dim"}, {"lun"}, {"mar"}, {"mer"}, {"jeu"}, {"ven"}, {"sam"},
+		},
+		yesterday: []string{"hier"},
+	},
+	"it": {
+		months: [12][]string{
+			{"gennaio"}, {"febbraio"}, {"marzo"}, {"aprile"},
+			{"maggio"}, {"giugno"}, {"luglio"}, {"agosto"},
+			{"settembre"}, {"ottobre"}, {"novembre"}, {"dicembre"},
+		},
+		monthAbbreviations: [12][]string{
+			{"gen"}, {"feb"}, {"mar"}, {"apr"}, {"mag"}, {"giu"},
+			{"lug"}, {"ago"}, {"set"}, {"ott"}, {"nov"}, {"dic"},
+		},
+		weekdays: [7][]string{
+			{"domenica"}, {"lunedì", "lunedi"}, {"martedì", "martedi"}, {"mercoledì", "mercoledi"},
+			{"giovedì", "giovedi"}, {"venerdì", "venerdi"}, {"sabato"},
+		},
+		weekdayAbbreviations: [7][]string{
+			{"dom"}, {"lun"}, {}, {"mer"}, {"gio"}, {"ven"}, {"sab"},
+		},
+		today:     []string{"oggi"},
+		yesterday: []string{"ieri"},
+	},
+	"nl": {
+		months: [12][]string{
+			{"januari"}, {"februari"}, {"maart"}, {"april"},
+			{"mei"}, {"juni"}, {"juli"}, {"augustus"},
+			{"september"}, {"oktober"}, {"november"}, {"december"},
+		},
+		monthAbbreviations: [12][]string{
+			{"jan"}, {"feb"}, {"mrt"}, {"apr"}, {}, {"jun"},
+			{"jul"}, {"aug"}, {"sep"}, {"okt"}, {"nov"}, {"dec"},
+		},
+		weekdays: [7][]string{
+			{"zondag"}, {"maandag"}, {"dinsdag"}, {"woensdag"},
+			{"donderdag"}, {"vrijdag"}, {"zaterdag"},
+		},
+		weekdayAbbreviations: [7][]string{
+			{"zo"}, {"ma"}, {"di"}, {"wo"}, {"do"}, {"vr"}, {"za"},
+		},
+		today:     []string{"vandaag"},
+		yesterday: []string{"gisteren"},
+	},
+	"pt": {
+		months: [12][]string{
+			{"janeiro"}, {"fevereiro"}, {"março", "marco"}, {"abril"},
+			{"maio"}, {"junho"}, {"julho"}, {"agosto"},
+			{"setembro"}, {"outubro"}, {"novembro"}, {"dezembro"},
+		},
+		monthAbbreviations: [12][]string{
+			{"jan"}, {"fev"}, {"mar"}, {"abr"}, {"mai"}, {"jun"},
+			{"jul"}, {"ago"}, {"set"}, {"out"}, {"nov"}, {"dez"},
+		},
+		weekdays: [7][]string{
+			{"domingo"}, {"segunda-feira", "segunda"}, {"terça-feira", "terca-feira", "terça", "terca"}, {"quarta-feira", "quarta"},
+			{"quinta-feira", "quinta"}, {"sexta-feira", "sexta"}, {"sábado", "sabado"},
+		},
+		weekdayAbbreviations: [7][]string{
+			{"dom"}, {"seg"}, {"ter"}, {"qua"}, {"qui"}, {"sex"}, {"sáb", "sab"},
+		},
+		today:     []string{"hoje"},
+		yesterday: []string{"ontem"},
+	},
+}
+
+// Returns the English word for each month and weekday name of the language,
+// full names becoming full names and abbreviations becoming abbreviations.
+func (n dateNames) translations() map[string]string {
+	translations := make(map[string]string)
+	add := func(names []string, english string) {
+		for _, name := range names {
+			translations[name] = english
+		}
+	}
+
+	for i := range n.months {
+		month := time.Month(i + 1).String()
+		add(n.months[i], month)
+		add(n.monthAbbreviations[i], month[:3])
+	}
+	for i := range n.weekdays {
+		weekday := time.Weekday(i).String()
+		add(n.weekdays[i], weekday)
+		add(n.weekdayAbbreviations[i], weekday[:3])
+	}
+	add(n.today, "today")
+	add(n.yesterday, "yesterday")
+	return translations
+}
+
+// Translates the month and weekday names in a date written in the given
+// locale to English, e.g. "3. März 2024" in "de-DE" becomes "3. March 2024",
+// so that it can be parsed with Go's layouts. Dates in English are returned
+// unchanged.
+func TranslateDateNames(value string, locale string) (string, error) {
+	_, language := normalizeLocale(locale)
+	if language == "en" {
+		return value, nil
+	}
+	names, ok := localeDateNames[language]
+	if !ok {
+		return "", fmt.Errorf("no month and weekday names are known for locale %q", locale)
+	}
+	translations := names.translations()
+
+	// Longer names first, so that e.g. "segunda-feira" is preferred to "segunda"
+	words := make([]string, 0, len(translations))
+	for word := range translations {
+		words = append(words, word)
+	}
+	sort.Slice(words, func(i, j int) bool {
+		if len(words[i]) != len(words[j]) {
+			return len(words[i]) > len(words[j])
+		}
+		return words[i] < words[j]
+	})
+
+	var result strings.Builder
+	for i := 0; i < len(value); {
+		startOfWord := i == 0 || !isLetterBefore(value, i)
+		if startOfWord {
+			if word, ok := matchWord(value[i:], words); ok {
+				result.WriteString(translations[word])
+				i += len(word)
+				continue
+			}
+		}
+		r, size := utf8.DecodeRuneInString(value[i:])
+		result.WriteRune(r)
+		i += size
+	}
+	return result.String(), nil
+}
+
+// Returns the first of the words the text starts with as a whole word,
+// ignoring case.
+func matchWord(text string, words []string) (string, bool) {
+	for _, word := range words {
+		if len(text) < len(word) || !strings.EqualFold(text[:len(word)], word) {
+			continue
+		}
+		if next, _ := utf8.DecodeRuneInString(text[len(word):]); len(text) == len(word) || !unicode.IsLetter(next) {
+			return word, true
+		}
+	}
+	return "", false
+}
+
+func isLetterBefore(s string, i int) bool {
+	r, _ := utf8.DecodeLastRuneInString(s[:i])
+	return unicode.IsLetter(r)
+}
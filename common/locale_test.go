@@ -0,0 +1,48 @@
+package common
+
+import "testing"
+
+func TestAmountFormatForLocale_FallsBackToLanguage(t *testing.T) {
+	format, err := AmountFormatForLocale("de-AT")
+	if err != nil {
+		t.Fatalf("AmountFormatForLocale returned an error: %v", err)
+	}
+	if format.DecimalSeparator != "," {
+		t.Errorf("Expected a comma decimal separator, got %q", format.DecimalSeparator)
+	}
+
+	if _, err := AmountFormatForLocale("xx-YY"); err == nil {
+		t.Errorf("Expected an error for an unknown locale")
+	}
+}
+
+func TestTranslateDateNames(t *testing.T) {
+	tests := []struct {
+		value    string
+		locale   string
+		expected string
+	}{
+		{"3. März 2024", "de-DE", "3. March 2024"},
+		{"Mo, 3. MÄR 2024", "de_AT", "Mon, 3. Mar 2024"},
+		{"15 de marzo", "es-MX", "15 de March"},
+		{"viernes 15 de mar.", "es", "Friday 15 de Mar."},
+		{"jeudi 1er août", "fr-FR", "Thursday 1er August"},
+		{"segunda-feira, 4 de março", "pt-BR", "Monday, 4 de March"},
+		{"gisteren", "nl", "yesterday"},
+		{"Mar 3", "en-US", "Mar 3"},
+	}
+
+	for _, test := range tests {
+		translated, err := TranslateDateNames(test.value, test.locale)
+		if err != nil {
+			t.Fatalf("TranslateDateNames returned an error: %v", err)
+		}
+		if translated != test.expected {
+			t.Errorf("Expected %q, got %q", test.expected, translated)
+		}
+	}
+
+	if _, err := TranslateDateNames("3 mars", "sv-SE"); err == nil {
+		t.Errorf("Expected an error for a locale without known month names")
+	}
+}
@@ -2,45 +2,106 @@ package common
 
 import (
 	"fmt"
-	"strconv"
+	"strings"
 	"time"
 )
 
-type DollarAmount struct {
-	Dollars int
-	Cents   int
-}
-
 type TransactionType int
 
 const (
-	Transfer TransactionType = iota
+	// The type was not given, so it is inferred from the accounts involved.
+	Unspecified TransactionType = iota
+	Transfer
 	Withdrawal
 	Deposit
 )
 
+// The words accepted for each transaction type, either in configuration or
+// as extracted from an email.
+var transactionTypeNames = map[string]TransactionType{
+	"transfer":   Transfer,
+	"withdrawal": Withdrawal,
+	"debit":      Withdrawal,
+	"purchase":   Withdrawal,
+	"payment":    Withdrawal,
+	"deposit":    Deposit,
+	"credit":     Deposit,
+	"refund":     Deposit,
+	"payroll":    Deposit,
+}
+
+// Parses a transaction type such as "withdrawal" or "deposit", ignoring case.
+// Words banks commonly use, such as "debit", "credit" and "refund", are
+// accepted as well.
+func ParseTransactionType(value string) (TransactionType, error) {
+	if t, ok := transactionTypeNames[strings.ToLower(strings.TrimSpace(value))]; ok {
+		return t, nil
+	}
+	return Unspecified, fmt.Errorf("unknown transaction type %q", value)
+}
+
+func (t TransactionType) String() string {
+	switch t {
+	case Transfer:
+		return "transfer"
+	case Withdrawal:
+		return "withdrawal"
+	case Deposit:
+		return "deposit"
+	}
+	return "unspecified"
+}
+
 type EmailTransactionInfo struct {
-	Uid    uint32
+	// The source-specific identifier of the email, e.g. the IMAP UID.
+	Id     string
 	MailId string
-	Info   *TransactionInfo
+	// A hash of the email's text content, which identifies the email along
+	// with its Message-ID regardless of the source it was read from.
+	ContentHash string
+	// The transactions extracted from the email. Most emails are about a
+	// single transaction, but some list several. Empty if the email could
+	// not be parsed.
+	Transactions []TransactionInfo
+	// Why no transactions could be extracted from the email, or nil if they
+	// were. See the errors of the email package for the kinds of failure.
+	Err error
 }
 
 type TransactionInfo struct {
-	Amount          DollarAmount
+	Amount Money
+	// The amount in the currency the purchase was made in, when it differs
+	// from the currency of the account, e.g. the €45.00 in "€45.00 (USD 48.91)".
+	ForeignAmount   *Money
 	TransactionDate time.Time
+	// The configured account the email is about. It is the source of
+	// withdrawals and transfers and the destination of deposits.
 	SourceAccountId int
+	// The name of the configured account, used instead of SourceAccountId
+	// when it is set.
+	SourceAccountName string
+	// The last digits of the account or card number the email is about,
+	// which identify the account in place of the configured one.
+	AccountNumberSuffix string
+	// The name of the other party: the merchant for withdrawals and the
+	// payer for deposits.
 	DestinationName string
 	Type            TransactionType
-}
-
-func ParseMoney(value string) (string, error) {
-	amount, err := strconv.ParseFloat(value, 64)
-	if err != nil {
-		return "", err
-	}
-	return fmt.Sprintf("%.2f", amount), nil
-}
+	// The name of the processing step which extracted this transaction.
+	ProcessingStep string
 
-func (da *DollarAmount) String() string {
-	return fmt.Sprintf("%d.%02d", da.Dollars, da.Cents)
+	// Optional details which are passed on to Firefly when they are known.
+	Description string
+	Notes       string
+	Category    string
+	Budget      string
+	Tags        []string
+	Bill        string
+	BookDate    *time.Time
+	ProcessDate *time.Time
+	// The last four digits of the card used, e.g. "1234".
+	CardLast4  string
+	Cardholder string
+	// The bank's authorization or reference number for the transaction.
+	Reference string
 }
@@ -0,0 +1,246 @@
+package common
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// An exact decimal amount of money, optionally in a known currency.
+//
+// The amount is held as a whole number of units at a decimal scale, so
+// 12.34 is 1234 units at scale 2 and ¥1234 is 1234 units at scale 0.
+type Money struct {
+	Units int64
+	Scale int
+	// The ISO 4217 code of the currency, or empty if it is not known.
+	Currency string
+}
+
+// Creates an amount of money of the given units at the given scale.
+func NewMoney(units int64, scale int, currency string) Money {
+	return Money{Units: units, Scale: scale, Currency: currency}
+}
+
+// Returns the same amount at the given scale. Digits beyond a smaller scale
+// are truncated.
+func (m Money) Rescale(scale int) Money {
+	for m.Scale < scale {
+		m.Units *= 10
+		m.Scale++
+	}
+	for m.Scale > scale {
+		m.Units /= 10
+		m.Scale--
+	}
+	return m
+}
+
+// Reports whether the two amounts are numerically equal, regardless of
+// scale. The currencies are only compared when both are known.
+func (m Money) Equal(other Money) bool {
+	if m.Currency != "" && other.Currency != "" && m.Currency != other.Currency {
+		return false
+	}
+	scale := max(m.Scale, other.Scale)
+	return m.Rescale(scale).Units == other.Rescale(scale).Units
+}
+
+func (m Money) IsZero() bool {
+	return m.Units == 0
+}
+
+func (m Money) IsNegative() bool {
+	return m.Units < 0
+}
+
+// Returns the amount without its sign.
+func (m Money) Abs() Money {
+	if m.Units < 0 {
+		m.Units = -m.Units
+	}
+	return m
+}
+
+// Formats the amount as a plain decimal number, e.g. "-1234.50", as used by
+// the Firefly API.
+func (m Money) String() string {
+	digits := strconv.FormatInt(m.Abs().Units, 10)
+	sign := ""
+	if m.Units < 0 {
+		sign = "-"
+	}
+
+	if m.Scale <= 0 {
+		return sign + digits
+	}
+
+	if len(digits) <= m.Scale {
+		digits = strings.Repeat("0", m.Scale-len(digits)+1) + digits
+	}
+	whole := digits[:len(digits)-m.Scale]
+	fraction := digits[len(digits)-m.Scale:]
+	return sign + whole + "." + fraction
+}
+
+// Formats the amount for people to read, e.g. "12.34 EUR". Amounts with no
+// known currency are shown in dollars, which is what the scanner originally
+// assumed all amounts were.
+func (m Money) Display() string {
+	if m.Currency == "" {
+		if m.Units < 0 {
+			return "-$" + m.Abs().String()
+		}
+		return "$" + m.String()
+	}
+	return m.String() + " " + m.Currency
+}
+
+// The separators used to write amounts.
+type AmountFormat struct {
+	// The character between the whole and fractional parts, e.g. "." in 1,234.56.
+	DecimalSeparator string
+	// Characters used to group thousands, e.g. "," in 1,234.56. Any of them is accepted.
+	GroupSeparators string
+}
+
+// The format used when no locale or separators are configured.
+var DefaultAmountFormat = AmountFormat{DecimalSeparator: ".", GroupSeparators: ","}
+
+// Currency symbols which identify a single currency. The dollar and yen
+// signs are shared by several currencies, so they are not included.
+var currencySymbols = map[string]string{
+	"€": "EUR",
+	"£": "GBP",
+	"₹": "INR",
+	"₩": "KRW",
+	"₪": "ILS",
+	"₺": "TRY",
+	"₴": "UAH",
+	"₱": "PHP",
+	"₫": "VND",
+}
+
+// Parses a currency as written in an email, either as an ISO 4217 code such
+// as "eur" or as a symbol which identifies a single currency, such as "€".
+func ParseCurrency(value string) (string, error) {
+	s := strings.TrimSpace(value)
+	if code, ok := currencySymbols[s]; ok {
+		return code, nil
+	}
+
+	if len(s) == 3 && strings.IndexFunc(s, func(r rune) bool { return !unicode.IsLetter(r) || r > unicode.MaxASCII }) < 0 {
+		return strings.ToUpper(s), nil
+	}
+
+	return "", fmt.Errorf("unknown currency %q", value)
+}
+
+// Parses an amount as written in an email, e.g. "$1,234.56", "1.234,56 €",
+// "(42.10)", "-5" or "USD 48.91", using the given separators.
+//
+// Currency symbols, ISO currency codes and spaces around the number are
+// ignored, except that an unambiguous symbol or code sets the currency.
+// A leading or trailing minus sign, or parentheses around the amount, make it
+// negative. Amounts without a fractional part have a scale of 0. Every
+// group after a group separator must have three digits.
+func ParseAmount(value string, format AmountFormat) (Money, error) {
+	if format.DecimalSeparator == "" {
+		format.DecimalSeparator = DefaultAmountFormat.DecimalSeparator
+	}
+
+	s := strings.TrimSpace(value)
+	negative := false
+	if strings.HasPrefix(s, "(") && strings.HasSuffix(s, ")") {
+		negative = true
+		s = strings.TrimSpace(s[1 : len(s)-1])
+	}
+
+	currency := ""
+	for symbol, code := range currencySymbols {
+		if strings.Contains(s, symbol) {
+			currency = code
+			s = strings.ReplaceAll(s, symbol, "")
+		}
+	}
+
+	// Letters around the number are a currency code or symbol, e.g. "USD",
+	// "CHF" or "kr". Only three letter upper case words are taken as codes.
+	for _, word := range strings.FieldsFunc(s, func(r rune) bool { return !unicode.IsLetter(r) }) {
+		if len(word) == 3 && strings.ToUpper(word) == word {
+			currency = word
+		}
+	}
+	s = strings.TrimFunc(s, func(r rune) bool {
+		return !(r >= '0' && r <= '9') && r != '-' && r != '−' && string(r) != format.DecimalSeparator
+	})
+
+	for _, minus := range []string{"-", "−"} {
+		if strings.HasPrefix(s, minus) || strings.HasSuffix(s, minus) {
+			negative = !negative
+			s = strings.Trim(s, minus)
+			break
+		}
+	}
+	s = strings.TrimFunc(s, func(r rune) bool {
+		return !(r >= '0' && r <= '9') && string(r) != format.DecimalSeparator
+	})
+
+	var digits strings.Builder
+	scale := -1
+	// The number of digits since the last group separator, or -1 before the
+	// first. Each group after a separator must have exactly three digits, so
+	// that an amount written with another decimal separator, e.g. "45,00",
+	// is an error rather than a hundred times too large.
+	groupDigits := -1
+	for _, r := range s {
+		switch {
+		case r >= '0' && r <= '9':
+			digits.WriteRune(r)
+			if scale >= 0 {
+				scale++
+			} else if groupDigits >= 0 {
+				groupDigits++
+			}
+		case string(r) == format.DecimalSeparator:
+			if scale >= 0 {
+				return Money{}, fmt.Errorf("amount %q has more than one decimal separator", value)
+			}
+			if groupDigits >= 0 && groupDigits != 3 {
+				return Money{}, fmt.Errorf("amount %q has a group of %d digits rather than 3", value, groupDigits)
+			}
+			scale = 0
+		case strings.ContainsRune(format.GroupSeparators, r) || unicode.IsSpace(r):
+			if scale >= 0 {
+				return Money{}, fmt.Errorf("amount %q has a group separator after the decimal separator", value)
+			}
+			if groupDigits >= 0 && groupDigits != 3 {
+				return Money{}, fmt.Errorf("amount %q has a group of %d digits rather than 3", value, groupDigits)
+			}
+			groupDigits = 0
+		default:
+			return Money{}, fmt.Errorf("amount %q contains unexpected character %q", value, r)
+		}
+	}
+
+	if digits.Len() == 0 {
+		return Money{}, fmt.Errorf("amount %q contains no digits", value)
+	}
+	if scale < 0 && groupDigits >= 0 && groupDigits != 3 {
+		return Money{}, fmt.Errorf("amount %q has a group of %d digits rather than 3", value, groupDigits)
+	}
+	if scale < 0 {
+		scale = 0
+	}
+
+	units, err := strconv.ParseInt(digits.String(), 10, 64)
+	if err != nil {
+		return Money{}, fmt.Errorf("amount %q is out of range: %w", value, err)
+	}
+	if negative {
+		units = -units
+	}
+
+	return NewMoney(units, scale, currency), nil
+}
@@ -0,0 +1,62 @@
+package common
+
+import "testing"
+
+func TestParseAmount(t *testing.T) {
+	german, _ := AmountFormatForLocale("de-DE")
+	french, _ := AmountFormatForLocale("fr_FR")
+
+	tests := []struct {
+		value    string
+		format   AmountFormat
+		expected string
+		currency string
+	}{
+		{"$1,234.56", DefaultAmountFormat, "1234.56", ""},
+		{"1.234,56 €", german, "1234.56", "EUR"},
+		{"1 234,56 €", french, "1234.56", "EUR"},
+		{"¥1,234", DefaultAmountFormat, "1234", ""},
+		{"JPY 1,234", DefaultAmountFormat, "1234", "JPY"},
+		{"USD 48.91", DefaultAmountFormat, "48.91", "USD"},
+		{"(42.10)", DefaultAmountFormat, "-42.10", ""},
+		{"-$5", DefaultAmountFormat, "-5", ""},
+		{"12.00-", DefaultAmountFormat, "-12.00", ""},
+		{"42", DefaultAmountFormat, "42", ""},
+		{"0.05", DefaultAmountFormat, "0.05", ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.value, func(t *testing.T) {
+			amount, err := ParseAmount(test.value, test.format)
+			if err != nil {
+				t.Fatalf("ParseAmount returned an error: %v", err)
+			}
+			if amount.String() != test.expected {
+				t.Errorf("Expected %s, got %s", test.expected, amount.String())
+			}
+			if amount.Currency != test.currency {
+				t.Errorf("Expected currency %q, got %q", test.currency, amount.Currency)
+			}
+		})
+	}
+}
+
+func TestParseAmount_Invalid(t *testing.T) {
+	for _, value := range []string{"", "$", "1.2.3", "12.3,4", "12x4", "45,00 €", "€ -3,00", "1 234,56 €", "1,23"} {
+		if amount, err := ParseAmount(value, DefaultAmountFormat); err == nil {
+			t.Errorf("Expected an error parsing %q, got %s", value, amount.String())
+		}
+	}
+}
+
+func TestMoney_Equal(t *testing.T) {
+	if !NewMoney(42, 0, "").Equal(NewMoney(4200, 2, "USD")) {
+		t.Errorf("Expected 42 to equal 42.00 USD")
+	}
+	if NewMoney(4200, 2, "EUR").Equal(NewMoney(4200, 2, "USD")) {
+		t.Errorf("Expected amounts in different currencies not to be equal")
+	}
+	if NewMoney(4210, 2, "").Equal(NewMoney(42, 0, "")) {
+		t.Errorf("Expected 42.10 not to equal 42")
+	}
+}
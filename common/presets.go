@@ -0,0 +1,190 @@
+package common
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// A processing step for a known alert format, which a processing step uses
+// by naming it in `preset`.
+type preset struct {
+	// The address the alerts are sent from, used when the process_emails
+	// entry does not set fromEmail. Empty if banks send the format from
+	// different addresses.
+	fromEmail string
+	step      ProcessingStep
+}
+
+func stringPtr(s string) *string {
+	return &s
+}
+
+// The built-in presets, by name.
+var presets = map[string]preset{
+	// Chase credit card transaction alerts, with the amount and merchant in
+	// the subject, e.g. "Your $25.00 transaction with AMAZON MKTPL*AB12C3",
+	// and the card in the body, e.g. "Chase Freedom Unlimited (...1234)".
+	"chase-credit-card": {
+		fromEmail: "no.reply.alerts@chase.com",
+		step: ProcessingStep{
+			OptionName: "Chase credit card",
+			Discriminator: Discriminator{
+				Type:  "subjectRegex",
+				Regex: `^Your \$[\d,]+\.\d{2} transaction with `,
+			},
+			ExtractionSteps: []ExtractionStep{
+				{
+					Type:  "subjectRegex",
+					Regex: `^Your (?P<amount>\$[\d,]+\.\d{2}) transaction with (?P<destinationAccount>.+)$`,
+					TargetFields: []TargetField{
+						{GroupName: "destinationAccount", TargetField: "destinationAccount", Transforms: []Transform{{Type: "normalize", Name: "merchant"}}},
+					},
+				},
+				{
+					Regex: `\(\.\.\.(\d{4})\)`,
+					TargetFields: []TargetField{
+						{GroupNumber: 1, TargetField: "cardLast4"},
+						{GroupNumber: 1, TargetField: "accountNumberSuffix"},
+					},
+				},
+				{Type: "envelopeDate"},
+			},
+		},
+	},
+	// Capital One credit card transaction alerts, e.g. "we're notifying you
+	// that on June 1, 2024, at BLUE BOTTLE COFFEE, a pending authorization or
+	// purchase in the amount of $4.50 was placed or charged on your Capital
+	// One® Quicksilver Credit Card account ending in 1234."
+	"capital-one-credit-card": {
+		fromEmail: "capitalone@notification.capitalone.com",
+		step: ProcessingStep{
+			OptionName: "Capital One credit card",
+			Discriminator: Discriminator{
+				Type:  "plainTextBodyRegex",
+				Regex: `a\s+pending\s+authorization\s+or\s+purchase\s+in\s+the\s+amount\s+of`,
+			},
+			ExtractionSteps: []ExtractionStep{
+				{
+					// The plain text part wraps lines, so words are separated by
+					// any whitespace
+					Regex: `on\s+(?P<transactionDate>[A-Z][a-z]+\s+\d{1,2},\s+\d{4}),\s+at\s+(?P<destinationAccount>[^,]+?),\s+a\s+pending\s+authorization\s+or\s+purchase\s+in\s+the\s+amount\s+of\s+(?P<amount>\$[\d,]+\.\d{2})`,
+					TargetFields: []TargetField{
+						{GroupName: "transactionDate", TargetField: "transactionDate", Format: stringPtr("January 2, 2006"), TimeZone: stringPtr("America/New_York")},
+						{GroupName: "destinationAccount", TargetField: "destinationAccount", Transforms: []Transform{
+							{Type: "replace", Regex: `\s+`, Replacement: " "},
+							{Type: "normalize", Name: "merchant"},
+						}},
+					},
+				},
+				{
+					Regex: `account\s+ending\s+in\s+(\d{4})`,
+					TargetFields: []TargetField{
+						{GroupNumber: 1, TargetField: "cardLast4"},
+						{GroupNumber: 1, TargetField: "accountNumberSuffix"},
+					},
+				},
+			},
+		},
+	},
+	// Account withdrawal alerts in the format the scanner originally parsed,
+	// e.g. "$1,234.56 came out of your account ending in 1234" followed by
+	// "To: ACME CORP" and "Date: 01/02/24" lines. Banks send this format from
+	// different addresses, so fromEmail is required.
+	"account-withdrawal": {
+		step: ProcessingStep{
+			OptionName: "Account withdrawal",
+			Discriminator: Discriminator{
+				Type:  "plainTextBodyRegex",
+				Regex: `came out of your account ending in \d+`,
+			},
+			ExtractionSteps: []ExtractionStep{
+				{Regex: `(?P<amount>\$[\d,]+\.\d{2}) came out of your account ending in (?P<accountNumberSuffix>\d+)`},
+				{Regex: `^To:\s*(?P<destinationAccount>.+?)\s*$`},
+				{
+					Regex: `^Date:\s*(\d{2}/\d{2}/\d{2})\s*$`,
+					TargetFields: []TargetField{
+						{GroupNumber: 1, TargetField: "transactionDate", Format: stringPtr("01/02/06"), TimeZone: stringPtr("UTC")},
+					},
+				},
+			},
+		},
+	},
+}
+
+// Returns the names of the built-in presets, in alphabetical order.
+func PresetNames() []string {
+	names := make([]string, 0, len(presets))
+	for name := range presets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Replaces each processing step which names a preset with the preset's step,
+// keeping any fields the processing step sets itself, and sets fromEmail from
+// the presets if it is not set.
+func (c *EmailProcessingConfig) ApplyPresets() error {
+	for i, step := range c.ProcessingSteps {
+		if step.Preset == "" {
+			continue
+		}
+		preset, ok := presets[step.Preset]
+		if !ok {
+			return fmt.Errorf("processing step %d: unknown preset %q, the built-in presets are %s", i+1, step.Preset, strings.Join(PresetNames(), ", "))
+		}
+		c.ProcessingSteps[i] = preset.withOverrides(step)
+		if c.FromEmail == "" {
+			c.FromEmail = preset.fromEmail
+		}
+	}
+	return nil
+}
+
+// Returns the preset's step with the fields the given step sets in place of
+// its own.
+func (p preset) withOverrides(step ProcessingStep) ProcessingStep {
+	result := p.step
+	result.Preset = step.Preset
+	if step.OptionName != "" {
+		result.OptionName = step.OptionName
+	}
+	if step.Discriminator.Type != "" {
+		result.Discriminator = step.Discriminator
+	}
+	if step.SourceAccountId != 0 {
+		result.SourceAccountId = step.SourceAccountId
+	}
+	if step.SourceAccountName != "" {
+		result.SourceAccountName = step.SourceAccountName
+	}
+	if step.TransactionType != "" {
+		result.TransactionType = step.TransactionType
+	}
+	if len(step.ExtractionSteps) > 0 {
+		result.ExtractionSteps = step.ExtractionSteps
+	}
+	if step.Repeat != nil {
+		result.Repeat = step.Repeat
+	}
+	if step.Description != "" {
+		result.Description = step.Description
+	}
+	if step.Notes != "" {
+		result.Notes = step.Notes
+	}
+	if step.Category != "" {
+		result.Category = step.Category
+	}
+	if step.Budget != "" {
+		result.Budget = step.Budget
+	}
+	if step.Bill != "" {
+		result.Bill = step.Bill
+	}
+	if len(step.Tags) > 0 {
+		result.Tags = step.Tags
+	}
+	return result
+}
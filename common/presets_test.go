@@ -0,0 +1,54 @@
+package common
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestApplyPresets(t *testing.T) {
+	config := EmailProcessingConfig{
+		ProcessingSteps: []ProcessingStep{
+			{Preset: "chase-credit-card", SourceAccountId: 3, Tags: []string{"credit card"}},
+		},
+	}
+	if err := config.ApplyPresets(); err != nil {
+		t.Fatal(err)
+	}
+
+	if config.FromEmail != "no.reply.alerts@chase.com" {
+		t.Errorf("Expected fromEmail from the preset, got %q", config.FromEmail)
+	}
+	step := config.ProcessingSteps[0]
+	if step.SourceAccountId != 3 {
+		t.Errorf("Expected the overridden sourceAccountId 3, got %d", step.SourceAccountId)
+	}
+	if len(step.Tags) != 1 || step.Tags[0] != "credit card" {
+		t.Errorf("Expected the overridden tags, got %v", step.Tags)
+	}
+	if step.OptionName != "Chase credit card" || step.Discriminator.Type == "" || len(step.ExtractionSteps) == 0 {
+		t.Errorf("Expected the preset's option name, discriminator and extraction steps, got %+v", step)
+	}
+}
+
+func TestApplyPresets_KeepsFromEmail(t *testing.T) {
+	config := EmailProcessingConfig{
+		FromEmail:       "alerts@chase.example",
+		ProcessingSteps: []ProcessingStep{{Preset: "chase-credit-card"}},
+	}
+	if err := config.ApplyPresets(); err != nil {
+		t.Fatal(err)
+	}
+	if config.FromEmail != "alerts@chase.example" {
+		t.Errorf("Expected the configured fromEmail, got %q", config.FromEmail)
+	}
+}
+
+func TestApplyPresets_Unknown(t *testing.T) {
+	config := EmailProcessingConfig{
+		ProcessingSteps: []ProcessingStep{{OptionName: "Mine"}, {Preset: "no-such-bank"}},
+	}
+	err := config.ApplyPresets()
+	if err == nil || !strings.Contains(err.Error(), `processing step 2: unknown preset "no-such-bank"`) {
+		t.Errorf("Expected an unknown preset error, got %v", err)
+	}
+}
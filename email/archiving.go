@@ -0,0 +1,32 @@
+package email
+
+import (
+	"firefly-iii-email-scanner/archive"
+	"fmt"
+)
+
+// Wraps a source so that every message it returns is saved to an archive
+// before being processed.
+type archivingSource struct {
+	Source
+	archive *archive.Archive
+}
+
+// Returns a source which archives every message fetched from the given source.
+func WithArchive(source Source, a *archive.Archive) Source {
+	return &archivingSource{Source: source, archive: a}
+}
+
+func (s *archivingSource) Fetch(fromEmail string) ([]RawMessage, error) {
+	messages, err := s.Source.Fetch(fromEmail)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, msg := range messages {
+		if _, err := s.archive.Put(msg.Body); err != nil {
+			return nil, fmt.Errorf("failed to archive message %s: %w", msg.Id, err)
+		}
+	}
+	return messages, nil
+}
@@ -0,0 +1,151 @@
+package email
+
+import (
+	"firefly-iii-email-scanner/common"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The layout used when a date target field gives none.
+const defaultDateLayout = "01/02/06"
+
+// How far after the email's date a date may be before it is taken to be from
+// the previous year (or month). It allows for the email being sent in a time
+// zone behind the transaction's.
+const futureDateTolerance = 24 * time.Hour
+
+// Words which give a date relative to the day the email was sent, as a
+// number of days to add.
+var relativeDays = map[string]int{
+	"today":     0,
+	"yesterday": -1,
+}
+
+var (
+	daysAgoRegex    = regexp.MustCompile(`^(\d+) days? ago$`)
+	dayOfMonthRegex = regexp.MustCompile(`^(?:on )?(?:the )?(\d{1,2})(?:st|nd|rd|th)?$`)
+)
+
+// Parses a date captured for the transactionDate, bookDate or processDate
+// target fields, using the target field's layouts, time zone and locale, and
+// resolving relative and partial dates against the date the email was sent.
+func parseDate(targetField common.TargetField, value string, sent time.Time) (time.Time, error) {
+	if targetField.TimeZone == nil || *targetField.TimeZone == "" {
+		return time.Time{}, newExtractionError(ErrConfig, "timeZone is required when extracting %s", targetField.TargetField)
+	}
+
+	loc, err := time.LoadLocation(*targetField.TimeZone)
+	if err != nil {
+		return time.Time{}, newExtractionError(ErrConfig, "failed to load time zone %s: %w", *targetField.TimeZone, err)
+	}
+
+	if targetField.Locale != nil && *targetField.Locale != "" {
+		value, err = common.TranslateDateNames(value, *targetField.Locale)
+		if err != nil {
+			return time.Time{}, newExtractionError(ErrConfig, "invalid date locale: %w", err)
+		}
+	}
+
+	date, err := resolveDate(value, dateLayouts(targetField), loc, sent)
+	if err != nil {
+		return time.Time{}, &ExtractionError{Kind: ErrBadDate, Err: err}
+	}
+	return date.UTC(), nil
+}
+
+// Returns the layouts to try for a date target field, in order.
+func dateLayouts(targetField common.TargetField) []string {
+	var layouts []string
+	if targetField.Format != nil {
+		layouts = append(layouts, *targetField.Format)
+	}
+	layouts = append(layouts, targetField.Formats...)
+	if len(layouts) == 0 {
+		layouts = append(layouts, defaultDateLayout)
+	}
+	return layouts
+}
+
+// Parses a date as written in an email, in the given location.
+//
+// The value can be:
+//   - a relative date: "today", "yesterday" or "3 days ago"
+//   - a date in one of the layouts, tried in order. A layout without a year,
+//     such as "Jan 2", takes the year the email was sent, or the year before
+//     if the date would otherwise be after the email was sent. Feb 29 takes
+//     the most recent leap year
+//   - a day of the month on its own, such as "14th" or "on the 14th", in the
+//     month the email was sent, or the most recent month before that has the
+//     day if the day is still to come or the month does not have it
+//
+// Relative and partial dates fail if the date the email was sent is unknown,
+// which is given as the zero time.
+func resolveDate(value string, layouts []string, loc *time.Location, sent time.Time) (time.Time, error) {
+	value = strings.Join(strings.Fields(value), " ")
+	lower := strings.ToLower(value)
+	unknownSent := sent.IsZero()
+	sent = sent.In(loc)
+	sentDay := time.Date(sent.Year(), sent.Month(), sent.Day(), 0, 0, 0, 0, loc)
+	latest := sent.Add(futureDateTolerance)
+	errUnknownSent := fmt.Errorf("date %q depends on when the email was sent, which is unknown", value)
+
+	if days, ok := relativeDays[lower]; ok {
+		if unknownSent {
+			return time.Time{}, errUnknownSent
+		}
+		return sentDay.AddDate(0, 0, days), nil
+	}
+	if matches := daysAgoRegex.FindStringSubmatch(lower); matches != nil {
+		if unknownSent {
+			return time.Time{}, errUnknownSent
+		}
+		days, _ := strconv.Atoi(matches[1])
+		return sentDay.AddDate(0, 0, -days), nil
+	}
+
+	var errs []string
+	for _, layout := range layouts {
+		date, err := time.ParseInLocation(layout, value, loc)
+		if err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+
+		// Layouts without a year parse to year 0
+		if date.Year() == 0 {
+			if unknownSent {
+				return time.Time{}, errUnknownSent
+			}
+			// Feb 29 is taken from the most recent leap year
+			for year := sent.Year(); year > sent.Year()-8; year-- {
+				withYear := time.Date(year, date.Month(), date.Day(), date.Hour(), date.Minute(), date.Second(), date.Nanosecond(), loc)
+				if withYear.Day() == date.Day() && !withYear.After(latest) {
+					return withYear, nil
+				}
+			}
+			return time.Time{}, fmt.Errorf("date %q does not exist in any recent year", value)
+		}
+		return date, nil
+	}
+
+	if matches := dayOfMonthRegex.FindStringSubmatch(lower); matches != nil {
+		day, _ := strconv.Atoi(matches[1])
+		if day >= 1 && day <= 31 {
+			if unknownSent {
+				return time.Time{}, errUnknownSent
+			}
+			// Months without the day, e.g. February for the 30th, are skipped
+			for months := 0; months < 12; months++ {
+				date := time.Date(sent.Year(), sent.Month()-time.Month(months), day, 0, 0, 0, 0, loc)
+				if date.Day() == day && !date.After(latest) {
+					return date, nil
+				}
+			}
+		}
+	}
+
+	return time.Time{}, fmt.Errorf("date %q does not match any of the layouts %q: %s", value, layouts, strings.Join(errs, "; "))
+}
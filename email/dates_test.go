@@ -0,0 +1,153 @@
+package email
+
+import (
+	"errors"
+	"firefly-iii-email-scanner/common"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-message/mail"
+)
+
+func TestResolveDate(t *testing.T) {
+	loc, _ := time.LoadLocation("America/New_York")
+	// 2024-03-14 23:30 in New York, a day behind UTC
+	sent := time.Date(2024, 3, 15, 3, 30, 0, 0, time.UTC)
+	january := time.Date(2024, 1, 3, 15, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name     string
+		value    string
+		layouts  []string
+		sent     time.Time
+		expected time.Time
+	}{
+		{"full date", "03/10/2024", []string{"01/02/2006"}, sent, time.Date(2024, 3, 10, 0, 0, 0, 0, loc)},
+		{"fallback layout", "Mar 3, 2024", []string{"01/02/2006", "Jan 2, 2006"}, sent, time.Date(2024, 3, 3, 0, 0, 0, 0, loc)},
+		{"today", "Today", []string{"01/02/2006"}, sent, time.Date(2024, 3, 14, 0, 0, 0, 0, loc)},
+		{"yesterday", "yesterday", []string{"01/02/2006"}, sent, time.Date(2024, 3, 13, 0, 0, 0, 0, loc)},
+		{"days ago", "3 days ago", nil, sent, time.Date(2024, 3, 11, 0, 0, 0, 0, loc)},
+		{"without year", "Mar 3", []string{"Jan 2"}, sent, time.Date(2024, 3, 3, 0, 0, 0, 0, loc)},
+		{"without year with time", "Mar 3 4:05 PM", []string{"Jan 2 3:04 PM"}, sent, time.Date(2024, 3, 3, 16, 5, 0, 0, loc)},
+		{"previous year", "Dec 30", []string{"Jan 2"}, january, time.Date(2023, 12, 30, 0, 0, 0, 0, loc)},
+		{"day of month", "on the 14th", []string{"Jan 2"}, sent, time.Date(2024, 3, 14, 0, 0, 0, 0, loc)},
+		{"day of previous month", "the 20th", []string{"Jan 2"}, sent, time.Date(2024, 2, 20, 0, 0, 0, 0, loc)},
+		{"day of previous year", "31st", nil, january, time.Date(2023, 12, 31, 0, 0, 0, 0, loc)},
+		{"day missing from previous month", "on the 31st", nil, time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC), time.Date(2025, 1, 31, 0, 0, 0, 0, loc)},
+		{"day missing from this month", "31st", nil, time.Date(2025, 4, 30, 12, 0, 0, 0, time.UTC), time.Date(2025, 3, 31, 0, 0, 0, 0, loc)},
+		{"leap day without year", "Feb 29", []string{"Jan 2"}, time.Date(2025, 3, 14, 12, 0, 0, 0, time.UTC), time.Date(2024, 2, 29, 0, 0, 0, 0, loc)},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			date, err := resolveDate(test.value, test.layouts, loc, test.sent)
+			if err != nil {
+				t.Fatalf("resolveDate returned an error: %v", err)
+			}
+			if !date.Equal(test.expected) {
+				t.Errorf("Expected %v, got %v", test.expected, date)
+			}
+		})
+	}
+}
+
+func TestResolveDate_NoMatch(t *testing.T) {
+	if date, err := resolveDate("sometime", []string{"01/02/2006"}, time.UTC, time.Now()); err == nil {
+		t.Errorf("Expected an error, got %v", date)
+	}
+	if date, err := resolveDate("the 32nd", []string{"01/02/2006"}, time.UTC, time.Now()); err == nil {
+		t.Errorf("Expected an error for a day that does not exist, got %v", date)
+	}
+}
+
+func TestProcessEmail_YearlessDateFromDateHeader(t *testing.T) {
+	timeZone := "UTC"
+	config := common.EmailProcessingConfig{
+		ProcessingSteps: []common.ProcessingStep{
+			{
+				Discriminator: common.Discriminator{Type: "plainTextBodyRegex", Regex: "Posted"},
+				ExtractionSteps: []common.ExtractionStep{
+					{
+						Regex: `Posted (.+)$`,
+						TargetFields: []common.TargetField{
+							{GroupNumber: 1, TargetField: "transactionDate", Formats: []string{"01/02/2006", "Jan 2"}, TimeZone: &timeZone},
+						},
+					},
+				},
+			},
+		},
+	}
+
+	var header mail.Header
+	header.SetDate(time.Date(2025, 1, 2, 9, 0, 0, 0, time.UTC))
+	transaction := processSingleTransaction(t, &ParsedEmail{Header: header, PlainText: "Posted Dec 31"}, config)
+	expected := time.Date(2024, 12, 31, 0, 0, 0, 0, time.UTC)
+	if transaction == nil || !transaction.TransactionDate.Equal(expected) {
+		t.Errorf("Expected %v, got %+v", expected, transaction)
+	}
+}
+
+func TestProcessEmail_YearlessDateWithoutDateHeader(t *testing.T) {
+	timeZone := "UTC"
+	config := common.EmailProcessingConfig{
+		ProcessingSteps: []common.ProcessingStep{
+			{
+				Discriminator: common.Discriminator{Type: "plainTextBodyRegex", Regex: "Posted"},
+				ExtractionSteps: []common.ExtractionStep{
+					{
+						Regex: `Posted (.+)$`,
+						TargetFields: []common.TargetField{
+							{GroupNumber: 1, TargetField: "transactionDate", Formats: []string{"Jan 2"}, TimeZone: &timeZone},
+						},
+					},
+				},
+			},
+		},
+	}
+
+	received := time.Date(2025, 1, 2, 9, 0, 0, 0, time.UTC)
+	transaction := processSingleTransaction(t, &ParsedEmail{PlainText: "Posted Dec 31", Received: received}, config)
+	expected := time.Date(2024, 12, 31, 0, 0, 0, 0, time.UTC)
+	if transaction == nil || !transaction.TransactionDate.Equal(expected) {
+		t.Errorf("Expected the date the source received the email to be used, got %+v", transaction)
+	}
+
+	_, err := processEmail(&ParsedEmail{PlainText: "Posted Dec 31"}, config)
+	if !errors.Is(err, ErrBadDate) {
+		t.Errorf("Expected ErrBadDate when the date the email was sent is unknown, got %v", err)
+	}
+}
+
+func TestProcessEmail_LocalizedDateAndAmount(t *testing.T) {
+	timeZone := "Europe/Berlin"
+	format := "2. January 2006"
+	locale := "de-DE"
+	config := common.EmailProcessingConfig{
+		ProcessingSteps: []common.ProcessingStep{
+			{
+				Discriminator: common.Discriminator{Type: "plainTextBodyRegex", Regex: "Umsatz"},
+				ExtractionSteps: []common.ExtractionStep{
+					{
+						Regex: `Umsatz von (.+) am (.+)$`,
+						TargetFields: []common.TargetField{
+							{GroupNumber: 1, TargetField: "amount", Locale: &locale},
+							{GroupNumber: 2, TargetField: "transactionDate", Format: &format, TimeZone: &timeZone, Locale: &locale},
+						},
+					},
+				},
+			},
+		},
+	}
+
+	transaction := processSingleTransaction(t, &ParsedEmail{PlainText: "Umsatz von 1.234,56 € am 3. März 2024"}, config)
+	if transaction == nil {
+		t.Fatalf("processEmail returned nil")
+	}
+	if transaction.Amount.Display() != "1234.56 EUR" {
+		t.Errorf("Expected 1234.56 EUR, got %s", transaction.Amount.Display())
+	}
+	expected := time.Date(2024, 3, 2, 23, 0, 0, 0, time.UTC)
+	if !transaction.TransactionDate.Equal(expected) {
+		t.Errorf("Expected %v, got %v", expected, transaction.TransactionDate)
+	}
+}
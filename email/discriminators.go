@@ -0,0 +1,91 @@
+package email
+
+import (
+	"firefly-iii-email-scanner/common"
+	"regexp"
+)
+
+// The headers which name the recipients of an email, checked by the
+// recipientRegex discriminator. Forwarded emails often only keep the
+// original recipient in Delivered-To or X-Original-To.
+var recipientHeaders = []string{"To", "Cc", "Bcc", "Delivered-To", "X-Original-To"}
+
+// Reports whether the discriminator matches the email. Returns an error
+// wrapping ErrConfig if the discriminator is invalid.
+//
+// The supported types are:
+//   - plainTextBodyRegex: the regex is found in the body (the plain text part, or the HTML part if there is none)
+//   - htmlBodyRegex: the regex is found in the HTML part
+//   - subjectRegex: the regex is found in the decoded subject
+//   - headerRegex: the regex is found in any value of the header named by `header`
+//   - recipientRegex: the regex is found in any of the recipient headers
+//   - all: every one of `discriminators` matches
+//   - any: at least one of `discriminators` matches
+//   - not: none of `discriminators` match
+func matchesDiscriminator(d common.Discriminator, email *ParsedEmail) (bool, error) {
+	// Otherwise an empty all or not, e.g. from a mistake in indentation, would
+	// match every email from the sender
+	if (d.Type == "all" || d.Type == "any" || d.Type == "not") && len(d.Discriminators) == 0 {
+		return false, newExtractionError(ErrConfig, "%s has no discriminators", d.Type)
+	}
+
+	switch d.Type {
+	case "plainTextBodyRegex":
+		return matchesRegex(d.Regex, email.Body())
+	case "htmlBodyRegex":
+		return matchesRegex(d.Regex, email.Html)
+	case "subjectRegex":
+		return matchesRegex(d.Regex, email.Subject())
+	case "headerRegex":
+		if d.Header == "" {
+			return false, newExtractionError(ErrConfig, "header is required for a headerRegex discriminator")
+		}
+		return matchesAnyRegex(d.Regex, email.HeaderValues(d.Header))
+	case "recipientRegex":
+		var recipients []string
+		for _, header := range recipientHeaders {
+			recipients = append(recipients, email.HeaderValues(header)...)
+		}
+		return matchesAnyRegex(d.Regex, recipients)
+	case "all":
+		for _, child := range d.Discriminators {
+			if matches, err := matchesDiscriminator(child, email); !matches || err != nil {
+				return false, err
+			}
+		}
+		return true, nil
+	case "any":
+		for _, child := range d.Discriminators {
+			if matches, err := matchesDiscriminator(child, email); matches || err != nil {
+				return matches, err
+			}
+		}
+		return false, nil
+	case "not":
+		for _, child := range d.Discriminators {
+			if matches, err := matchesDiscriminator(child, email); matches || err != nil {
+				return false, err
+			}
+		}
+		return true, nil
+	}
+
+	return false, newExtractionError(ErrConfig, "unknown discriminator type `%s`", d.Type)
+}
+
+func matchesRegex(pattern string, text string) (bool, error) {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return false, newExtractionError(ErrConfig, "discriminator regex `%s` does not compile: %w", pattern, err)
+	}
+	return re.MatchString(text), nil
+}
+
+func matchesAnyRegex(pattern string, texts []string) (bool, error) {
+	for _, text := range texts {
+		if matches, err := matchesRegex(pattern, text); matches || err != nil {
+			return matches, err
+		}
+	}
+	return false, nil
+}
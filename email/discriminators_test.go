@@ -0,0 +1,100 @@
+package email
+
+import (
+	"errors"
+	"firefly-iii-email-scanner/common"
+	"testing"
+
+	"github.com/emersion/go-message/mail"
+)
+
+func newDiscriminatorTestEmail() *ParsedEmail {
+	var header mail.Header
+	header.SetSubject("Your Purchase of $42.10")
+	header.Set("To", "me@example.com")
+	header.Set("Delivered-To", "alerts@example.com")
+	header.Set("X-Bank-Alert", "card-transaction")
+
+	return &ParsedEmail{
+		Header:    header,
+		PlainText: "A charge on your card ending in 1234 was approved.",
+		Html:      "<p>A charge on your card ending in <b>1234</b> was approved.</p>",
+	}
+}
+
+func TestMatchesDiscriminator_Types(t *testing.T) {
+	email := newDiscriminatorTestEmail()
+
+	tests := []struct {
+		name          string
+		discriminator common.Discriminator
+		expected      bool
+	}{
+		{"plain text", common.Discriminator{Type: "plainTextBodyRegex", Regex: "ending in 1234"}, true},
+		{"html", common.Discriminator{Type: "htmlBodyRegex", Regex: "<b>1234</b>"}, true},
+		{"html does not search plain text", common.Discriminator{Type: "htmlBodyRegex", Regex: "ending in 1234"}, false},
+		{"subject", common.Discriminator{Type: "subjectRegex", Regex: `^Your Purchase of \$`}, true},
+		{"subject mismatch", common.Discriminator{Type: "subjectRegex", Regex: "Deposit"}, false},
+		{"header", common.Discriminator{Type: "headerRegex", Header: "X-Bank-Alert", Regex: "^card-"}, true},
+		{"missing header", common.Discriminator{Type: "headerRegex", Header: "X-Other", Regex: ".*"}, false},
+		{"recipient", common.Discriminator{Type: "recipientRegex", Regex: "alerts@example"}, true},
+		{"recipient mismatch", common.Discriminator{Type: "recipientRegex", Regex: "someone@else"}, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			actual, err := matchesDiscriminator(test.discriminator, email)
+			if err != nil {
+				t.Fatalf("matchesDiscriminator returned an error: %v", err)
+			}
+			if actual != test.expected {
+				t.Errorf("Expected %v, got %v", test.expected, actual)
+			}
+		})
+	}
+}
+
+func TestMatchesDiscriminator_Composites(t *testing.T) {
+	email := newDiscriminatorTestEmail()
+
+	purchase := common.Discriminator{Type: "subjectRegex", Regex: "Purchase"}
+	card := common.Discriminator{Type: "plainTextBodyRegex", Regex: "ending in 1234"}
+	declined := common.Discriminator{Type: "plainTextBodyRegex", Regex: "declined"}
+
+	all := common.Discriminator{Type: "all", Discriminators: []common.Discriminator{
+		purchase,
+		card,
+		{Type: "not", Discriminators: []common.Discriminator{declined}},
+	}}
+	if matches, _ := matchesDiscriminator(all, email); !matches {
+		t.Errorf("Expected purchase AND card AND NOT declined to match")
+	}
+
+	all.Discriminators = append(all.Discriminators, declined)
+	if matches, _ := matchesDiscriminator(all, email); matches {
+		t.Errorf("Expected all to fail when one discriminator does not match")
+	}
+
+	anyOf := common.Discriminator{Type: "any", Discriminators: []common.Discriminator{declined, card}}
+	if matches, _ := matchesDiscriminator(anyOf, email); !matches {
+		t.Errorf("Expected any to match when one discriminator matches")
+	}
+}
+
+func TestMatchesDiscriminator_UnknownType(t *testing.T) {
+	_, err := matchesDiscriminator(common.Discriminator{Type: "bodyRegex", Regex: ".*"}, newDiscriminatorTestEmail())
+	if !errors.Is(err, ErrConfig) {
+		t.Errorf("Expected a configuration error, got %v", err)
+	}
+
+	nested := common.Discriminator{Type: "any", Discriminators: []common.Discriminator{{Type: "subjectRegex", Regex: "("}}}
+	if _, err := matchesDiscriminator(nested, newDiscriminatorTestEmail()); !errors.Is(err, ErrConfig) {
+		t.Errorf("Expected a configuration error from a nested discriminator, got %v", err)
+	}
+
+	for _, composite := range []string{"all", "any", "not"} {
+		if _, err := matchesDiscriminator(common.Discriminator{Type: composite}, newDiscriminatorTestEmail()); !errors.Is(err, ErrConfig) {
+			t.Errorf("Expected a configuration error from %s with no discriminators, got %v", composite, err)
+		}
+	}
+}
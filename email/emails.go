@@ -1,17 +1,16 @@
 package email
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"firefly-iii-email-scanner/common"
 	"io"
 	"log"
-	"os"
-	"regexp"
-	"strconv"
 	"strings"
 	"time"
 
-	"github.com/emersion/go-imap"
-	"github.com/emersion/go-imap/client"
 	"github.com/emersion/go-message/mail"
 )
 
@@ -21,13 +20,13 @@ type TextPart interface {
 
 type PlainTextPart struct {
 	MessageId string
-	Uid       uint32
+	Id        string
 	PlainText string
 }
 
 type HtmlTextPart struct {
 	MessageId string
-	Uid       uint32
+	Id        string
 	HtmlText  string
 }
 
@@ -39,313 +38,349 @@ func (ptp *HtmlTextPart) GetText() string {
 	return ptp.HtmlText
 }
 
-func ParseText(plainText string) common.TransactionInfo {
-	lines := strings.Split(plainText, "\n")
+// An email after MIME parsing, with everything that processing steps can
+// match against.
+type ParsedEmail struct {
+	Header    mail.Header
+	PlainText string
+	Html      string
+	// When the source reports the message was sent or received, used if
+	// the Date header is missing or invalid.
+	Received time.Time
+}
 
-	retVal := common.TransactionInfo{}
+// Returns the text that body regexes run against: the plain text part, or
+// the HTML part if the email has no plain text.
+func (e *ParsedEmail) Body() string {
+	if e.PlainText != "" {
+		return e.PlainText
+	}
+	return e.Html
+}
 
-	amountAndAccountRegex, _ := regexp.Compile(`\$([\d,]+)\.(\d\d) came out of your account ending in (\d+)`)
-	amountRegex, _ := regexp.Compile(`^Amount:\s*\$([\d,]+)\.(\d\d)`)
-	detailsRegex, _ := regexp.Compile(`^Details:\s*(.*)$`)
-	toRegex, _ := regexp.Compile("^To:(.+)$")
-	dateRegex, _ := regexp.Compile("^Date:(.+)$")
+// Returns the decoded subject of the email.
+func (e *ParsedEmail) Subject() string {
+	subject, err := e.Header.Subject()
+	if err != nil {
+		return e.Header.Get("Subject")
+	}
+	return subject
+}
 
-	matches := 0
+// Returns the date the email was sent, from its Date header, or the date
+// reported by the source if it has none. Returns the zero time if neither is
+// known.
+func (e *ParsedEmail) Date() time.Time {
+	if date, err := e.Header.Date(); err == nil && !date.IsZero() {
+		return date
+	}
+	return e.Received
+}
 
-	for _, line := range lines {
-		amountAndAccountResult := amountAndAccountRegex.FindStringSubmatch(line)
-		if amountAndAccountResult != nil {
-			matches = matches + 1
-			dollars, _ := strconv.Atoi(strings.ReplaceAll(amountAndAccountResult[1], ",", ""))
-			cents, _ := strconv.Atoi(amountAndAccountResult[2])
-			account := amountAndAccountResult[3]
+// Returns the decoded values of every header with the given name.
+func (e *ParsedEmail) HeaderValues(name string) []string {
+	var values []string
+	fields := e.Header.FieldsByKey(name)
+	for fields.Next() {
+		value, err := fields.Text()
+		if err != nil {
+			value = fields.Value()
+		}
+		values = append(values, value)
+	}
+	return values
+}
 
-			retVal.SourceAccountId, _ = strconv.Atoi(account) // this is clearly wrong, just a temp thing
-			retVal.Amount = common.DollarAmount{
-				Dollars: dollars,
-				Cents:   cents,
-			}
-			continue
-		} else {
-			amountRegex := amountRegex.FindStringSubmatch(line)
-			detailsRegex := detailsRegex.FindStringSubmatch(line)
-
-			if amountRegex != nil && detailsRegex != nil {
-				matches = matches + 1
-				dollars, _ := strconv.Atoi(strings.ReplaceAll(amountRegex[1], ",", ""))
-				cents, _ := strconv.Atoi(amountRegex[2])
-				retVal.Amount = common.DollarAmount{
-					Dollars: dollars,
-					Cents:   cents,
-				}
-				retVal.DestinationName = strings.TrimSpace(detailsRegex[1])
-				continue
-			}
+// Retrieves the unprocessed emails for each of the given configurations from
+// the source and extracts transaction information from them.
+func GetTransactions(source Source, configs []common.EmailProcessingConfig) ([]common.EmailTransactionInfo, error) {
+	var result []common.EmailTransactionInfo
+
+	for _, config := range configs {
+		log.Printf("Checking for emails from %s", config.FromEmail)
+
+		messages, err := source.Fetch(config.FromEmail)
+		if err != nil {
+			return nil, err
 		}
 
-		toResult := toRegex.FindStringSubmatch(line)
-		if toResult != nil {
-			matches = matches + 1
-			target := strings.TrimSpace(toResult[1])
-			retVal.DestinationName = target
+		if len(messages) == 0 {
+			log.Println("No emails matching filters were found")
 			continue
 		}
 
-		dateResult := dateRegex.FindStringSubmatch(line)
-		if dateResult != nil {
-			matches = matches + 1
-			date, timeParseError := time.Parse("01/02/06", strings.TrimSpace(dateResult[1]))
-			if timeParseError == nil {
-				retVal.TransactionDate = date
-			} else {
-				log.Panic(timeParseError)
-			}
-			continue
+		log.Printf("Got %d search results to process\n", len(messages))
+
+		for _, msg := range messages {
+			result = append(result, processMessage(msg, config))
 		}
 	}
-	if matches != 3 {
-		log.Panicf("Failed to extract all info from email\n%s", plainText)
-	}
-	return retVal
-}
-
-var c *client.Client
 
-func GetTransactions(configs []common.EmailProcessingConfig) []common.EmailTransactionInfo {
-	var server = os.Getenv("IMAP_SERVER")
-	var email = os.Getenv("IMAP_EMAIL")
-	var password = os.Getenv("IMAP_PASSWORD")
+	log.Printf("Returning %d transactions", len(result))
+	return result, nil
+}
 
-	// Connect to Gmail
-	log.Printf("Connecting to server \"%s\"...\n", server)
-	var err error
-	c, err = client.DialTLS(server, nil)
+// Finds the configuration for the sender of the raw message and extracts
+// transaction information from it, as `GetTransactions` would have. Returns
+// nil if none of the configurations are for the message's sender.
+func ProcessRawMessage(msg RawMessage, configs []common.EmailProcessingConfig) *common.EmailTransactionInfo {
+	m, err := mail.CreateReader(bytes.NewReader(msg.Body))
 	if err != nil {
-		log.Panic("Error connecting to server:", err)
+		return &common.EmailTransactionInfo{
+			Id:     msg.Id,
+			MailId: msg.MessageId,
+			Err:    &ExtractionError{Kind: ErrMalformedEmail, Err: err},
+		}
+	}
+	config := ConfigForSender(&ParsedEmail{Header: m.Header}, configs)
+	if config == nil {
+		return nil
 	}
-	log.Println("Connected to Gmail IMAP server.")
+	info := processMessage(msg, *config)
+	return &info
+}
 
-	// Login
-	if err := c.Login(email, password); err != nil {
-		log.Panic("Error logging in:", err)
+// Returns the configuration for the sender of the email, or nil if none of
+// the configurations are for it.
+func ConfigForSender(email *ParsedEmail, configs []common.EmailProcessingConfig) *common.EmailProcessingConfig {
+	from := strings.ToLower(email.Header.Get("From"))
+	for i := range configs {
+		if strings.Contains(from, strings.ToLower(configs[i].FromEmail)) {
+			return &configs[i]
+		}
 	}
-	log.Println("Logged in as", email)
+	return nil
+}
 
-	// Select INBOX
-	mbox, err := c.Select("INBOX", false)
+// Parses the MIME structure of a raw message and runs the configured
+// processing steps against its text.
+func processMessage(msg RawMessage, config common.EmailProcessingConfig) common.EmailTransactionInfo {
+	messageId := msg.MessageId
+
+	m, err := mail.CreateReader(bytes.NewReader(msg.Body))
 	if err != nil {
-		log.Panic("Error selecting INBOX:", err)
+		log.Printf("Failed to parse message ID %s: %v", messageId, err)
+		return common.EmailTransactionInfo{
+			Id:     msg.Id,
+			MailId: messageId,
+			Err:    &ExtractionError{Kind: ErrMalformedEmail, Err: err},
+		}
 	}
-	log.Printf("INBOX has %d messages\n", mbox.Messages)
 
-	if mbox.Messages == 0 {
-		log.Println("No messages to fetch")
-		return []common.EmailTransactionInfo{}
+	// Sources report the Message-ID in different forms, so prefer the header
+	// itself to keep it consistent in the state store and notifications.
+	if id, err := m.Header.MessageID(); err == nil && id != "" {
+		messageId = "<" + id + ">"
 	}
 
-	var result []common.EmailTransactionInfo
-
-	for _, config := range configs {
-		log.Printf("Checking for emails from %s", config.FromEmail)
-
-		criteria := imap.NewSearchCriteria()
-		criteria.Header.Set("From", config.FromEmail)
-		criteria.WithoutFlags = []string{"\\Seen"}
+	textPart, htmlPart := readParts(m, msg, messageId)
 
-		searchRes, searchErr := c.Search(criteria)
-		if searchErr != nil {
-			log.Panic("Error searching for email:", searchErr)
+	var transactions []common.TransactionInfo
+	var processErr error
+	if textPart != nil || htmlPart != nil {
+		transactions, processErr = processEmail(newParsedEmail(m.Header, msg.Date, textPart, htmlPart), config)
+		if processErr != nil {
+			log.Printf("Failed to extract transactions from message ID %s: %v", messageId, processErr)
 		}
+	} else {
+		log.Println("No valid parts found for email")
+		processErr = newExtractionError(ErrMalformedEmail, "no text or HTML part")
+	}
 
-		if len(searchRes) == 0 {
-			log.Println("No emails matching filters were found")
+	for i := range transactions {
+		if !transactions[i].TransactionDate.IsZero() {
 			continue
 		}
 
-		log.Printf("Got %d search results to process\n", len(searchRes))
-
-		seqSet := new(imap.SeqSet)
-		seqSet.AddNum(searchRes...)
-
-		messages := make(chan *imap.Message, mbox.Messages)
-		done := make(chan error, 1)
-
-		section := &imap.BodySectionName{}
-		section.Peek = true
+		// If date wasn't set by processEmail, use the date reported by the source
+		date := msg.Date
+		if date.IsZero() {
+			date, _ = m.Header.Date()
+		}
+		if !date.IsZero() {
+			log.Printf("Transaction date not found in email body for message ID %s. Using email received time.", messageId)
+			transactions[i].TransactionDate = date.UTC()
+		} else {
+			log.Printf("WARNING: Cannot set fallback transaction date for message ID %s as the message date is unknown.", messageId)
+		}
+	}
 
-		go func() {
-			done <- c.Fetch(seqSet, []imap.FetchItem{section.FetchItem(), imap.FetchEnvelope, imap.FetchUid}, messages)
-		}()
+	return common.EmailTransactionInfo{
+		Id:           msg.Id,
+		MailId:       messageId,
+		ContentHash:  contentHash(textPart, htmlPart),
+		Transactions: transactions,
+		Err:          processErr,
+	}
+}
 
-		if err := <-done; err != nil {
-			log.Panic("Error fetching message:", err)
-		}
+// Parses a raw message into the parts that processing steps match against,
+// without running any of them.
+func ParseRawMessage(msg RawMessage) (*ParsedEmail, error) {
+	m, err := mail.CreateReader(bytes.NewReader(msg.Body))
+	if err != nil {
+		return nil, &ExtractionError{Kind: ErrMalformedEmail, Err: err}
+	}
+	textPart, htmlPart := readParts(m, msg, msg.MessageId)
+	if textPart == nil && htmlPart == nil {
+		return nil, newExtractionError(ErrMalformedEmail, "no text or HTML part")
+	}
+	return newParsedEmail(m.Header, msg.Date, textPart, htmlPart), nil
+}
 
-		for msg := range messages {
-			messageId := msg.Envelope.MessageId
-			uid := msg.Uid
+func newParsedEmail(header mail.Header, received time.Time, textPart *PlainTextPart, htmlPart *HtmlTextPart) *ParsedEmail {
+	email := &ParsedEmail{Header: header, Received: received}
+	if textPart != nil {
+		email.PlainText = textPart.GetText()
+	}
+	if htmlPart != nil {
+		email.Html = htmlPart.GetText()
+	}
+	return email
+}
 
-			m, err := mail.CreateReader(msg.GetBody(section))
-			if err != nil {
-				log.Panic(err)
+// Reads the first inline text and HTML parts of a message, skipping any
+// attachments.
+func readParts(m *mail.Reader, msg RawMessage, messageId string) (*PlainTextPart, *HtmlTextPart) {
+	var textPart *PlainTextPart
+	var htmlPart *HtmlTextPart
+
+	for {
+		part, err := m.NextPart()
+		if err != nil {
+			if err == io.EOF {
+				break
 			}
+			log.Printf("(skip mail): parse part: %v", err)
+			break
+		}
 
-			var textPart *PlainTextPart
-			var htmlPart *HtmlTextPart
-
-			for {
-				part, err := m.NextPart()
+		switch part.Header.(type) {
+		case *mail.InlineHeader:
+			contentType := part.Header.Get("Content-Type")
+			if strings.Contains(contentType, "text/plain") {
+				if textPart != nil {
+					log.Printf("Skipping a second inline text section")
+					continue
+				}
+				body, err := io.ReadAll(part.Body)
 				if err != nil {
-					if err == io.EOF {
-						break
+					log.Printf("(skip) read plain body: %v", err)
+				} else {
+					textPart = &PlainTextPart{
+						MessageId: messageId,
+						Id:        msg.Id,
+						PlainText: string(body),
 					}
-					log.Printf("(skip mail): parse part: %v", err)
-					break
 				}
-
-				switch part.Header.(type) {
-				case *mail.InlineHeader:
-					contentType := part.Header.Get("Content-Type")
-					if strings.Contains(contentType, "text/plain") {
-						if textPart != nil {
-							log.Printf("Skipping a second inline text section")
-							continue
-						}
-						body, err := io.ReadAll(part.Body)
-						if err != nil {
-							log.Printf("(skip) read plain body: %v", err)
-						} else {
-							textPart = &PlainTextPart{
-								MessageId: messageId,
-								Uid:       uid,
-								PlainText: string(body),
-							}
-						}
-					} else if strings.Contains(contentType, "text/html") {
-						if htmlPart != nil {
-							log.Printf("Skipping a second inline HTML section")
-							continue
-						}
-						body, err := io.ReadAll(part.Body)
-						if err != nil {
-							log.Printf("Failed to read HTML: %v", err)
-						} else {
-							htmlPart = &HtmlTextPart{
-								MessageId: messageId,
-								HtmlText:  string(body),
-							}
-						}
-					}
-				case *mail.AttachmentHeader:
-					log.Printf("Skipping attachment.")
-				default:
-					log.Printf("Not sure what I've seen here")
+			} else if strings.Contains(contentType, "text/html") {
+				if htmlPart != nil {
+					log.Printf("Skipping a second inline HTML section")
+					continue
 				}
-			}
-
-			var transaction *common.TransactionInfo
-			if textPart != nil {
-				transaction = processEmail(textPart.GetText(), config)
-			} else if htmlPart != nil {
-				transaction = processEmail(htmlPart.GetText(), config)
-			} else {
-				log.Println("No valid parts found for email")
-			}
-
-			if transaction != nil && transaction.TransactionDate.IsZero() {
-				// If date wasn't set by processEmail, use envelope date
-				if msg.Envelope != nil && !msg.Envelope.Date.IsZero() { // Ensure envelope and date are not nil/zero
-					log.Printf("Transaction date not found in email body for message ID %s. Using email received time.", messageId)
-					transaction.TransactionDate = msg.Envelope.Date.UTC()
+				body, err := io.ReadAll(part.Body)
+				if err != nil {
+					log.Printf("Failed to read HTML: %v", err)
 				} else {
-					log.Printf("WARNING: Cannot set fallback transaction date for message ID %s as envelope or envelope date is nil/zero.", messageId)
+					htmlPart = &HtmlTextPart{
+						MessageId: messageId,
+						Id:        msg.Id,
+						HtmlText:  string(body),
+					}
 				}
 			}
-
-			result = append(result, common.EmailTransactionInfo{
-				Uid:    uid,
-				MailId: messageId,
-				Info:   transaction,
-			})
+		case *mail.AttachmentHeader:
+			log.Printf("Skipping attachment.")
+		default:
+			log.Printf("Not sure what I've seen here")
 		}
 	}
 
-	log.Printf("Returning %d transactions", len(result))
-	return result
+	return textPart, htmlPart
+}
+
+// Hashes the text content of an email. Only the decoded text parts are used
+// so that the hash does not depend on MIME boundaries or transport headers.
+func contentHash(textPart *PlainTextPart, htmlPart *HtmlTextPart) string {
+	h := sha256.New()
+	if textPart != nil {
+		io.WriteString(h, textPart.GetText())
+	}
+	h.Write([]byte{0})
+	if htmlPart != nil {
+		io.WriteString(h, htmlPart.GetText())
+	}
+	return hex.EncodeToString(h.Sum(nil))
 }
 
-func processEmail(body string, config common.EmailProcessingConfig) *common.TransactionInfo {
+// Runs the first processing step whose discriminator matches the email and
+// returns the transactions it extracts: one, or one per match of the step's
+// repeat regex. Returns an `ExtractionError` wrapping ErrNoStepMatched if no
+// step matches, or describing why the matching step failed.
+func processEmail(email *ParsedEmail, config common.EmailProcessingConfig) ([]common.TransactionInfo, error) {
 	for _, step := range config.ProcessingSteps {
-		if step.Discriminator.Type == "plainTextBodyRegex" {
-			matched, _ := regexp.MatchString(step.Discriminator.Regex, body)
-			if matched {
-				transaction := common.TransactionInfo{
-					SourceAccountId: step.SourceAccountId,
-				}
-				for _, extractionStep := range step.ExtractionSteps {
-					re := regexp.MustCompile("(?m)" + extractionStep.Regex)
-					matches := re.FindStringSubmatch(body)
-					if matches == nil {
-						log.Panicf("Failed to extract all info from email because regex `%s` was not found\n%s", extractionStep.Regex, body)
-					}
-					for _, targetField := range extractionStep.TargetFields {
-						value := matches[targetField.GroupNumber]
-						switch targetField.TargetField {
-						case "dollars":
-							dollars, _ := strconv.Atoi(strings.ReplaceAll(value, ",", ""))
-							transaction.Amount.Dollars = dollars
-						case "cents":
-							cents, _ := strconv.Atoi(value)
-							transaction.Amount.Cents = cents
-						case "transactionDate":
-							format := "01/02/06"
-							if targetField.Format != nil {
-								format = *targetField.Format
-							}
-
-							if targetField.TimeZone == nil || *targetField.TimeZone == "" {
-								log.Panic("TimeZone is required in email processing configuration when extracting transactionDate.")
-							}
-
-							loc, err := time.LoadLocation(*targetField.TimeZone)
-							if err != nil {
-								log.Panicf("Failed to load timezone: %s %v", *targetField.TimeZone, err)
-							}
-
-							date, err := time.ParseInLocation(format, strings.TrimSpace(value), loc)
-							if err != nil {
-								log.Panicf("Failed to parse date with timezone: %v", err)
-							}
-							transaction.TransactionDate = date.UTC()
-						case "destinationAccount":
-							transaction.DestinationName = strings.TrimSpace(value)
-						}
-					}
-				}
-				return &transaction
-			}
+		matches, err := matchesDiscriminator(step.Discriminator, email)
+		if err != nil {
+			return nil, inStep(err, step)
+		}
+		if !matches {
+			continue
 		}
+
+		transactions, err := runProcessingStep(step, email)
+		if err != nil {
+			return nil, inStep(err, step)
+		}
+		return transactions, nil
 	}
 
-	log.Printf("No processing step matched for email\n%s", body)
-	return nil
+	return nil, &ExtractionError{Kind: ErrNoStepMatched}
 }
 
-// Marks the email with the given uid as "read".
-func MarkRead(uid uint32) {
-	// if _, selectErr := c.Select("INBOX", false); selectErr != nil {
-	// 	log.Panic("Unable to select INBOX:", selectErr)
-	// }
+// Runs a processing step whose discriminator matched the email.
+func runProcessingStep(step common.ProcessingStep, email *ParsedEmail) ([]common.TransactionInfo, error) {
+	transaction := common.TransactionInfo{
+		SourceAccountId:   step.SourceAccountId,
+		SourceAccountName: step.SourceAccountName,
+		ProcessingStep:    step.OptionName,
+	}
+	if step.TransactionType != "" {
+		transactionType, err := common.ParseTransactionType(step.TransactionType)
+		if err != nil {
+			return nil, newExtractionError(ErrConfig, "invalid transactionType: %w", err)
+		}
+		transaction.Type = transactionType
+	}
+	for _, extractionStep := range step.ExtractionSteps {
+		if err := extract(extractionStep, email, &transaction); err != nil {
+			return nil, err
+		}
+	}
 
-	seqSet := new(imap.SeqSet)
-	seqSet.AddNum(uid)
+	if step.Repeat == nil {
+		if err := applyStepFields(step, email, &transaction); err != nil {
+			return nil, err
+		}
+		return []common.TransactionInfo{transaction}, nil
+	}
 
-	item := imap.FormatFlagsOp(imap.AddFlags, true)
-	flags := []interface{}{imap.SeenFlag}
+	transactions, err := extractRepeated(*step.Repeat, email, transaction)
+	if err != nil {
+		return nil, err
+	}
+	for i := range transactions {
+		if err := applyStepFields(step, email, &transactions[i]); err != nil {
+			return nil, err
+		}
+	}
+	return transactions, nil
+}
 
-	if err := c.Store(seqSet, item, flags, nil); err != nil {
-		log.Panic("Unable to mark message as read:", err)
-	} else {
-		log.Printf("Should have marked as read")
+// Records the processing step an extraction error happened in.
+func inStep(err error, step common.ProcessingStep) error {
+	var extractionErr *ExtractionError
+	if errors.As(err, &extractionErr) && extractionErr.Step == "" {
+		extractionErr.Step = step.OptionName
 	}
+	return err
 }
@@ -1,6 +1,7 @@
 package email
 
 import (
+	"errors"
 	"firefly-iii-email-scanner/common"
 	"testing"
 	"time"
@@ -32,7 +33,7 @@ func TestProcessEmail_DateExtractionWithValidTimezone(t *testing.T) {
 	}
 
 	emailBody := "Some email content... Date: 03/15/2024 10:00:00 ... more content"
-	transaction := processEmail(emailBody, config)
+	transaction := processSingleTransaction(t, &ParsedEmail{PlainText: emailBody}, config)
 
 	if transaction == nil {
 		t.Fatalf("processEmail returned nil")
@@ -76,13 +77,10 @@ func TestProcessEmail_DateExtractionConfigMissingTimezone(t *testing.T) {
 		},
 	}
 
-	defer func() {
-		if r := recover(); r == nil {
-			t.Fatalf("Expected log.Panic (panic), but no panic occurred")
-		}
-	}()
-
-	processEmail(emailBody, config) // This should trigger a panic due to missing timezone
+	_, err := processEmail(&ParsedEmail{PlainText: emailBody}, config)
+	if !errors.Is(err, ErrConfig) {
+		t.Fatalf("Expected a configuration error for the missing timezone, got %v", err)
+	}
 }
 
 func TestProcessEmail_DateExtractionConfigInvalidTimezone(t *testing.T) {
@@ -110,18 +108,15 @@ func TestProcessEmail_DateExtractionConfigInvalidTimezone(t *testing.T) {
 		},
 	}
 
-	defer func() {
-		if r := recover(); r == nil {
-			t.Fatalf("Expected log.Panic (panic), but no panic occurred")
-		}
-	}()
-
-	processEmail(emailBody, config) // This should trigger a panic due to invalid timezone
+	_, err := processEmail(&ParsedEmail{PlainText: emailBody}, config)
+	if !errors.Is(err, ErrConfig) {
+		t.Fatalf("Expected a configuration error for the invalid timezone, got %v", err)
+	}
 }
 
 func TestTransactionDateFallback_NoDateFromProcessEmail(t *testing.T) {
 	transaction := &common.TransactionInfo{
-		Amount: common.DollarAmount{Dollars: 10, Cents: 0},
+		Amount: common.NewMoney(1000, 2, ""),
 		// TransactionDate is intentionally zero
 	}
 
@@ -143,7 +138,7 @@ func TestTransactionDateFallback_NoDateFromProcessEmail(t *testing.T) {
 func TestTransactionDateFallback_DateAlreadySetByProcessEmail(t *testing.T) {
 	preSetDate := time.Date(2024, 3, 20, 12, 0, 0, 0, time.UTC)
 	transaction := &common.TransactionInfo{
-		Amount:          common.DollarAmount{Dollars: 20, Cents: 0},
+		Amount:          common.NewMoney(2000, 2, ""),
 		TransactionDate: preSetDate,
 	}
 
@@ -159,3 +154,87 @@ func TestTransactionDateFallback_DateAlreadySetByProcessEmail(t *testing.T) {
 		t.Errorf("Expected transaction date %v (to remain unchanged), got %v", preSetDate, transaction.TransactionDate)
 	}
 }
+
+// Runs processEmail on an email about a single transaction and returns that
+// transaction, or nil if no processing step matched. Any other error fails
+// the test.
+func processSingleTransaction(t *testing.T, email *ParsedEmail, config common.EmailProcessingConfig) *common.TransactionInfo {
+	t.Helper()
+	transactions, err := processEmail(email, config)
+	if errors.Is(err, ErrNoStepMatched) {
+		return nil
+	}
+	if err != nil {
+		t.Fatalf("processEmail returned an error: %v", err)
+	}
+	if len(transactions) != 1 {
+		t.Fatalf("Expected one transaction, got %d", len(transactions))
+	}
+	return &transactions[0]
+}
+
+func TestProcessEmail_Errors(t *testing.T) {
+	timeZone := "UTC"
+	newConfig := func(regex string, targetField common.TargetField) common.EmailProcessingConfig {
+		return common.EmailProcessingConfig{
+			ProcessingSteps: []common.ProcessingStep{
+				{
+					OptionName:    "Alerts",
+					Discriminator: common.Discriminator{Type: "plainTextBodyRegex", Regex: "Charged"},
+					ExtractionSteps: []common.ExtractionStep{
+						{Regex: regex, TargetFields: []common.TargetField{targetField}},
+					},
+				},
+			},
+		}
+	}
+
+	tests := []struct {
+		name     string
+		body     string
+		config   common.EmailProcessingConfig
+		expected error
+	}{
+		{"no step matched", "Refunded $4.50", newConfig(`Charged (\S+)`, common.TargetField{GroupNumber: 1, TargetField: "amount"}), ErrNoStepMatched},
+		{"regex not found", "Charged", newConfig(`Charged (\S+)`, common.TargetField{GroupNumber: 1, TargetField: "amount"}), ErrRegexNotFound},
+		{"bad amount", "Charged lots", newConfig(`Charged (\S+)`, common.TargetField{GroupNumber: 1, TargetField: "amount"}), ErrBadAmount},
+		{"bad dollars", "Charged $abc.50", newConfig(`Charged \$(\S+)\.(\d{2})`, common.TargetField{GroupNumber: 1, TargetField: "dollars"}), ErrBadAmount},
+		{"bad cents", "Charged $4.5x", newConfig(`Charged \$(\d+)\.(\S+)`, common.TargetField{GroupNumber: 2, TargetField: "cents"}), ErrBadAmount},
+		{"bad date", "Charged on Someday", newConfig(`Charged on (\S+)`, common.TargetField{GroupNumber: 1, TargetField: "transactionDate", TimeZone: &timeZone}), ErrBadDate},
+		{"missing group", "Charged $4.50", newConfig(`Charged (\S+)`, common.TargetField{GroupNumber: 2, TargetField: "amount"}), ErrConfig},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := processEmail(&ParsedEmail{PlainText: test.body}, test.config)
+			if !errors.Is(err, test.expected) {
+				t.Fatalf("Expected %v, got %v", test.expected, err)
+			}
+
+			var extractionErr *ExtractionError
+			if !errors.As(err, &extractionErr) {
+				t.Fatalf("Expected an ExtractionError, got %T", err)
+			}
+			if test.expected != ErrNoStepMatched && extractionErr.Step != "Alerts" {
+				t.Errorf("Expected the error to name the processing step, got %q", extractionErr.Step)
+			}
+		})
+	}
+}
+
+func TestProcessMessage_ErrorIsAttached(t *testing.T) {
+	config := common.EmailProcessingConfig{
+		ProcessingSteps: []common.ProcessingStep{
+			{Discriminator: common.Discriminator{Type: "plainTextBodyRegex", Regex: "Charged"}},
+		},
+	}
+
+	body := "Message-ID: <abc@example.com>\r\nContent-Type: text/plain\r\n\r\nRefunded $4.50\r\n"
+	info := processMessage(RawMessage{Id: "1", Body: []byte(body)}, config)
+	if !errors.Is(info.Err, ErrNoStepMatched) || len(info.Transactions) != 0 {
+		t.Errorf("Expected no transactions and ErrNoStepMatched, got %+v", info)
+	}
+	if info.MailId != "<abc@example.com>" {
+		t.Errorf("Expected the Message-ID to be kept for the failed email, got %q", info.MailId)
+	}
+}
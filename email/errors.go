@@ -0,0 +1,57 @@
+package email
+
+import (
+	"errors"
+	"fmt"
+)
+
+// The kinds of failure when extracting transactions from an email. An
+// `ExtractionError` wraps one of them, so they can be told apart with
+// `errors.Is`.
+var (
+	// No processing step's discriminator matched the email.
+	ErrNoStepMatched = errors.New("no processing step matched")
+	// An extraction step's regex was not found in the email.
+	ErrRegexNotFound = errors.New("extraction regex was not found")
+	// A captured date could not be parsed.
+	ErrBadDate = errors.New("invalid date")
+	// A captured amount or currency could not be parsed.
+	ErrBadAmount = errors.New("invalid amount")
+	// The email processing configuration is invalid, e.g. a regex does not
+	// compile or a date target field has no time zone.
+	ErrConfig = errors.New("invalid email processing configuration")
+	// The email's MIME structure could not be read.
+	ErrMalformedEmail = errors.New("malformed email")
+)
+
+// Why transactions could not be extracted from an email.
+type ExtractionError struct {
+	// One of the Err values above.
+	Kind error
+	// The name of the processing step that failed, if a step matched.
+	Step string
+	// The underlying error, if any.
+	Err error
+}
+
+func newExtractionError(kind error, format string, args ...any) *ExtractionError {
+	return &ExtractionError{Kind: kind, Err: fmt.Errorf(format, args...)}
+}
+
+func (e *ExtractionError) Error() string {
+	message := e.Kind.Error()
+	if e.Step != "" {
+		message += " in processing step " + e.Step
+	}
+	if e.Err != nil {
+		message += ": " + e.Err.Error()
+	}
+	return message
+}
+
+func (e *ExtractionError) Unwrap() []error {
+	if e.Err == nil {
+		return []error{e.Kind}
+	}
+	return []error{e.Kind, e.Err}
+}
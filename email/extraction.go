@@ -0,0 +1,354 @@
+package email
+
+import (
+	"firefly-iii-email-scanner/common"
+	"fmt"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Runs an extraction step against the email, setting the step's target
+// fields on the transaction. Returns an `ExtractionError` if the regex is
+// not found or a captured value cannot be parsed.
+//
+// The supported types are:
+//   - plainTextBodyRegex (or no type): the regex runs against the body (the plain text part, or the HTML part if there is none)
+//   - htmlBodyRegex: the regex runs against the HTML part
+//   - subjectRegex: the regex runs against the decoded subject
+//   - headerRegex: the regex runs against each value of the header named by `header`, using the first that matches
+//   - envelopeDate: the transaction date is taken from the email's Date header, with no regex or target fields
+func extract(step common.ExtractionStep, email *ParsedEmail, transaction *common.TransactionInfo) error {
+	if step.Type == "envelopeDate" {
+		date, err := email.Header.Date()
+		if err != nil || date.IsZero() {
+			return &ExtractionError{Kind: ErrBadDate, Err: fmt.Errorf("failed to read the Date header: %v", err)}
+		}
+		transaction.TransactionDate = date.UTC()
+		return nil
+	}
+
+	texts, err := extractionTexts(step, email)
+	if err != nil {
+		return err
+	}
+	re, err := compileExtractionRegex(step)
+	if err != nil {
+		return &ExtractionError{Kind: ErrConfig, Err: err}
+	}
+
+	for _, text := range texts {
+		if match := re.FindStringSubmatchIndex(text); match != nil {
+			return setMatchedFields(step, re, text, match, email, transaction)
+		}
+	}
+	return newExtractionError(ErrRegexNotFound, "regex `%s` was not found", step.Regex)
+}
+
+// Returns the texts of the email an extraction step's regex runs against.
+func extractionTexts(step common.ExtractionStep, email *ParsedEmail) ([]string, error) {
+	switch step.Type {
+	case "", "plainTextBodyRegex":
+		return []string{email.Body()}, nil
+	case "htmlBodyRegex":
+		return []string{email.Html}, nil
+	case "subjectRegex":
+		return []string{email.Subject()}, nil
+	case "headerRegex":
+		if step.Header == "" {
+			return nil, newExtractionError(ErrConfig, "header is required for a headerRegex extraction step")
+		}
+		return email.HeaderValues(step.Header), nil
+	case "envelopeDate":
+		return nil, newExtractionError(ErrConfig, "an envelopeDate extraction step cannot be repeated")
+	}
+
+	return nil, newExtractionError(ErrConfig, "unknown extraction step type `%s`", step.Type)
+}
+
+// Extracts a transaction for each match of the repeating step's regex. Each
+// starts as a copy of the transaction extracted so far, then takes the
+// target fields of its match and of the repeating step's own extraction
+// steps, which run against the text of the match.
+func extractRepeated(repeat common.RepeatingExtraction, email *ParsedEmail, base common.TransactionInfo) ([]common.TransactionInfo, error) {
+	texts, err := extractionTexts(repeat.ExtractionStep, email)
+	if err != nil {
+		return nil, err
+	}
+	re, err := compileExtractionRegex(repeat.ExtractionStep)
+	if err != nil {
+		return nil, &ExtractionError{Kind: ErrConfig, Err: fmt.Errorf("invalid repeat step: %w", err)}
+	}
+
+	var transactions []common.TransactionInfo
+	for _, text := range texts {
+		for _, match := range re.FindAllStringSubmatchIndex(text, -1) {
+			transaction := cloneTransaction(base)
+			if err := setMatchedFields(repeat.ExtractionStep, re, text, match, email, &transaction); err != nil {
+				return nil, err
+			}
+
+			matched := text[match[0]:match[1]]
+			row := &ParsedEmail{Header: email.Header, PlainText: matched, Html: matched, Received: email.Received}
+			for _, step := range repeat.ExtractionSteps {
+				if err := extract(step, row, &transaction); err != nil {
+					return nil, err
+				}
+			}
+			transactions = append(transactions, transaction)
+		}
+	}
+
+	if len(transactions) == 0 {
+		return nil, newExtractionError(ErrRegexNotFound, "repeat regex `%s` was not found", repeat.Regex)
+	}
+	return transactions, nil
+}
+
+// Returns a copy of the transaction which shares nothing with the original,
+// so that each transaction extracted from a repeating step can be changed
+// independently.
+func cloneTransaction(transaction common.TransactionInfo) common.TransactionInfo {
+	clone := transaction
+	if transaction.ForeignAmount != nil {
+		foreignAmount := *transaction.ForeignAmount
+		clone.ForeignAmount = &foreignAmount
+	}
+	clone.Tags = slices.Clone(transaction.Tags)
+	return clone
+}
+
+// The target fields which extraction steps can set.
+var targetFieldNames = []string{
+	"amount",
+	"dollars",
+	"cents",
+	"currencyCode",
+	"foreignAmount",
+	"foreignCurrency",
+	"transactionDate",
+	"destinationAccount",
+	"transactionType",
+	"accountNumberSuffix",
+	"description",
+	"notes",
+	"category",
+	"budget",
+	"tags",
+	"bill",
+	"bookDate",
+	"processDate",
+	"cardLast4",
+	"cardholder",
+	"reference",
+}
+
+func isTargetFieldName(name string) bool {
+	return slices.Contains(targetFieldNames, name)
+}
+
+// Compiles the regex of an extraction step and checks that every group its
+// target fields reference exists.
+func compileExtractionRegex(step common.ExtractionStep) (*regexp.Regexp, error) {
+	re, err := regexp.Compile("(?m)" + step.Regex)
+	if err != nil {
+		return nil, fmt.Errorf("regex `%s` does not compile: %w", step.Regex, err)
+	}
+
+	for _, targetField := range step.TargetFields {
+		if targetField.GroupName != "" {
+			if re.SubexpIndex(targetField.GroupName) < 0 {
+				return nil, fmt.Errorf("regex `%s` has no group named %q for target field %s", step.Regex, targetField.GroupName, targetField.TargetField)
+			}
+		} else if targetField.GroupNumber < 0 || targetField.GroupNumber > re.NumSubexp() {
+			return nil, fmt.Errorf("regex `%s` has no group %d for target field %s", step.Regex, targetField.GroupNumber, targetField.TargetField)
+		}
+	}
+
+	return re, nil
+}
+
+// Returns the target fields to set from a match of the step's regex: those
+// listed in the step, followed by a field for each named group whose name is
+// a target field that is not already listed.
+func resolveTargetFields(step common.ExtractionStep, re *regexp.Regexp) []common.TargetField {
+	targetFields := slices.Clone(step.TargetFields)
+
+	for _, name := range re.SubexpNames() {
+		if !isTargetFieldName(name) {
+			continue
+		}
+		listed := slices.ContainsFunc(targetFields, func(f common.TargetField) bool {
+			return f.TargetField == name
+		})
+		if !listed {
+			targetFields = append(targetFields, common.TargetField{GroupName: name, TargetField: name})
+		}
+	}
+
+	return targetFields
+}
+
+// Sets the target fields from a match of the step's regex in the text, given
+// as the indexes FindStringSubmatchIndex returns. A named group which sets a
+// target field without being listed is skipped if it took no part in the
+// match, so that it can be optional, e.g. `(?: \((?P<foreignAmount>[^)]+)\))?`.
+func setMatchedFields(step common.ExtractionStep, re *regexp.Regexp, text string, match []int, email *ParsedEmail, transaction *common.TransactionInfo) error {
+	for i, targetField := range resolveTargetFields(step, re) {
+		group := groupIndex(re, targetField)
+		start, end := match[2*group], match[2*group+1]
+		if start < 0 && i >= len(step.TargetFields) {
+			continue
+		}
+
+		value := ""
+		if start >= 0 {
+			value = text[start:end]
+		}
+		if err := setTargetField(targetField, value, email, transaction); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Returns the number of the target field's group.
+func groupIndex(re *regexp.Regexp, targetField common.TargetField) int {
+	if targetField.GroupName != "" {
+		return re.SubexpIndex(targetField.GroupName)
+	}
+	return targetField.GroupNumber
+}
+
+// Parses a value captured by an extraction regex from the email and sets it
+// on the transaction.
+func setTargetField(targetField common.TargetField, value string, email *ParsedEmail, transaction *common.TransactionInfo) error {
+	value, err := applyTransforms(targetField.Transforms, value)
+	if err != nil {
+		return newExtractionError(ErrConfig, "invalid transforms for target field %s: %w", targetField.TargetField, err)
+	}
+
+	switch targetField.TargetField {
+	case "amount":
+		format, err := targetField.GetAmountFormat()
+		if err != nil {
+			return &ExtractionError{Kind: ErrConfig, Err: err}
+		}
+		amount, err := common.ParseAmount(value, format)
+		if err != nil {
+			return &ExtractionError{Kind: ErrBadAmount, Err: err}
+		}
+		if amount.Currency == "" {
+			amount.Currency = transaction.Amount.Currency
+		}
+		transaction.Amount = amount
+	case "currencyCode":
+		currency, err := common.ParseCurrency(value)
+		if err != nil {
+			return &ExtractionError{Kind: ErrBadAmount, Err: err}
+		}
+		transaction.Amount.Currency = currency
+	case "foreignAmount":
+		format, err := targetField.GetAmountFormat()
+		if err != nil {
+			return &ExtractionError{Kind: ErrConfig, Err: err}
+		}
+		amount, err := common.ParseAmount(value, format)
+		if err != nil {
+			return newExtractionError(ErrBadAmount, "foreign amount: %w", err)
+		}
+		if amount.Currency == "" && transaction.ForeignAmount != nil {
+			amount.Currency = transaction.ForeignAmount.Currency
+		}
+		transaction.ForeignAmount = &amount
+	case "foreignCurrency":
+		currency, err := common.ParseCurrency(value)
+		if err != nil {
+			return newExtractionError(ErrBadAmount, "foreign currency: %w", err)
+		}
+		if transaction.ForeignAmount == nil {
+			transaction.ForeignAmount = &common.Money{}
+		}
+		transaction.ForeignAmount.Currency = currency
+	case "dollars":
+		dollars, err := strconv.ParseInt(strings.ReplaceAll(value, ",", ""), 10, 64)
+		if err != nil {
+			return &ExtractionError{Kind: ErrBadAmount, Err: err}
+		}
+		cents := transaction.Amount.Rescale(2).Units % 100
+		transaction.Amount = common.NewMoney(dollars*100+cents, 2, transaction.Amount.Currency)
+	case "cents":
+		cents, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return &ExtractionError{Kind: ErrBadAmount, Err: err}
+		}
+		dollars := transaction.Amount.Rescale(2).Units / 100
+		transaction.Amount = common.NewMoney(dollars*100+cents, 2, transaction.Amount.Currency)
+	case "transactionDate":
+		date, err := parseDate(targetField, value, email.Date())
+		if err != nil {
+			return err
+		}
+		transaction.TransactionDate = date
+	case "bookDate":
+		date, err := parseDate(targetField, value, email.Date())
+		if err != nil {
+			return err
+		}
+		transaction.BookDate = &date
+	case "processDate":
+		date, err := parseDate(targetField, value, email.Date())
+		if err != nil {
+			return err
+		}
+		transaction.ProcessDate = &date
+	case "destinationAccount":
+		transaction.DestinationName = strings.TrimSpace(value)
+	case "description":
+		transaction.Description = strings.TrimSpace(value)
+	case "notes":
+		transaction.Notes = strings.TrimSpace(value)
+	case "category":
+		transaction.Category = strings.TrimSpace(value)
+	case "budget":
+		transaction.Budget = strings.TrimSpace(value)
+	case "bill":
+		transaction.Bill = strings.TrimSpace(value)
+	case "tags":
+		for _, tag := range strings.Split(value, ",") {
+			if tag = strings.TrimSpace(tag); tag != "" && !slices.Contains(transaction.Tags, tag) {
+				transaction.Tags = append(transaction.Tags, tag)
+			}
+		}
+	case "accountNumberSuffix":
+		transaction.AccountNumberSuffix = digitsOf(value)
+	case "cardLast4":
+		digits := digitsOf(value)
+		if len(digits) > 4 {
+			digits = digits[len(digits)-4:]
+		}
+		transaction.CardLast4 = digits
+	case "cardholder":
+		transaction.Cardholder = strings.TrimSpace(value)
+	case "reference":
+		transaction.Reference = strings.TrimSpace(value)
+	case "transactionType":
+		transactionType, err := common.ParseTransactionType(value)
+		if err != nil {
+			return &ExtractionError{Kind: ErrConfig, Err: err}
+		}
+		transaction.Type = transactionType
+	}
+	return nil
+}
+
+// Returns only the digits of the value, e.g. "1234" for "xxxx-1234".
+func digitsOf(value string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= '0' && r <= '9' {
+			return r
+		}
+		return -1
+	}, value)
+}
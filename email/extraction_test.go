@@ -0,0 +1,417 @@
+package email
+
+import (
+	"firefly-iii-email-scanner/common"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-message/mail"
+)
+
+func TestProcessEmail_ExtractsFromSubjectAndHeaders(t *testing.T) {
+	var header mail.Header
+	header.SetSubject("You made a $42.10 purchase at Blue Bottle Coffee")
+	header.SetDate(time.Date(2024, 3, 15, 10, 0, 0, 0, time.FixedZone("EDT", -4*60*60)))
+	header.Set("X-Card", "Visa ending 1234")
+
+	email := &ParsedEmail{Header: header, PlainText: "Thanks for using your card."}
+
+	config := common.EmailProcessingConfig{
+		ProcessingSteps: []common.ProcessingStep{
+			{
+				OptionName:    "Visa",
+				Discriminator: common.Discriminator{Type: "headerRegex", Header: "X-Card", Regex: "1234"},
+				ExtractionSteps: []common.ExtractionStep{
+					{
+						Type:  "subjectRegex",
+						Regex: `\$([\d,]+)\.(\d\d) purchase at (.+)$`,
+						TargetFields: []common.TargetField{
+							{GroupNumber: 1, TargetField: "dollars"},
+							{GroupNumber: 2, TargetField: "cents"},
+							{GroupNumber: 3, TargetField: "destinationAccount"},
+						},
+					},
+					{
+						Type: "envelopeDate",
+					},
+				},
+			},
+		},
+	}
+
+	transaction := processSingleTransaction(t, email, config)
+	if transaction == nil {
+		t.Fatalf("processEmail returned nil")
+	}
+
+	if transaction.Amount.String() != "42.10" {
+		t.Errorf("Expected $42.10, got %s", transaction.Amount.String())
+	}
+	if transaction.DestinationName != "Blue Bottle Coffee" {
+		t.Errorf("Expected destination Blue Bottle Coffee, got %s", transaction.DestinationName)
+	}
+
+	expectedDate := time.Date(2024, 3, 15, 14, 0, 0, 0, time.UTC)
+	if !transaction.TransactionDate.Equal(expectedDate) {
+		t.Errorf("Expected transaction date %v, got %v", expectedDate, transaction.TransactionDate)
+	}
+	if transaction.ProcessingStep != "Visa" {
+		t.Errorf("Expected processing step Visa, got %s", transaction.ProcessingStep)
+	}
+}
+
+func TestProcessEmail_HeaderRegexExtraction(t *testing.T) {
+	var header mail.Header
+	header.Add("X-Merchant", "category=dining")
+	header.Add("X-Merchant", "name=Blue Bottle")
+
+	email := &ParsedEmail{Header: header, PlainText: "Amount: $5.00"}
+	config := common.EmailProcessingConfig{
+		ProcessingSteps: []common.ProcessingStep{
+			{
+				Discriminator: common.Discriminator{Type: "plainTextBodyRegex", Regex: "Amount"},
+				ExtractionSteps: []common.ExtractionStep{
+					{
+						Type:   "headerRegex",
+						Header: "X-Merchant",
+						Regex:  "^name=(.+)$",
+						TargetFields: []common.TargetField{
+							{GroupNumber: 1, TargetField: "destinationAccount"},
+						},
+					},
+				},
+			},
+		},
+	}
+
+	transaction := processSingleTransaction(t, email, config)
+	if transaction == nil {
+		t.Fatalf("processEmail returned nil")
+	}
+	if transaction.DestinationName != "Blue Bottle" {
+		t.Errorf("Expected the second header value to be used, got %s", transaction.DestinationName)
+	}
+}
+
+func TestProcessEmail_NamedGroups(t *testing.T) {
+	timezone := "America/New_York"
+	dateFormat := "01/02/2006"
+	config := common.EmailProcessingConfig{
+		ProcessingSteps: []common.ProcessingStep{
+			{
+				Discriminator: common.Discriminator{Type: "plainTextBodyRegex", Regex: "Amount"},
+				ExtractionSteps: []common.ExtractionStep{
+					{
+						// Named groups which are target fields are mapped without a targetFields list
+						Regex: `Amount: \$(?P<dollars>[\d,]+)\.(?P<cents>\d\d) at (?P<destinationAccount>.+)$`,
+					},
+					{
+						// A listed target field can refer to a group by name to set options
+						Regex: `on (?P<when>\d\d/\d\d/\d{4})`,
+						TargetFields: []common.TargetField{
+							{GroupName: "when", TargetField: "transactionDate", Format: &dateFormat, TimeZone: &timezone},
+						},
+					},
+				},
+			},
+		},
+	}
+
+	transaction := processSingleTransaction(t, &ParsedEmail{PlainText: "Amount: $1,042.10 at Blue Bottle\non 03/15/2024"}, config)
+	if transaction == nil {
+		t.Fatalf("processEmail returned nil")
+	}
+
+	if transaction.Amount.String() != "1042.10" {
+		t.Errorf("Expected $1042.10, got %s", transaction.Amount.String())
+	}
+	if transaction.DestinationName != "Blue Bottle" {
+		t.Errorf("Expected destination Blue Bottle, got %s", transaction.DestinationName)
+	}
+	expectedDate := time.Date(2024, 3, 15, 4, 0, 0, 0, time.UTC)
+	if !transaction.TransactionDate.Equal(expectedDate) {
+		t.Errorf("Expected transaction date %v, got %v", expectedDate, transaction.TransactionDate)
+	}
+}
+
+func TestCompileExtractionRegex_MissingGroups(t *testing.T) {
+	tests := []struct {
+		name        string
+		targetField common.TargetField
+	}{
+		{"group number", common.TargetField{GroupNumber: 2, TargetField: "dollars"}},
+		{"group name", common.TargetField{GroupName: "cents", TargetField: "cents"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			step := common.ExtractionStep{
+				Regex:        `\$(?P<dollars>\d+)`,
+				TargetFields: []common.TargetField{test.targetField},
+			}
+			if _, err := compileExtractionRegex(step); err == nil {
+				t.Errorf("Expected an error for a missing group")
+			}
+		})
+	}
+
+	valid := common.ExtractionStep{
+		Regex:        `\$(?P<dollars>\d+)`,
+		TargetFields: []common.TargetField{{GroupNumber: 1, TargetField: "dollars"}, {GroupName: "dollars", TargetField: "dollars"}},
+	}
+	if _, err := compileExtractionRegex(valid); err != nil {
+		t.Errorf("Expected no error for existing groups, got %v", err)
+	}
+}
+
+func TestProcessEmail_AmountWithLocale(t *testing.T) {
+	locale := "de-DE"
+	config := common.EmailProcessingConfig{
+		ProcessingSteps: []common.ProcessingStep{
+			{
+				Discriminator: common.Discriminator{Type: "plainTextBodyRegex", Regex: "Betrag"},
+				ExtractionSteps: []common.ExtractionStep{
+					{
+						Regex: `Betrag: (.+)$`,
+						TargetFields: []common.TargetField{
+							{GroupNumber: 1, TargetField: "amount", Locale: &locale},
+						},
+					},
+				},
+			},
+		},
+	}
+
+	transaction := processSingleTransaction(t, &ParsedEmail{PlainText: "Betrag: 1.234,56 €"}, config)
+	if transaction == nil {
+		t.Fatalf("processEmail returned nil")
+	}
+	if transaction.Amount.String() != "1234.56" || transaction.Amount.Currency != "EUR" {
+		t.Errorf("Expected 1234.56 EUR, got %s", transaction.Amount.Display())
+	}
+}
+
+func TestProcessEmail_ForeignCurrency(t *testing.T) {
+	config := common.EmailProcessingConfig{
+		ProcessingSteps: []common.ProcessingStep{
+			{
+				Discriminator: common.Discriminator{Type: "plainTextBodyRegex", Regex: "charged"},
+				ExtractionSteps: []common.ExtractionStep{
+					{
+						Regex: `charged (?P<foreignCurrency>\S)(?P<foreignAmount>[\d.,]+) \((?P<currencyCode>[A-Z]{3}) (?P<amount>[\d.,]+)\)`,
+					},
+				},
+			},
+		},
+	}
+
+	transaction := processSingleTransaction(t, &ParsedEmail{PlainText: "You were charged €45.00 (USD 48.91) at Cafe de Flore"}, config)
+	if transaction == nil {
+		t.Fatalf("processEmail returned nil")
+	}
+	if transaction.Amount.Display() != "48.91 USD" {
+		t.Errorf("Expected 48.91 USD, got %s", transaction.Amount.Display())
+	}
+	if transaction.ForeignAmount == nil || transaction.ForeignAmount.Display() != "45.00 EUR" {
+		t.Errorf("Expected a foreign amount of 45.00 EUR, got %+v", transaction.ForeignAmount)
+	}
+}
+
+func TestProcessEmail_OptionalNamedGroup(t *testing.T) {
+	config := common.EmailProcessingConfig{
+		ProcessingSteps: []common.ProcessingStep{
+			{
+				Discriminator: common.Discriminator{Type: "plainTextBodyRegex", Regex: "charged"},
+				ExtractionSteps: []common.ExtractionStep{
+					{
+						// The foreign amount is only in alerts for purchases abroad
+						Regex: `charged (?P<amount>\$[\d.,]+)(?: \((?P<foreignAmount>[^)]+)\))? at`,
+					},
+				},
+			},
+		},
+	}
+
+	domestic := processSingleTransaction(t, &ParsedEmail{PlainText: "You were charged $12.00 at Blue Bottle"}, config)
+	if domestic == nil {
+		t.Fatalf("processEmail returned nil")
+	}
+	if domestic.Amount.String() != "12.00" || domestic.ForeignAmount != nil {
+		t.Errorf("Expected $12.00 with no foreign amount, got %s and %+v", domestic.Amount.String(), domestic.ForeignAmount)
+	}
+
+	abroad := processSingleTransaction(t, &ParsedEmail{PlainText: "You were charged $48.91 (€45.00) at Cafe de Flore"}, config)
+	if abroad == nil {
+		t.Fatalf("processEmail returned nil")
+	}
+	if abroad.ForeignAmount == nil || abroad.ForeignAmount.Display() != "45.00 EUR" {
+		t.Errorf("Expected a foreign amount of 45.00 EUR, got %+v", abroad.ForeignAmount)
+	}
+}
+
+func TestProcessEmail_TransactionType(t *testing.T) {
+	config := common.EmailProcessingConfig{
+		ProcessingSteps: []common.ProcessingStep{
+			{
+				OptionName:      "Refund",
+				Discriminator:   common.Discriminator{Type: "subjectRegex", Regex: "refund"},
+				TransactionType: "deposit",
+				ExtractionSteps: []common.ExtractionStep{
+					{Regex: `A refund of (?P<amount>\S+) from (?P<destinationAccount>.+) was issued`},
+				},
+			},
+			{
+				OptionName:    "Activity",
+				Discriminator: common.Discriminator{Type: "subjectRegex", Regex: "activity"},
+				ExtractionSteps: []common.ExtractionStep{
+					{Regex: `(?P<transactionType>Debit|Credit) of (?P<amount>\S+)`},
+				},
+			},
+		},
+	}
+
+	var refundHeader mail.Header
+	refundHeader.SetSubject("Your refund")
+	refund := processSingleTransaction(t, &ParsedEmail{Header: refundHeader, PlainText: "A refund of $12.00 from Blue Bottle Coffee was issued"}, config)
+	if refund == nil || refund.Type != common.Deposit {
+		t.Fatalf("Expected the step's transaction type to make a deposit, got %+v", refund)
+	}
+	if refund.DestinationName != "Blue Bottle Coffee" {
+		t.Errorf("Expected the payer Blue Bottle Coffee, got %q", refund.DestinationName)
+	}
+
+	var activityHeader mail.Header
+	activityHeader.SetSubject("Account activity")
+	credit := processSingleTransaction(t, &ParsedEmail{Header: activityHeader, PlainText: "Credit of $2,500.00 to your account"}, config)
+	if credit == nil || credit.Type != common.Deposit {
+		t.Errorf("Expected an extracted Credit to make a deposit, got %+v", credit)
+	}
+}
+
+func TestProcessEmail_MetadataFields(t *testing.T) {
+	timeZone := "America/New_York"
+	format := "Jan 2, 2006"
+	config := common.EmailProcessingConfig{
+		ProcessingSteps: []common.ProcessingStep{
+			{
+				Discriminator: common.Discriminator{Type: "plainTextBodyRegex", Regex: "Card activity"},
+				ExtractionSteps: []common.ExtractionStep{
+					{Regex: `Card: (?P<cardLast4>.+)$`},
+					{Regex: `Cardholder: (?P<cardholder>.+)$`},
+					{Regex: `Authorization: (?P<reference>\w+)`},
+					{Regex: `Category: (?P<category>.+)$`},
+					{Regex: `Labels: (?P<tags>.+)$`},
+					{
+						Regex: `Posted: (.+)$`,
+						TargetFields: []common.TargetField{
+							{GroupNumber: 1, TargetField: "bookDate", Format: &format, TimeZone: &timeZone},
+						},
+					},
+				},
+			},
+		},
+	}
+
+	body := "Card activity\n" +
+		"Card: Visa xxxx-xxxx-xxxx-1234\n" +
+		"Cardholder: Jane Doe\n" +
+		"Authorization: A1B2C3\n" +
+		"Category: Dining\n" +
+		"Labels: coffee, travel,coffee\n" +
+		"Posted: Mar 16, 2024\n"
+	transaction := processSingleTransaction(t, &ParsedEmail{PlainText: body}, config)
+	if transaction == nil {
+		t.Fatalf("processEmail returned nil")
+	}
+
+	if transaction.CardLast4 != "1234" {
+		t.Errorf("Expected card 1234, got %q", transaction.CardLast4)
+	}
+	if transaction.Cardholder != "Jane Doe" || transaction.Reference != "A1B2C3" || transaction.Category != "Dining" {
+		t.Errorf("Unexpected cardholder, reference or category: %+v", transaction)
+	}
+	if len(transaction.Tags) != 2 || transaction.Tags[0] != "coffee" || transaction.Tags[1] != "travel" {
+		t.Errorf("Expected tags [coffee travel], got %v", transaction.Tags)
+	}
+	expectedBookDate := time.Date(2024, 3, 16, 4, 0, 0, 0, time.UTC)
+	if transaction.BookDate == nil || !transaction.BookDate.Equal(expectedBookDate) {
+		t.Errorf("Expected book date %v, got %v", expectedBookDate, transaction.BookDate)
+	}
+}
+
+func TestProcessEmail_RepeatedTransactions(t *testing.T) {
+	config := common.EmailProcessingConfig{
+		ProcessingSteps: []common.ProcessingStep{
+			{
+				OptionName:    "Daily digest",
+				Discriminator: common.Discriminator{Type: "subjectRegex", Regex: "Daily digest"},
+				ExtractionSteps: []common.ExtractionStep{
+					{Regex: `Card ending in (?P<cardLast4>\d{4})`},
+				},
+				Repeat: &common.RepeatingExtraction{
+					ExtractionStep: common.ExtractionStep{
+						Regex: `^(?P<amount>\$[\d.,]+) at (?P<destinationAccount>.+)$`,
+					},
+				},
+				Tags: []string{"{{.CardLast4}}"},
+			},
+		},
+	}
+
+	var header mail.Header
+	header.SetSubject("Daily digest")
+	body := "Card ending in 1234\n$4.50 at Blue Bottle\n$12.00 at Safeway\n$4.50 at Blue Bottle\n"
+	transactions, err := processEmail(&ParsedEmail{Header: header, PlainText: body}, config)
+	if err != nil {
+		t.Fatalf("processEmail returned an error: %v", err)
+	}
+	if len(transactions) != 3 {
+		t.Fatalf("Expected 3 transactions, got %d", len(transactions))
+	}
+
+	expected := []struct {
+		amount      string
+		destination string
+	}{{"4.50", "Blue Bottle"}, {"12.00", "Safeway"}, {"4.50", "Blue Bottle"}}
+	for i, e := range expected {
+		transaction := transactions[i]
+		if transaction.Amount.String() != e.amount || transaction.DestinationName != e.destination {
+			t.Errorf("Transaction %d: expected %s at %s, got %s at %s", i, e.amount, e.destination, transaction.Amount.String(), transaction.DestinationName)
+		}
+		if transaction.CardLast4 != "1234" || len(transaction.Tags) != 1 || transaction.Tags[0] != "1234" {
+			t.Errorf("Transaction %d: expected the shared card and templated tag, got %+v", i, transaction)
+		}
+	}
+}
+
+func TestProcessEmail_RepeatedHtmlRows(t *testing.T) {
+	config := common.EmailProcessingConfig{
+		ProcessingSteps: []common.ProcessingStep{
+			{
+				Discriminator: common.Discriminator{Type: "htmlBodyRegex", Regex: "Recent activity"},
+				Repeat: &common.RepeatingExtraction{
+					ExtractionStep: common.ExtractionStep{Type: "htmlBodyRegex", Regex: `(?s)<tr class="txn">.*?</tr>`},
+					ExtractionSteps: []common.ExtractionStep{
+						{Type: "htmlBodyRegex", Regex: `<td class="merchant">(?P<destinationAccount>[^<]+)</td>`},
+						{Type: "htmlBodyRegex", Regex: `<td class="amount">(?P<amount>[^<]+)</td>`},
+					},
+				},
+			},
+		},
+	}
+
+	html := `<h1>Recent activity</h1><table>
+<tr class="txn"><td class="amount">$4.50</td><td class="merchant">Blue Bottle</td></tr>
+<tr class="txn"><td class="amount">$12.00</td><td class="merchant">Safeway</td></tr>
+</table>`
+	transactions, err := processEmail(&ParsedEmail{Html: html}, config)
+	if err != nil {
+		t.Fatalf("processEmail returned an error: %v", err)
+	}
+	if len(transactions) != 2 {
+		t.Fatalf("Expected 2 transactions, got %d", len(transactions))
+	}
+	if transactions[0].DestinationName != "Blue Bottle" || transactions[1].Amount.String() != "12.00" {
+		t.Errorf("Unexpected transactions %+v", transactions)
+	}
+}
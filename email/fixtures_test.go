@@ -0,0 +1,189 @@
+package email
+
+import (
+	"bytes"
+	"firefly-iii-email-scanner/common"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Run `go test ./email -run TestFixtures -update` to rewrite the expected
+// results from the current rules, then review the changes with `git diff`.
+var (
+	updateFixtures = flag.Bool("update", false, "Rewrite the expected results of the email fixtures")
+	fixturesDir    = flag.String("fixtures", filepath.Join("testdata", "fixtures"), "The directory of .eml fixtures and the config.yaml to run them with")
+)
+
+// What is extracted from a fixture, as kept in the .yaml file next to it.
+type fixtureResult struct {
+	Error        string               `yaml:"error,omitempty"`
+	Transactions []fixtureTransaction `yaml:"transactions,omitempty"`
+}
+
+type fixtureTransaction struct {
+	Step                string   `yaml:"step,omitempty"`
+	Amount              string   `yaml:"amount,omitempty"`
+	ForeignAmount       string   `yaml:"foreignAmount,omitempty"`
+	Date                string   `yaml:"date,omitempty"`
+	Type                string   `yaml:"type,omitempty"`
+	Destination         string   `yaml:"destination,omitempty"`
+	SourceAccountId     int      `yaml:"sourceAccountId,omitempty"`
+	SourceAccountName   string   `yaml:"sourceAccountName,omitempty"`
+	AccountNumberSuffix string   `yaml:"accountNumberSuffix,omitempty"`
+	Description         string   `yaml:"description,omitempty"`
+	Notes               string   `yaml:"notes,omitempty"`
+	Category            string   `yaml:"category,omitempty"`
+	Budget              string   `yaml:"budget,omitempty"`
+	Bill                string   `yaml:"bill,omitempty"`
+	Tags                []string `yaml:"tags,omitempty"`
+	BookDate            string   `yaml:"bookDate,omitempty"`
+	ProcessDate         string   `yaml:"processDate,omitempty"`
+	CardLast4           string   `yaml:"cardLast4,omitempty"`
+	Cardholder          string   `yaml:"cardholder,omitempty"`
+	Reference           string   `yaml:"reference,omitempty"`
+}
+
+// Runs the rules of the fixtures' config.yaml against every .eml file in
+// the fixtures directory, and compares what is extracted with the .yaml file
+// of the same name.
+func TestFixtures(t *testing.T) {
+	config, err := common.GetConfig(filepath.Join(*fixturesDir, "config.yaml"))
+	if err != nil {
+		t.Fatalf("Failed to load the fixtures' config: %v", err)
+	}
+
+	emls, err := filepath.Glob(filepath.Join(*fixturesDir, "*.eml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(emls) == 0 {
+		t.Fatalf("No .eml fixtures found in %s", *fixturesDir)
+	}
+
+	for _, eml := range emls {
+		name := strings.TrimSuffix(filepath.Base(eml), ".eml")
+		t.Run(name, func(t *testing.T) {
+			body, err := os.ReadFile(eml)
+			if err != nil {
+				t.Fatal(err)
+			}
+			actual := newFixtureResult(ProcessRawMessage(RawMessage{Id: name, Body: body}, config.ProcessEmails))
+
+			expectedFile := strings.TrimSuffix(eml, ".eml") + ".yaml"
+			if *updateFixtures {
+				writeFixtureResult(t, expectedFile, actual)
+				return
+			}
+
+			data, err := os.ReadFile(expectedFile)
+			if err != nil {
+				t.Fatalf("Failed to read the expected result, which -update writes: %v", err)
+			}
+			var expected fixtureResult
+			if err := yaml.Unmarshal(data, &expected); err != nil {
+				t.Fatalf("Failed to parse %s: %v", expectedFile, err)
+			}
+			for _, diff := range diffFixtureResults(expected, actual) {
+				t.Error(diff)
+			}
+		})
+	}
+}
+
+func newFixtureResult(info *common.EmailTransactionInfo) fixtureResult {
+	if info == nil {
+		return fixtureResult{Error: "no process_emails entry is for the sender"}
+	}
+
+	var result fixtureResult
+	if info.Err != nil {
+		result.Error = info.Err.Error()
+	}
+	for _, t := range info.Transactions {
+		transaction := fixtureTransaction{
+			Step:                t.ProcessingStep,
+			Amount:              t.Amount.Display(),
+			Date:                formatFixtureDate(&t.TransactionDate),
+			Type:                t.Type.String(),
+			Destination:         t.DestinationName,
+			SourceAccountId:     t.SourceAccountId,
+			SourceAccountName:   t.SourceAccountName,
+			AccountNumberSuffix: t.AccountNumberSuffix,
+			Description:         t.Description,
+			Notes:               t.Notes,
+			Category:            t.Category,
+			Budget:              t.Budget,
+			Bill:                t.Bill,
+			Tags:                t.Tags,
+			BookDate:            formatFixtureDate(t.BookDate),
+			ProcessDate:         formatFixtureDate(t.ProcessDate),
+			CardLast4:           t.CardLast4,
+			Cardholder:          t.Cardholder,
+			Reference:           t.Reference,
+		}
+		if t.ForeignAmount != nil {
+			transaction.ForeignAmount = t.ForeignAmount.Display()
+		}
+		result.Transactions = append(result.Transactions, transaction)
+	}
+	return result
+}
+
+func formatFixtureDate(date *time.Time) string {
+	if date == nil || date.IsZero() {
+		return ""
+	}
+	return date.Format(time.RFC3339)
+}
+
+func writeFixtureResult(t *testing.T, file string, result fixtureResult) {
+	var data bytes.Buffer
+	encoder := yaml.NewEncoder(&data)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(result); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(file, data.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Describes each field which differs between the expected and actual
+// results, e.g. `transactions[1].amount: expected "$4.50", got "$45.00"`.
+func diffFixtureResults(expected fixtureResult, actual fixtureResult) []string {
+	var diffs []string
+	if expected.Error != actual.Error {
+		diffs = append(diffs, fmt.Sprintf("error: expected %q, got %q", expected.Error, actual.Error))
+	}
+	if len(expected.Transactions) != len(actual.Transactions) {
+		diffs = append(diffs, fmt.Sprintf("expected %d transactions, got %d", len(expected.Transactions), len(actual.Transactions)))
+	}
+
+	for i := 0; i < min(len(expected.Transactions), len(actual.Transactions)); i++ {
+		e := reflect.ValueOf(expected.Transactions[i])
+		a := reflect.ValueOf(actual.Transactions[i])
+		for j := 0; j < e.NumField(); j++ {
+			if reflect.DeepEqual(e.Field(j).Interface(), a.Field(j).Interface()) {
+				continue
+			}
+			field := strings.Split(e.Type().Field(j).Tag.Get("yaml"), ",")[0]
+			diffs = append(diffs, fmt.Sprintf("transactions[%d].%s: expected %v, got %v", i, field, describeFixtureValue(e.Field(j)), describeFixtureValue(a.Field(j))))
+		}
+	}
+	return diffs
+}
+
+func describeFixtureValue(value reflect.Value) string {
+	if value.Kind() == reflect.String {
+		return fmt.Sprintf("%q", value.String())
+	}
+	return fmt.Sprint(value.Interface())
+}
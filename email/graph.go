@@ -0,0 +1,373 @@
+package email
+
+import (
+	"bytes"
+	"encoding/json"
+	"firefly-iii-email-scanner/common"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultGraphUrl          = "https://graph.microsoft.com/v1.0"
+	defaultGraphLoginUrl     = "https://login.microsoftonline.com"
+	defaultGraphFolder       = "inbox"
+	defaultProcessedCategory = "Firefly Processed"
+)
+
+// A mail source backed by the Microsoft Graph mail API, for Outlook.com and
+// Microsoft 365 mailboxes. Processed messages are tagged with a category
+// instead of being marked as read.
+type GraphSource struct {
+	baseUrl    string
+	userPath   string
+	folder     string
+	category   string
+	httpClient *http.Client
+	tokens     *graphTokenSource
+
+	folderOnce sync.Once
+	folderId   string
+	folderErr  error
+
+	// The unprocessed messages in the folder, listed on the first call to
+	// Fetch and shared by every sender.
+	messages []graphMessage
+	listed   bool
+}
+
+// Creates a Graph mail source using the given options.
+//
+// Credentials come from the environment. If GRAPH_REFRESH_TOKEN is set, the
+// delegated refresh token flow is used against the signed in user's mailbox.
+// Otherwise the client credentials flow is used with GRAPH_CLIENT_SECRET and
+// the mailbox of GRAPH_USER. GRAPH_CLIENT_ID is always required, and
+// GRAPH_TENANT_ID defaults to "common". GRAPH_URL and GRAPH_LOGIN_URL may be
+// set to point the source at a different Graph deployment.
+func NewGraphSource(config *common.GraphConfig) (*GraphSource, error) {
+	baseUrl := envOrDefault("GRAPH_URL", defaultGraphUrl)
+	loginUrl := envOrDefault("GRAPH_LOGIN_URL", defaultGraphLoginUrl)
+	tenant := envOrDefault("GRAPH_TENANT_ID", "common")
+	clientId := os.Getenv("GRAPH_CLIENT_ID")
+	clientSecret := os.Getenv("GRAPH_CLIENT_SECRET")
+	refreshToken := os.Getenv("GRAPH_REFRESH_TOKEN")
+	user := os.Getenv("GRAPH_USER")
+
+	if clientId == "" {
+		return nil, fmt.Errorf("GRAPH_CLIENT_ID is required for the graph source")
+	}
+
+	form := url.Values{}
+	form.Set("client_id", clientId)
+	if clientSecret != "" {
+		form.Set("client_secret", clientSecret)
+	}
+
+	var userPath string
+	if refreshToken != "" {
+		form.Set("grant_type", "refresh_token")
+		form.Set("refresh_token", refreshToken)
+		form.Set("scope", "https://graph.microsoft.com/Mail.ReadWrite offline_access")
+		userPath = "/me"
+	} else {
+		if clientSecret == "" || user == "" {
+			return nil, fmt.Errorf("either GRAPH_REFRESH_TOKEN or both GRAPH_CLIENT_SECRET and GRAPH_USER are required for the graph source")
+		}
+		form.Set("grant_type", "client_credentials")
+		form.Set("scope", "https://graph.microsoft.com/.default")
+		userPath = "/users/" + url.PathEscape(user)
+	}
+
+	source := &GraphSource{
+		baseUrl:    strings.TrimSuffix(baseUrl, "/"),
+		userPath:   userPath,
+		folder:     defaultGraphFolder,
+		category:   defaultProcessedCategory,
+		httpClient: &http.Client{Timeout: 30 * time.Second},
+	}
+	if config != nil && config.Folder != "" {
+		source.folder = config.Folder
+	}
+	if config != nil && config.ProcessedCategory != "" {
+		source.category = config.ProcessedCategory
+	}
+
+	source.tokens = &graphTokenSource{
+		tokenUrl:   strings.TrimSuffix(loginUrl, "/") + "/" + url.PathEscape(tenant) + "/oauth2/v2.0/token",
+		form:       form,
+		httpClient: source.httpClient,
+	}
+
+	return source, nil
+}
+
+func envOrDefault(name string, fallback string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	return fallback
+}
+
+// The subset of a Graph message resource that the source needs.
+type graphMessage struct {
+	Id                string    `json:"id"`
+	InternetMessageId string    `json:"internetMessageId"`
+	ReceivedDateTime  time.Time `json:"receivedDateTime"`
+	Categories        []string  `json:"categories"`
+	From              struct {
+		EmailAddress struct {
+			Address string `json:"address"`
+		} `json:"emailAddress"`
+	} `json:"from"`
+}
+
+type graphMessageList struct {
+	Value    []graphMessage `json:"value"`
+	NextLink string         `json:"@odata.nextLink"`
+}
+
+type graphFolderList struct {
+	Value []struct {
+		Id          string `json:"id"`
+		DisplayName string `json:"displayName"`
+	} `json:"value"`
+}
+
+// Returns the messages from the given sender in the configured folder which
+// do not yet have the processed category. As with the other sources, a
+// message is from the sender if its address contains fromEmail. The Graph
+// filter only matches whole addresses, so the folder is listed once, on the
+// first call, and the sender is checked against that list.
+func (s *GraphSource) Fetch(fromEmail string) ([]RawMessage, error) {
+	if !s.listed {
+		if err := s.listMessages(); err != nil {
+			return nil, err
+		}
+		s.listed = true
+	}
+
+	var result []RawMessage
+	for _, message := range s.messages {
+		if !strings.Contains(strings.ToLower(message.From.EmailAddress.Address), strings.ToLower(fromEmail)) {
+			continue
+		}
+		body, err := s.get(s.messageUrl(message.Id) + "/$value")
+		if err != nil {
+			return nil, fmt.Errorf("error fetching message %s: %w", message.Id, err)
+		}
+
+		result = append(result, RawMessage{
+			Id:        message.Id,
+			MessageId: message.InternetMessageId,
+			Date:      message.ReceivedDateTime,
+			Body:      body,
+		})
+	}
+
+	return result, nil
+}
+
+// Lists the messages in the configured folder which do not yet have the
+// processed category.
+func (s *GraphSource) listMessages() error {
+	folderId, err := s.resolveFolder()
+	if err != nil {
+		return err
+	}
+
+	query := url.Values{}
+	query.Set("$filter", fmt.Sprintf("not(categories/any(c:c eq '%s'))", odataEscape(s.category)))
+	query.Set("$select", "id,internetMessageId,receivedDateTime,categories,from")
+	query.Set("$top", "50")
+
+	next := s.baseUrl + s.userPath + "/mailFolders/" + url.PathEscape(folderId) + "/messages?" + query.Encode()
+
+	for next != "" {
+		var page graphMessageList
+		if err := s.getJSON(next, &page); err != nil {
+			return fmt.Errorf("error listing messages: %w", err)
+		}
+		s.messages = append(s.messages, page.Value...)
+		next = page.NextLink
+	}
+
+	return nil
+}
+
+// Adds the processed category to the message with the given Graph id,
+// keeping any categories it already has.
+func (s *GraphSource) MarkProcessed(id string) error {
+	var message graphMessage
+	if err := s.getJSON(s.messageUrl(id)+"?$select=id,categories", &message); err != nil {
+		return fmt.Errorf("unable to read message categories: %w", err)
+	}
+
+	// So that later calls to Fetch in this run leave it out
+	s.messages = slices.DeleteFunc(s.messages, func(m graphMessage) bool { return m.Id == id })
+
+	for _, category := range message.Categories {
+		if category == s.category {
+			return nil
+		}
+	}
+
+	patch, err := json.Marshal(map[string][]string{
+		"categories": append(message.Categories, s.category),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to marshal categories: %w", err)
+	}
+
+	if _, err := s.do(http.MethodPatch, s.messageUrl(id), bytes.NewReader(patch)); err != nil {
+		return fmt.Errorf("unable to mark message as processed: %w", err)
+	}
+	return nil
+}
+
+// The Graph source holds no connection, so there is nothing to release.
+func (s *GraphSource) Close() error {
+	return nil
+}
+
+func (s *GraphSource) messageUrl(id string) string {
+	return s.baseUrl + s.userPath + "/messages/" + url.PathEscape(id)
+}
+
+// Looks up the configured folder by display name, falling back to treating
+// it as a well-known folder name or id if no folder has that name.
+func (s *GraphSource) resolveFolder() (string, error) {
+	s.folderOnce.Do(func() {
+		query := url.Values{}
+		query.Set("$filter", fmt.Sprintf("displayName eq '%s'", odataEscape(s.folder)))
+		query.Set("$select", "id,displayName")
+
+		var folders graphFolderList
+		if err := s.getJSON(s.baseUrl+s.userPath+"/mailFolders?"+query.Encode(), &folders); err != nil {
+			s.folderErr = fmt.Errorf("error looking up folder %q: %w", s.folder, err)
+			return
+		}
+
+		if len(folders.Value) > 0 {
+			s.folderId = folders.Value[0].Id
+		} else {
+			s.folderId = s.folder
+		}
+		log.Printf("Reading Graph mail folder %q", s.folder)
+	})
+	return s.folderId, s.folderErr
+}
+
+func (s *GraphSource) get(url string) ([]byte, error) {
+	return s.do(http.MethodGet, url, nil)
+}
+
+func (s *GraphSource) getJSON(url string, v any) error {
+	body, err := s.get(url)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(body, v)
+}
+
+func (s *GraphSource) do(method string, url string, body io.Reader) ([]byte, error) {
+	token, err := s.tokens.token()
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := s.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response: %w", err)
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, fmt.Errorf("%s %s returned %s: %s", method, req.URL.Path, resp.Status, string(respBody))
+	}
+
+	return respBody, nil
+}
+
+// Escapes a string for use inside a single quoted OData literal.
+func odataEscape(s string) string {
+	return strings.ReplaceAll(s, "'", "''")
+}
+
+// Acquires and caches OAuth access tokens from the Microsoft identity platform.
+type graphTokenSource struct {
+	tokenUrl   string
+	form       url.Values
+	httpClient *http.Client
+
+	accessToken string
+	expiry      time.Time
+}
+
+type graphTokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int    `json:"expires_in"`
+}
+
+// Returns a valid access token, requesting a new one if the cached token is
+// missing or about to expire.
+func (ts *graphTokenSource) token() (string, error) {
+	if ts.accessToken != "" && time.Now().Add(time.Minute).Before(ts.expiry) {
+		return ts.accessToken, nil
+	}
+
+	resp, err := ts.httpClient.PostForm(ts.tokenUrl, ts.form)
+	if err != nil {
+		return "", fmt.Errorf("failed to request access token: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", fmt.Errorf("failed to read token response: %w", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("failed to request access token, status %s: %s", resp.Status, string(body))
+	}
+
+	var tokenResponse graphTokenResponse
+	if err := json.Unmarshal(body, &tokenResponse); err != nil {
+		return "", fmt.Errorf("failed to parse token response: %w", err)
+	}
+	if tokenResponse.AccessToken == "" {
+		return "", fmt.Errorf("token response did not contain an access token")
+	}
+
+	ts.accessToken = tokenResponse.AccessToken
+	ts.expiry = time.Now().Add(time.Duration(tokenResponse.ExpiresIn) * time.Second)
+
+	// Refresh tokens are rotated on use, so keep the newest one for the next request.
+	if tokenResponse.RefreshToken != "" && ts.form.Get("grant_type") == "refresh_token" {
+		ts.form.Set("refresh_token", tokenResponse.RefreshToken)
+	}
+
+	return ts.accessToken, nil
+}
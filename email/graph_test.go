@@ -0,0 +1,210 @@
+package email
+
+import (
+	"encoding/json"
+	"firefly-iii-email-scanner/common"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+const graphTestMessage = "From: alerts@mybank.com\r\n" +
+	"To: me@example.com\r\n" +
+	"Subject: Transaction alert\r\n" +
+	"Message-ID: <abc@mybank.com>\r\n" +
+	"Content-Type: text/plain\r\n" +
+	"\r\n" +
+	"Amount: $12.34\r\n"
+
+// A minimal fake of the Graph mail API and token endpoint.
+type fakeGraph struct {
+	categories map[string][]string
+	tokens     int
+	filters    []string
+}
+
+func (f *fakeGraph) handler(t *testing.T) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/tenant/oauth2/v2.0/token", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		if r.Form.Get("grant_type") != "client_credentials" || r.Form.Get("client_secret") != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		f.tokens++
+		json.NewEncoder(w).Encode(map[string]any{"access_token": "token", "expires_in": 3600})
+	})
+	mux.HandleFunc("/v1.0/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		path := strings.TrimPrefix(r.URL.Path, "/v1.0/users/me@example.com")
+		switch {
+		case path == "/mailFolders":
+			json.NewEncoder(w).Encode(map[string]any{"value": []map[string]string{{"id": "folder-1", "displayName": "Bank Alerts"}}})
+		case path == "/mailFolders/folder-1/messages":
+			f.filters = append(f.filters, r.URL.Query().Get("$filter"))
+			var value []map[string]any
+			if len(f.categories["msg-1"]) == 1 {
+				value = append(value, map[string]any{
+					"id":                "msg-1",
+					"internetMessageId": "<abc@mybank.com>",
+					"receivedDateTime":  "2024-03-15T14:00:00Z",
+					"from":              map[string]any{"emailAddress": map[string]string{"address": "Alerts@MyBank.com"}},
+				})
+			}
+			json.NewEncoder(w).Encode(map[string]any{"value": value})
+		case path == "/messages/msg-1/$value":
+			io.WriteString(w, graphTestMessage)
+		case path == "/messages/msg-1" && r.Method == http.MethodGet:
+			json.NewEncoder(w).Encode(map[string]any{"id": "msg-1", "categories": f.categories["msg-1"]})
+		case path == "/messages/msg-1" && r.Method == http.MethodPatch:
+			var patch struct {
+				Categories []string `json:"categories"`
+			}
+			json.NewDecoder(r.Body).Decode(&patch)
+			f.categories["msg-1"] = patch.Categories
+			json.NewEncoder(w).Encode(map[string]any{"id": "msg-1"})
+		default:
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+		}
+	})
+	return mux
+}
+
+func newTestGraphSource(t *testing.T, fake *fakeGraph) *GraphSource {
+	server := httptest.NewServer(fake.handler(t))
+	t.Cleanup(server.Close)
+
+	t.Setenv("GRAPH_URL", server.URL+"/v1.0")
+	t.Setenv("GRAPH_LOGIN_URL", server.URL)
+	t.Setenv("GRAPH_TENANT_ID", "tenant")
+	t.Setenv("GRAPH_CLIENT_ID", "client")
+	t.Setenv("GRAPH_CLIENT_SECRET", "secret")
+	t.Setenv("GRAPH_REFRESH_TOKEN", "")
+	t.Setenv("GRAPH_USER", "me@example.com")
+
+	source, err := NewGraphSource(&common.GraphConfig{Folder: "Bank Alerts", ProcessedCategory: "Scanned"})
+	if err != nil {
+		t.Fatalf("NewGraphSource returned an error: %v", err)
+	}
+	return source
+}
+
+func TestGraphSource_FetchAndMarkProcessed(t *testing.T) {
+	fake := &fakeGraph{categories: map[string][]string{"msg-1": {"Bank"}}}
+	source := newTestGraphSource(t, fake)
+
+	messages, err := source.Fetch("alerts@mybank.com")
+	if err != nil {
+		t.Fatalf("Fetch returned an error: %v", err)
+	}
+	if len(messages) != 1 {
+		t.Fatalf("Expected 1 message, got %d", len(messages))
+	}
+
+	msg := messages[0]
+	if msg.Id != "msg-1" || msg.MessageId != "<abc@mybank.com>" {
+		t.Errorf("Unexpected message identifiers: %+v", msg)
+	}
+	if string(msg.Body) != graphTestMessage {
+		t.Errorf("Unexpected message body %q", string(msg.Body))
+	}
+	if msg.Date.IsZero() {
+		t.Errorf("Expected the received date to be set")
+	}
+
+	expectedFilter := "not(categories/any(c:c eq 'Scanned'))"
+	if fake.filters[0] != expectedFilter {
+		t.Errorf("Expected filter %q, got %q", expectedFilter, fake.filters[0])
+	}
+
+	if err := source.MarkProcessed("msg-1"); err != nil {
+		t.Fatalf("MarkProcessed returned an error: %v", err)
+	}
+	if got := strings.Join(fake.categories["msg-1"], ","); got != "Bank,Scanned" {
+		t.Errorf("Expected categories Bank,Scanned, got %s", got)
+	}
+
+	messages, err = source.Fetch("alerts@mybank.com")
+	if err != nil {
+		t.Fatalf("Fetch returned an error: %v", err)
+	}
+	if len(messages) != 0 {
+		t.Errorf("Expected processed message to be excluded, got %d messages", len(messages))
+	}
+
+	if fake.tokens != 1 {
+		t.Errorf("Expected the access token to be cached, but %d were requested", fake.tokens)
+	}
+}
+
+func TestGraphSource_FetchMatchesPartOfSender(t *testing.T) {
+	fake := &fakeGraph{categories: map[string][]string{"msg-1": {"Bank"}}}
+	source := newTestGraphSource(t, fake)
+
+	messages, err := source.Fetch("mybank.com")
+	if err != nil {
+		t.Fatalf("Fetch returned an error: %v", err)
+	}
+	if len(messages) != 1 {
+		t.Errorf("Expected the message from alerts@mybank.com, got %d messages", len(messages))
+	}
+
+	messages, err = source.Fetch("otherbank.com")
+	if err != nil {
+		t.Fatalf("Fetch returned an error: %v", err)
+	}
+	if len(messages) != 0 {
+		t.Errorf("Expected no messages from otherbank.com, got %d", len(messages))
+	}
+	if len(fake.filters) != 1 {
+		t.Errorf("Expected the folder to be listed once for both senders, got %d listings", len(fake.filters))
+	}
+}
+
+func TestGetTransactions_FromGraphSource(t *testing.T) {
+	fake := &fakeGraph{categories: map[string][]string{"msg-1": {"Bank"}}}
+	source := newTestGraphSource(t, fake)
+
+	config := common.EmailProcessingConfig{
+		FromEmail: "alerts@mybank.com",
+		ProcessingSteps: []common.ProcessingStep{
+			{
+				Discriminator: common.Discriminator{Type: "plainTextBodyRegex", Regex: "Amount"},
+				ExtractionSteps: []common.ExtractionStep{
+					{
+						Regex: `Amount: \$(\d+)\.(\d\d)`,
+						TargetFields: []common.TargetField{
+							{GroupNumber: 1, TargetField: "dollars"},
+							{GroupNumber: 2, TargetField: "cents"},
+						},
+					},
+				},
+			},
+		},
+	}
+
+	transactions, err := GetTransactions(source, []common.EmailProcessingConfig{config})
+	if err != nil {
+		t.Fatalf("GetTransactions returned an error: %v", err)
+	}
+	if len(transactions) != 1 || len(transactions[0].Transactions) != 1 {
+		t.Fatalf("Expected one parsed transaction, got %+v", transactions)
+	}
+
+	info := transactions[0].Transactions[0]
+	if info.Amount.String() != "12.34" {
+		t.Errorf("Expected $12.34, got %s", info.Amount.String())
+	}
+	if info.TransactionDate.IsZero() {
+		t.Errorf("Expected the received date to be used as the transaction date")
+	}
+	if transactions[0].Id != "msg-1" {
+		t.Errorf("Expected id msg-1, got %s", transactions[0].Id)
+	}
+}
@@ -0,0 +1,132 @@
+package email
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+)
+
+// A mail source backed by an IMAP server. Processed messages are marked
+// with the `\Seen` flag.
+type ImapSource struct {
+	c *client.Client
+}
+
+// Connects and logs in to the IMAP server and selects the INBOX.
+// Requires that the IMAP_SERVER, IMAP_EMAIL, and IMAP_PASSWORD environment
+// variables are set.
+func NewImapSource() (*ImapSource, error) {
+	var server = os.Getenv("IMAP_SERVER")
+	var email = os.Getenv("IMAP_EMAIL")
+	var password = os.Getenv("IMAP_PASSWORD")
+
+	log.Printf("Connecting to server \"%s\"...\n", server)
+	c, err := client.DialTLS(server, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to server: %w", err)
+	}
+	log.Println("Connected to IMAP server.")
+
+	if err := c.Login(email, password); err != nil {
+		c.Logout()
+		return nil, fmt.Errorf("error logging in: %w", err)
+	}
+	log.Println("Logged in as", email)
+
+	mbox, err := c.Select("INBOX", false)
+	if err != nil {
+		c.Logout()
+		return nil, fmt.Errorf("error selecting INBOX: %w", err)
+	}
+	log.Printf("INBOX has %d messages\n", mbox.Messages)
+
+	return &ImapSource{c: c}, nil
+}
+
+// Returns the unread messages from the given sender.
+func (s *ImapSource) Fetch(fromEmail string) ([]RawMessage, error) {
+	criteria := imap.NewSearchCriteria()
+	criteria.Header.Set("From", fromEmail)
+	criteria.WithoutFlags = []string{imap.SeenFlag}
+
+	uids, err := s.c.UidSearch(criteria)
+	if err != nil {
+		return nil, fmt.Errorf("error searching for email: %w", err)
+	}
+
+	if len(uids) == 0 {
+		return nil, nil
+	}
+
+	seqSet := new(imap.SeqSet)
+	seqSet.AddNum(uids...)
+
+	messages := make(chan *imap.Message, len(uids))
+	done := make(chan error, 1)
+
+	section := &imap.BodySectionName{}
+	section.Peek = true
+
+	go func() {
+		done <- s.c.UidFetch(seqSet, []imap.FetchItem{section.FetchItem(), imap.FetchEnvelope, imap.FetchUid}, messages)
+	}()
+
+	if err := <-done; err != nil {
+		return nil, fmt.Errorf("error fetching message: %w", err)
+	}
+
+	var result []RawMessage
+	for msg := range messages {
+		literal := msg.GetBody(section)
+		if literal == nil {
+			log.Printf("Server returned no body for message UID %d", msg.Uid)
+			continue
+		}
+
+		body, err := io.ReadAll(literal)
+		if err != nil {
+			return nil, fmt.Errorf("error reading message UID %d: %w", msg.Uid, err)
+		}
+
+		raw := RawMessage{
+			Id:   strconv.FormatUint(uint64(msg.Uid), 10),
+			Body: body,
+		}
+		if msg.Envelope != nil {
+			raw.MessageId = msg.Envelope.MessageId
+			raw.Date = msg.Envelope.Date
+		}
+		result = append(result, raw)
+	}
+
+	return result, nil
+}
+
+// Marks the email with the given UID as "read".
+func (s *ImapSource) MarkProcessed(id string) error {
+	uid, err := strconv.ParseUint(id, 10, 32)
+	if err != nil {
+		return fmt.Errorf("invalid IMAP UID %q: %w", id, err)
+	}
+
+	seqSet := new(imap.SeqSet)
+	seqSet.AddNum(uint32(uid))
+
+	item := imap.FormatFlagsOp(imap.AddFlags, true)
+	flags := []interface{}{imap.SeenFlag}
+
+	if err := s.c.UidStore(seqSet, item, flags, nil); err != nil {
+		return fmt.Errorf("unable to mark message as read: %w", err)
+	}
+	return nil
+}
+
+// Logs out of the IMAP server.
+func (s *ImapSource) Close() error {
+	return s.c.Logout()
+}
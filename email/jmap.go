@@ -0,0 +1,433 @@
+package email
+
+import (
+	"bytes"
+	"encoding/json"
+	"firefly-iii-email-scanner/common"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-message/mail"
+)
+
+const (
+	jmapCoreCapability = "urn:ietf:params:jmap:core"
+	jmapMailCapability = "urn:ietf:params:jmap:mail"
+
+	defaultJmapMailbox = "inbox"
+	defaultJmapKeyword = "$seen"
+
+	// How many emails to request per Email/query call.
+	jmapPageSize = 50
+)
+
+// A mail source backed by a JMAP server, such as Fastmail or Stalwart.
+// Processed messages are given a keyword and, optionally, moved to another
+// mailbox.
+type JmapSource struct {
+	sessionUrl       string
+	token            string
+	username         string
+	password         string
+	mailbox          string
+	processedKeyword string
+	processedMailbox string
+	httpClient       *http.Client
+
+	apiUrl             string
+	accountId          string
+	mailboxId          string
+	processedMailboxId string
+}
+
+// Creates a JMAP mail source using the given options and fetches the JMAP
+// session.
+//
+// Requires that the JMAP_SESSION_URL environment variable is set, along with
+// either JMAP_TOKEN (an API token sent as a bearer token) or JMAP_USERNAME and
+// JMAP_PASSWORD (sent with basic authentication).
+func NewJmapSource(config *common.JmapConfig) (*JmapSource, error) {
+	source := &JmapSource{
+		sessionUrl:       os.Getenv("JMAP_SESSION_URL"),
+		token:            os.Getenv("JMAP_TOKEN"),
+		username:         os.Getenv("JMAP_USERNAME"),
+		password:         os.Getenv("JMAP_PASSWORD"),
+		mailbox:          defaultJmapMailbox,
+		processedKeyword: defaultJmapKeyword,
+		httpClient:       &http.Client{Timeout: 30 * time.Second},
+	}
+
+	if source.sessionUrl == "" {
+		return nil, fmt.Errorf("JMAP_SESSION_URL is required for the jmap source")
+	}
+	if source.token == "" && source.username == "" {
+		return nil, fmt.Errorf("either JMAP_TOKEN or JMAP_USERNAME and JMAP_PASSWORD are required for the jmap source")
+	}
+
+	if config != nil {
+		if config.Mailbox != "" {
+			source.mailbox = config.Mailbox
+		}
+		if config.ProcessedKeyword != "" {
+			source.processedKeyword = config.ProcessedKeyword
+		}
+		source.processedMailbox = config.ProcessedMailbox
+	}
+
+	if err := source.connect(); err != nil {
+		return nil, err
+	}
+
+	return source, nil
+}
+
+type jmapSession struct {
+	ApiUrl          string            `json:"apiUrl"`
+	PrimaryAccounts map[string]string `json:"primaryAccounts"`
+}
+
+type jmapMailbox struct {
+	Id   string `json:"id"`
+	Name string `json:"name"`
+	Role string `json:"role"`
+}
+
+type jmapEmail struct {
+	Id         string   `json:"id"`
+	MessageId  []string `json:"messageId"`
+	ReceivedAt string   `json:"receivedAt"`
+	Headers    []struct {
+		Name  string `json:"name"`
+		Value string `json:"value"`
+	} `json:"headers"`
+	TextBody   []jmapBodyPart           `json:"textBody"`
+	HtmlBody   []jmapBodyPart           `json:"htmlBody"`
+	BodyValues map[string]jmapBodyValue `json:"bodyValues"`
+}
+
+type jmapBodyPart struct {
+	PartId string `json:"partId"`
+	Type   string `json:"type"`
+}
+
+type jmapBodyValue struct {
+	Value string `json:"value"`
+}
+
+// A single method call or response: the method name, its arguments and the call id.
+type jmapInvocation [3]any
+
+// The body of a JMAP API response. Each method response is an array of the
+// method name, its arguments and the call id.
+type jmapResponse struct {
+	MethodResponses [][3]json.RawMessage `json:"methodResponses"`
+}
+
+// Fetches the session to find the API endpoint and mail account, then
+// resolves the configured mailboxes to ids.
+func (s *JmapSource) connect() error {
+	body, err := s.do(http.MethodGet, s.sessionUrl, nil)
+	if err != nil {
+		return fmt.Errorf("error fetching JMAP session: %w", err)
+	}
+
+	var session jmapSession
+	if err := json.Unmarshal(body, &session); err != nil {
+		return fmt.Errorf("error parsing JMAP session: %w", err)
+	}
+
+	s.apiUrl = session.ApiUrl
+	s.accountId = session.PrimaryAccounts[jmapMailCapability]
+	if s.apiUrl == "" || s.accountId == "" {
+		return fmt.Errorf("JMAP session does not have a mail account")
+	}
+
+	responses, err := s.call(jmapInvocation{"Mailbox/get", map[string]any{
+		"accountId":  s.accountId,
+		"ids":        nil,
+		"properties": []string{"id", "name", "role"},
+	}, "0"})
+	if err != nil {
+		return fmt.Errorf("error listing mailboxes: %w", err)
+	}
+
+	var mailboxes struct {
+		List []jmapMailbox `json:"list"`
+	}
+	if err := json.Unmarshal(responses[0], &mailboxes); err != nil {
+		return fmt.Errorf("error parsing mailboxes: %w", err)
+	}
+
+	s.mailboxId = findJmapMailbox(mailboxes.List, s.mailbox)
+	if s.mailboxId == "" {
+		return fmt.Errorf("JMAP mailbox %q was not found", s.mailbox)
+	}
+
+	if s.processedMailbox != "" {
+		s.processedMailboxId = findJmapMailbox(mailboxes.List, s.processedMailbox)
+		if s.processedMailboxId == "" {
+			return fmt.Errorf("JMAP mailbox %q was not found", s.processedMailbox)
+		}
+	}
+
+	return nil
+}
+
+// Finds a mailbox by its name, or by its role (e.g. "inbox"), ignoring case.
+func findJmapMailbox(mailboxes []jmapMailbox, name string) string {
+	for _, mailbox := range mailboxes {
+		if strings.EqualFold(mailbox.Name, name) {
+			return mailbox.Id
+		}
+	}
+	for _, mailbox := range mailboxes {
+		if strings.EqualFold(mailbox.Role, name) {
+			return mailbox.Id
+		}
+	}
+	return ""
+}
+
+// Returns the emails from the given sender in the configured mailbox that do
+// not yet have the processed keyword.
+func (s *JmapSource) Fetch(fromEmail string) ([]RawMessage, error) {
+	var result []RawMessage
+
+	for position := 0; ; position += jmapPageSize {
+		responses, err := s.call(
+			jmapInvocation{"Email/query", map[string]any{
+				"accountId": s.accountId,
+				"filter": map[string]any{
+					"inMailbox":  s.mailboxId,
+					"from":       fromEmail,
+					"notKeyword": s.processedKeyword,
+				},
+				"sort":     []map[string]any{{"property": "receivedAt", "isAscending": true}},
+				"position": position,
+				"limit":    jmapPageSize,
+			}, "0"},
+			jmapInvocation{"Email/get", map[string]any{
+				"accountId": s.accountId,
+				"#ids": map[string]string{
+					"resultOf": "0",
+					"name":     "Email/query",
+					"path":     "/ids",
+				},
+				"properties":          []string{"id", "messageId", "receivedAt", "headers", "textBody", "htmlBody", "bodyValues"},
+				"fetchTextBodyValues": true,
+				"fetchHTMLBodyValues": true,
+			}, "1"},
+		)
+		if err != nil {
+			return nil, fmt.Errorf("error querying emails: %w", err)
+		}
+
+		var emails struct {
+			List []jmapEmail `json:"list"`
+		}
+		if err := json.Unmarshal(responses[1], &emails); err != nil {
+			return nil, fmt.Errorf("error parsing emails: %w", err)
+		}
+
+		for _, email := range emails.List {
+			raw, err := email.toRawMessage()
+			if err != nil {
+				return nil, fmt.Errorf("error reading email %s: %w", email.Id, err)
+			}
+			result = append(result, raw)
+		}
+
+		if len(emails.List) < jmapPageSize {
+			break
+		}
+	}
+
+	return result, nil
+}
+
+// Rebuilds a MIME message from the email's headers and decoded text bodies
+// so that it can go through the same parsing as messages from other sources.
+func (e *jmapEmail) toRawMessage() (RawMessage, error) {
+	var header mail.Header
+	for _, h := range e.Headers {
+		switch strings.ToLower(h.Name) {
+		case "content-type", "content-transfer-encoding", "mime-version":
+			continue
+		}
+		value := strings.ReplaceAll(strings.ReplaceAll(h.Value, "\r\n", ""), "\n", "")
+		header.Add(h.Name, strings.TrimSpace(value))
+	}
+	header.Set("MIME-Version", "1.0")
+
+	var buf bytes.Buffer
+	w, err := mail.CreateInlineWriter(&buf, header)
+	if err != nil {
+		return RawMessage{}, err
+	}
+
+	if err := e.writeParts(w, e.TextBody, "text/plain"); err != nil {
+		return RawMessage{}, err
+	}
+	if err := e.writeParts(w, e.HtmlBody, "text/html"); err != nil {
+		return RawMessage{}, err
+	}
+	if err := w.Close(); err != nil {
+		return RawMessage{}, err
+	}
+
+	raw := RawMessage{
+		Id:   e.Id,
+		Body: buf.Bytes(),
+	}
+	if len(e.MessageId) > 0 {
+		raw.MessageId = "<" + e.MessageId[0] + ">"
+	}
+	if date, err := time.Parse(time.RFC3339, e.ReceivedAt); err == nil {
+		raw.Date = date
+	}
+
+	return raw, nil
+}
+
+// Writes the body values of the given parts which have the given content type.
+// JMAP lists text parts in the HTML body when there is no HTML alternative,
+// so other types are skipped.
+func (e *jmapEmail) writeParts(w *mail.InlineWriter, parts []jmapBodyPart, contentType string) error {
+	for _, part := range parts {
+		value, ok := e.BodyValues[part.PartId]
+		if !ok || !strings.EqualFold(part.Type, contentType) {
+			continue
+		}
+
+		var h mail.InlineHeader
+		h.SetContentType(contentType, map[string]string{"charset": "utf-8"})
+		pw, err := w.CreatePart(h)
+		if err != nil {
+			return err
+		}
+		if _, err := io.WriteString(pw, value.Value); err != nil {
+			return err
+		}
+		if err := pw.Close(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Adds the processed keyword to the email with the given JMAP id and, if a
+// processed mailbox is configured, moves it there.
+func (s *JmapSource) MarkProcessed(id string) error {
+	patch := map[string]any{
+		"keywords/" + s.processedKeyword: true,
+	}
+	if s.processedMailboxId != "" {
+		patch["mailboxIds/"+s.mailboxId] = nil
+		patch["mailboxIds/"+s.processedMailboxId] = true
+	}
+
+	responses, err := s.call(jmapInvocation{"Email/set", map[string]any{
+		"accountId": s.accountId,
+		"update":    map[string]any{id: patch},
+	}, "0"})
+	if err != nil {
+		return fmt.Errorf("unable to mark email as processed: %w", err)
+	}
+
+	var result struct {
+		NotUpdated map[string]struct {
+			Type        string `json:"type"`
+			Description string `json:"description"`
+		} `json:"notUpdated"`
+	}
+	if err := json.Unmarshal(responses[0], &result); err != nil {
+		return fmt.Errorf("error parsing Email/set response: %w", err)
+	}
+	if failure, ok := result.NotUpdated[id]; ok {
+		return fmt.Errorf("unable to mark email as processed: %s %s", failure.Type, failure.Description)
+	}
+
+	return nil
+}
+
+// The JMAP source holds no connection, so there is nothing to release.
+func (s *JmapSource) Close() error {
+	return nil
+}
+
+// Sends the given method calls in a single request and returns the arguments
+// of each response, in order. A method level error fails the whole call.
+func (s *JmapSource) call(calls ...jmapInvocation) ([]json.RawMessage, error) {
+	requestBody, err := json.Marshal(map[string]any{
+		"using":       []string{jmapCoreCapability, jmapMailCapability},
+		"methodCalls": calls,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal request: %w", err)
+	}
+
+	body, err := s.do(http.MethodPost, s.apiUrl, bytes.NewReader(requestBody))
+	if err != nil {
+		return nil, err
+	}
+
+	var response jmapResponse
+	if err := json.Unmarshal(body, &response); err != nil {
+		return nil, fmt.Errorf("failed to parse response: %w", err)
+	}
+
+	if len(response.MethodResponses) != len(calls) {
+		return nil, fmt.Errorf("expected %d method responses, got %d", len(calls), len(response.MethodResponses))
+	}
+
+	result := make([]json.RawMessage, len(calls))
+	for i, methodResponse := range response.MethodResponses {
+		var name string
+		if err := json.Unmarshal(methodResponse[0], &name); err != nil {
+			return nil, fmt.Errorf("failed to parse response: %w", err)
+		}
+		if name == "error" {
+			return nil, fmt.Errorf("%s failed: %s", calls[i][0], string(methodResponse[1]))
+		}
+		result[i] = methodResponse[1]
+	}
+
+	return result, nil
+}
+
+func (s *JmapSource) do(method string, url string, body io.Reader) ([]byte, error) {
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+
+	if s.token != "" {
+		req.Header.Set("Authorization", "Bearer "+s.token)
+	} else {
+		req.SetBasicAuth(s.username, s.password)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := s.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response: %w", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s %s returned %s: %s", method, req.URL.Path, resp.Status, string(respBody))
+	}
+
+	return respBody, nil
+}
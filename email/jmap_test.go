@@ -0,0 +1,148 @@
+package email
+
+import (
+	"encoding/json"
+	"firefly-iii-email-scanner/common"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// A minimal fake of a JMAP server holding a single email.
+type fakeJmap struct {
+	keywords   map[string]bool
+	mailboxIds map[string]bool
+	queries    []map[string]any
+}
+
+func (f *fakeJmap) handler(t *testing.T, serverUrl *string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/session", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]any{
+			"apiUrl":          *serverUrl + "/api",
+			"primaryAccounts": map[string]string{jmapMailCapability: "acc"},
+		})
+	})
+	mux.HandleFunc("/api", func(w http.ResponseWriter, r *http.Request) {
+		var request struct {
+			MethodCalls [][3]json.RawMessage `json:"methodCalls"`
+		}
+		json.NewDecoder(r.Body).Decode(&request)
+
+		var responses []any
+		for _, call := range request.MethodCalls {
+			var name, callId string
+			var args map[string]any
+			json.Unmarshal(call[0], &name)
+			json.Unmarshal(call[1], &args)
+			json.Unmarshal(call[2], &callId)
+
+			switch name {
+			case "Mailbox/get":
+				responses = append(responses, []any{name, map[string]any{"list": []map[string]string{
+					{"id": "mb-inbox", "name": "Inbox", "role": "inbox"},
+					{"id": "mb-done", "name": "Processed"},
+				}}, callId})
+			case "Email/query":
+				f.queries = append(f.queries, args["filter"].(map[string]any))
+				responses = append(responses, []any{name, map[string]any{}, callId})
+			case "Email/get":
+				var list []any
+				if !f.keywords["$seen"] && f.mailboxIds["mb-inbox"] {
+					list = append(list, map[string]any{
+						"id":         "e1",
+						"messageId":  []string{"abc@mybank.com"},
+						"receivedAt": "2024-03-15T14:00:00Z",
+						"headers": []map[string]string{
+							{"name": "From", "value": " alerts@mybank.com"},
+							{"name": "Subject", "value": " Transaction\r\n alert"},
+							{"name": "Content-Type", "value": " multipart/alternative; boundary=x"},
+						},
+						"textBody":   []map[string]string{{"partId": "1", "type": "text/plain"}},
+						"htmlBody":   []map[string]string{{"partId": "2", "type": "text/html"}},
+						"bodyValues": map[string]any{"1": map[string]string{"value": "Amount: $12.34\n"}, "2": map[string]string{"value": "<p>Amount: $12.34</p>"}},
+					})
+				}
+				responses = append(responses, []any{name, map[string]any{"list": list}, callId})
+			case "Email/set":
+				for key, value := range args["update"].(map[string]any)["e1"].(map[string]any) {
+					if kw, ok := strings.CutPrefix(key, "keywords/"); ok {
+						f.keywords[kw] = value == true
+					} else if mb, ok := strings.CutPrefix(key, "mailboxIds/"); ok {
+						f.mailboxIds[mb] = value == true
+					}
+				}
+				responses = append(responses, []any{name, map[string]any{"updated": map[string]any{"e1": nil}}, callId})
+			default:
+				t.Errorf("unexpected method %s", name)
+			}
+		}
+		json.NewEncoder(w).Encode(map[string]any{"methodResponses": responses})
+	})
+	return mux
+}
+
+func TestJmapSource_FetchAndMarkProcessed(t *testing.T) {
+	fake := &fakeJmap{keywords: map[string]bool{}, mailboxIds: map[string]bool{"mb-inbox": true}}
+	var serverUrl string
+	server := httptest.NewServer(fake.handler(t, &serverUrl))
+	defer server.Close()
+	serverUrl = server.URL
+
+	t.Setenv("JMAP_SESSION_URL", server.URL+"/session")
+	t.Setenv("JMAP_TOKEN", "token")
+
+	source, err := NewJmapSource(&common.JmapConfig{ProcessedMailbox: "Processed"})
+	if err != nil {
+		t.Fatalf("NewJmapSource returned an error: %v", err)
+	}
+
+	messages, err := source.Fetch("alerts@mybank.com")
+	if err != nil {
+		t.Fatalf("Fetch returned an error: %v", err)
+	}
+	if len(messages) != 1 {
+		t.Fatalf("Expected 1 message, got %d", len(messages))
+	}
+	if messages[0].Id != "e1" || messages[0].MessageId != "<abc@mybank.com>" {
+		t.Errorf("Unexpected message identifiers: %+v", messages[0])
+	}
+
+	filter := fake.queries[0]
+	if filter["from"] != "alerts@mybank.com" || filter["inMailbox"] != "mb-inbox" || filter["notKeyword"] != "$seen" {
+		t.Errorf("Unexpected query filter %v", filter)
+	}
+
+	config := common.EmailProcessingConfig{
+		ProcessingSteps: []common.ProcessingStep{
+			{
+				Discriminator: common.Discriminator{Type: "plainTextBodyRegex", Regex: "Amount"},
+				ExtractionSteps: []common.ExtractionStep{
+					{
+						Regex: `Amount: \$(\d+)\.(\d\d)`,
+						TargetFields: []common.TargetField{
+							{GroupNumber: 1, TargetField: "dollars"},
+							{GroupNumber: 2, TargetField: "cents"},
+						},
+					},
+				},
+			},
+		},
+	}
+	info := processMessage(messages[0], config)
+	if len(info.Transactions) != 1 || info.Transactions[0].Amount.String() != "12.34" {
+		t.Errorf("Expected the rebuilt message to parse to $12.34, got %+v", info.Transactions)
+	}
+
+	if err := source.MarkProcessed("e1"); err != nil {
+		t.Fatalf("MarkProcessed returned an error: %v", err)
+	}
+	if !fake.keywords["$seen"] || fake.mailboxIds["mb-inbox"] || !fake.mailboxIds["mb-done"] {
+		t.Errorf("Expected the email to be marked seen and moved, got keywords %v mailboxes %v", fake.keywords, fake.mailboxIds)
+	}
+}
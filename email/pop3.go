@@ -0,0 +1,286 @@
+package email
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"firefly-iii-email-scanner/common"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/textproto"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/emersion/go-message/mail"
+)
+
+const defaultPop3StateFile = "pop3-state.json"
+
+// A mail source backed by a POP3 server. POP3 has no flags, so the UIDLs of
+// processed messages are tracked in a local state file, and messages can
+// optionally be deleted from the server once processed.
+type Pop3Source struct {
+	conn                  *textproto.Conn
+	stateFile             string
+	deleteAfterProcessing bool
+
+	// The UIDLs of processed messages, as loaded from and saved to the state file.
+	seen map[string]bool
+	// The message number of each UIDL currently on the server.
+	numbers map[string]int
+	// The unprocessed messages, downloaded on the first call to Fetch.
+	messages []pop3Message
+	fetched  bool
+}
+
+type pop3Message struct {
+	from string
+	raw  RawMessage
+}
+
+// The contents of the POP3 state file.
+type pop3State struct {
+	Seen []string `json:"seen"`
+}
+
+// Connects and logs in to the POP3 server over TLS and loads the local state
+// file. Requires that the POP3_SERVER, POP3_EMAIL, and POP3_PASSWORD
+// environment variables are set.
+func NewPop3Source(config *common.Pop3Config) (*Pop3Source, error) {
+	server := os.Getenv("POP3_SERVER")
+	user := os.Getenv("POP3_EMAIL")
+	password := os.Getenv("POP3_PASSWORD")
+
+	log.Printf("Connecting to server \"%s\"...\n", server)
+	conn, err := tls.Dial("tcp", server, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to server: %w", err)
+	}
+	log.Println("Connected to POP3 server.")
+
+	source, err := openPop3Source(conn, config, user, password)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	log.Println("Logged in as", user)
+
+	return source, nil
+}
+
+// Logs in over an established connection and lists the messages on the server.
+func openPop3Source(conn net.Conn, config *common.Pop3Config, user string, password string) (*Pop3Source, error) {
+	source := &Pop3Source{
+		conn:      textproto.NewConn(conn),
+		stateFile: defaultPop3StateFile,
+		seen:      map[string]bool{},
+		numbers:   map[string]int{},
+	}
+	if config != nil {
+		if config.StateFile != "" {
+			source.stateFile = config.StateFile
+		}
+		source.deleteAfterProcessing = config.DeleteAfterProcessing
+	}
+
+	if err := source.loadState(); err != nil {
+		return nil, err
+	}
+
+	if _, err := source.readResponse(); err != nil {
+		return nil, fmt.Errorf("unexpected greeting: %w", err)
+	}
+	if _, err := source.cmd("USER %s", user); err != nil {
+		return nil, fmt.Errorf("error logging in: %w", err)
+	}
+	if _, err := source.cmd("PASS %s", password); err != nil {
+		return nil, fmt.Errorf("error logging in: %w", err)
+	}
+
+	if _, err := source.cmd("UIDL"); err != nil {
+		return nil, fmt.Errorf("error listing messages: %w", err)
+	}
+	listing, err := source.conn.ReadDotLines()
+	if err != nil {
+		return nil, fmt.Errorf("error listing messages: %w", err)
+	}
+	for _, line := range listing {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("invalid UIDL line %q", line)
+		}
+		number, err := strconv.Atoi(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid UIDL line %q", line)
+		}
+		source.numbers[fields[1]] = number
+	}
+	log.Printf("Mailbox has %d messages\n", len(source.numbers))
+
+	return source, nil
+}
+
+// Returns the messages from the given sender whose UIDL has not been
+// recorded as processed. All unprocessed messages are downloaded on the first
+// call, since POP3 cannot search by sender.
+func (s *Pop3Source) Fetch(fromEmail string) ([]RawMessage, error) {
+	if !s.fetched {
+		if err := s.download(); err != nil {
+			return nil, err
+		}
+		s.fetched = true
+	}
+
+	var result []RawMessage
+	for _, message := range s.messages {
+		if strings.Contains(message.from, strings.ToLower(fromEmail)) {
+			result = append(result, message.raw)
+		}
+	}
+	return result, nil
+}
+
+func (s *Pop3Source) download() error {
+	var uidls []string
+	for uidl := range s.numbers {
+		if !s.seen[uidl] {
+			uidls = append(uidls, uidl)
+		}
+	}
+	sort.Slice(uidls, func(i, j int) bool { return s.numbers[uidls[i]] < s.numbers[uidls[j]] })
+
+	for _, uidl := range uidls {
+		number := s.numbers[uidl]
+
+		if _, err := s.cmd("RETR %d", number); err != nil {
+			return fmt.Errorf("error fetching message %d: %w", number, err)
+		}
+		body, err := s.conn.ReadDotBytes()
+		if err != nil {
+			return fmt.Errorf("error fetching message %d: %w", number, err)
+		}
+
+		raw := RawMessage{
+			Id:   uidl,
+			Body: body,
+		}
+		var from string
+		if m, err := mail.CreateReader(bytes.NewReader(body)); err == nil {
+			if id, err := m.Header.MessageID(); err == nil && id != "" {
+				raw.MessageId = "<" + id + ">"
+			}
+			raw.Date, _ = m.Header.Date()
+			from = strings.ToLower(m.Header.Get("From"))
+		} else {
+			log.Printf("Unable to read the headers of message %d: %v", number, err)
+		}
+
+		s.messages = append(s.messages, pop3Message{from: from, raw: raw})
+	}
+	return nil
+}
+
+// Records the message with the given UIDL as processed in the state file,
+// and deletes it from the server if configured to do so. Deletions are only
+// committed by the server when the source is closed.
+func (s *Pop3Source) MarkProcessed(id string) error {
+	s.seen[id] = true
+	if err := s.saveState(); err != nil {
+		return err
+	}
+
+	if s.deleteAfterProcessing {
+		number, ok := s.numbers[id]
+		if !ok {
+			return fmt.Errorf("message %s is not on the server", id)
+		}
+		if _, err := s.cmd("DELE %d", number); err != nil {
+			return fmt.Errorf("unable to delete message %s: %w", id, err)
+		}
+	}
+	return nil
+}
+
+// Ends the POP3 session, which commits any deletions.
+func (s *Pop3Source) Close() error {
+	_, err := s.cmd("QUIT")
+	if closeErr := s.conn.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func (s *Pop3Source) loadState() error {
+	data, err := os.ReadFile(s.stateFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read POP3 state file: %w", err)
+	}
+
+	var state pop3State
+	if err := json.Unmarshal(data, &state); err != nil {
+		return fmt.Errorf("failed to parse POP3 state file %s: %w", s.stateFile, err)
+	}
+	for _, uidl := range state.Seen {
+		s.seen[uidl] = true
+	}
+	return nil
+}
+
+// Writes the processed UIDLs which are still on the server to the state
+// file, so that it does not grow forever as messages are removed.
+func (s *Pop3Source) saveState() error {
+	var state pop3State
+	for uidl := range s.seen {
+		if _, ok := s.numbers[uidl]; ok {
+			state.Seen = append(state.Seen, uidl)
+		}
+	}
+	sort.Strings(state.Seen)
+
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal POP3 state: %w", err)
+	}
+
+	// Write to a temporary file first so a crash cannot leave a truncated state file.
+	tmp := s.stateFile + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("failed to write POP3 state file: %w", err)
+	}
+	if err := os.Rename(tmp, s.stateFile); err != nil {
+		return fmt.Errorf("failed to write POP3 state file: %w", err)
+	}
+	return nil
+}
+
+// Sends a command and reads its single line response.
+func (s *Pop3Source) cmd(format string, args ...any) (string, error) {
+	if err := s.conn.PrintfLine(format, args...); err != nil {
+		return "", err
+	}
+	return s.readResponse()
+}
+
+// Reads a status line, returning its text if it is "+OK" and an error otherwise.
+func (s *Pop3Source) readResponse() (string, error) {
+	line, err := s.conn.ReadLine()
+	if err != nil {
+		if err == io.EOF {
+			return "", io.ErrUnexpectedEOF
+		}
+		return "", err
+	}
+
+	if status, ok := strings.CutPrefix(line, "+OK"); ok {
+		return strings.TrimSpace(status), nil
+	}
+	return "", fmt.Errorf("server responded: %s", line)
+}
@@ -0,0 +1,145 @@
+package email
+
+import (
+	"bufio"
+	"firefly-iii-email-scanner/common"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Serves a fixed mailbox over one end of a pipe, recording deleted messages.
+func serveFakePop3(t *testing.T, conn net.Conn, messages map[string]string, uidls []string, deleted *[]int) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	write := func(format string, args ...any) {
+		fmt.Fprintf(conn, format+"\r\n", args...)
+	}
+
+	write("+OK fake POP3 ready")
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		fields := strings.Fields(line)
+		switch fields[0] {
+		case "USER":
+			write("+OK")
+		case "PASS":
+			if fields[1] != "secret" {
+				write("-ERR invalid password")
+				continue
+			}
+			write("+OK logged in")
+		case "UIDL":
+			write("+OK")
+			for i, uidl := range uidls {
+				write("%d %s", i+1, uidl)
+			}
+			write(".")
+		case "RETR":
+			var number int
+			fmt.Sscan(fields[1], &number)
+			write("+OK")
+			for _, l := range strings.Split(messages[uidls[number-1]], "\r\n") {
+				if strings.HasPrefix(l, ".") {
+					l = "." + l
+				}
+				write("%s", l)
+			}
+			write(".")
+		case "DELE":
+			var number int
+			fmt.Sscan(fields[1], &number)
+			*deleted = append(*deleted, number)
+			write("+OK")
+		case "QUIT":
+			write("+OK bye")
+			return
+		default:
+			t.Errorf("unexpected command %q", line)
+			write("-ERR unknown command")
+		}
+	}
+}
+
+func newPop3TestMessage(from string, amount string) string {
+	return "From: " + from + "\r\n" +
+		"Message-ID: <" + amount + "@example.com>\r\n" +
+		"Date: Fri, 15 Mar 2024 10:00:00 -0400\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"\r\n" +
+		"Amount: $" + amount + "\r\n" +
+		".hidden line\r\n"
+}
+
+func TestPop3Source_TracksProcessedUidls(t *testing.T) {
+	stateFile := filepath.Join(t.TempDir(), "state.json")
+	messages := map[string]string{
+		"uid-a": newPop3TestMessage("Bank Alerts <alerts@mybank.com>", "12.34"),
+		"uid-b": newPop3TestMessage("newsletter@example.com", "0.00"),
+		"uid-c": newPop3TestMessage("alerts@mybank.com", "56.78"),
+	}
+	uidls := []string{"uid-a", "uid-b", "uid-c"}
+
+	open := func(config *common.Pop3Config, deleted *[]int) *Pop3Source {
+		client, server := net.Pipe()
+		go serveFakePop3(t, server, messages, uidls, deleted)
+		source, err := openPop3Source(client, config, "me", "secret")
+		if err != nil {
+			t.Fatalf("openPop3Source returned an error: %v", err)
+		}
+		return source
+	}
+
+	var deleted []int
+	source := open(&common.Pop3Config{StateFile: stateFile, DeleteAfterProcessing: true}, &deleted)
+
+	fetched, err := source.Fetch("alerts@mybank.com")
+	if err != nil {
+		t.Fatalf("Fetch returned an error: %v", err)
+	}
+	if len(fetched) != 2 || fetched[0].Id != "uid-a" || fetched[1].Id != "uid-c" {
+		t.Fatalf("Expected messages uid-a and uid-c, got %+v", fetched)
+	}
+	if fetched[0].MessageId != "<12.34@example.com>" || fetched[0].Date.IsZero() {
+		t.Errorf("Expected headers to be read, got %+v", fetched[0])
+	}
+	if !strings.Contains(string(fetched[0].Body), "\n.hidden line") {
+		t.Errorf("Expected dot-stuffed lines to be restored, got %q", string(fetched[0].Body))
+	}
+
+	if err := source.MarkProcessed("uid-a"); err != nil {
+		t.Fatalf("MarkProcessed returned an error: %v", err)
+	}
+	if err := source.Close(); err != nil {
+		t.Fatalf("Close returned an error: %v", err)
+	}
+	if len(deleted) != 1 || deleted[0] != 1 {
+		t.Errorf("Expected message 1 to be deleted, got %v", deleted)
+	}
+
+	state, err := os.ReadFile(stateFile)
+	if err != nil {
+		t.Fatalf("Expected the state file to be written: %v", err)
+	}
+	if !strings.Contains(string(state), "uid-a") {
+		t.Errorf("Expected the state file to contain uid-a, got %s", string(state))
+	}
+
+	deleted = nil
+	source = open(&common.Pop3Config{StateFile: stateFile}, &deleted)
+	defer source.Close()
+
+	fetched, err = source.Fetch("alerts@mybank.com")
+	if err != nil {
+		t.Fatalf("Fetch returned an error: %v", err)
+	}
+	if len(fetched) != 1 || fetched[0].Id != "uid-c" {
+		t.Errorf("Expected only uid-c after uid-a was processed, got %+v", fetched)
+	}
+}
@@ -0,0 +1,28 @@
+package email
+
+import "time"
+
+// A message as retrieved from a mail source, before any MIME parsing.
+type RawMessage struct {
+	// The source-specific identifier of the message, used to mark it as processed.
+	Id string
+	// The Message-ID header of the email.
+	MessageId string
+	// When the message was sent or received. Used as a fallback transaction date.
+	Date time.Time
+	// The full RFC 5322 content of the message.
+	Body []byte
+}
+
+// Provides access to the messages of a mailbox, regardless of the protocol
+// used to reach it.
+type Source interface {
+	// Returns all messages from the given sender that have not yet been
+	// marked as processed.
+	Fetch(fromEmail string) ([]RawMessage, error)
+	// Marks the message with the given source-specific id as processed so
+	// that it is not returned by future calls to `Fetch`.
+	MarkProcessed(id string) error
+	// Releases any connection held by the source.
+	Close() error
+}
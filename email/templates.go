@@ -0,0 +1,127 @@
+package email
+
+import (
+	"firefly-iii-email-scanner/common"
+	"fmt"
+	"slices"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// The values available to the templates of a processing step, e.g.
+// "{{.Destination}} ({{.CardLast4}})".
+type templateData struct {
+	// The amount as it is shown in notifications, e.g. "$12.34" or "12.34 EUR".
+	Amount string
+	// The foreign amount as it is shown in notifications, or empty if there is none.
+	ForeignAmount string
+	Date          time.Time
+	Destination   string
+	// One of "withdrawal", "deposit", "transfer" or "unspecified".
+	Type        string
+	Description string
+	Notes       string
+	Category    string
+	Budget      string
+	Bill        string
+	Tags        []string
+	CardLast4   string
+	Cardholder  string
+	Reference   string
+	// The name of the processing step.
+	Step    string
+	Subject string
+}
+
+func newTemplateData(transaction *common.TransactionInfo, email *ParsedEmail) templateData {
+	foreignAmount := ""
+	if transaction.ForeignAmount != nil && !transaction.ForeignAmount.IsZero() {
+		foreignAmount = transaction.ForeignAmount.Display()
+	}
+
+	return templateData{
+		Amount:        transaction.Amount.Display(),
+		ForeignAmount: foreignAmount,
+		Date:          transaction.TransactionDate,
+		Destination:   transaction.DestinationName,
+		Type:          transaction.Type.String(),
+		Description:   transaction.Description,
+		Notes:         transaction.Notes,
+		Category:      transaction.Category,
+		Budget:        transaction.Budget,
+		Bill:          transaction.Bill,
+		Tags:          transaction.Tags,
+		CardLast4:     transaction.CardLast4,
+		Cardholder:    transaction.Cardholder,
+		Reference:     transaction.Reference,
+		Step:          transaction.ProcessingStep,
+		Subject:       email.Subject(),
+	}
+}
+
+// Compiles the template of a processing step's field.
+func compileFieldTemplate(field string, text string) (*template.Template, error) {
+	tmpl, err := template.New(field).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("template for %s does not compile: %w", field, err)
+	}
+	return tmpl, nil
+}
+
+// Renders the template of a processing step's field. The result is trimmed,
+// so that a template whose values are all missing renders as empty.
+func renderFieldTemplate(field string, text string, data templateData) (string, error) {
+	tmpl, err := compileFieldTemplate(field, text)
+	if err != nil {
+		return "", err
+	}
+
+	var rendered strings.Builder
+	if err := tmpl.Execute(&rendered, data); err != nil {
+		return "", fmt.Errorf("template for %s failed: %w", field, err)
+	}
+	return strings.TrimSpace(rendered.String()), nil
+}
+
+// Sets the metadata fields configured on the processing step, overriding any
+// values extracted from the email. The templates all see the values as they
+// were extracted, before any of them are overridden. Tags are added to the
+// extracted tags rather than replacing them, and tags which render as empty
+// are left out. Returns an error wrapping ErrConfig if a template does not
+// compile or refers to an unknown value.
+func applyStepFields(step common.ProcessingStep, email *ParsedEmail, transaction *common.TransactionInfo) error {
+	data := newTemplateData(transaction, email)
+
+	var renderErr error
+	render := func(field string, text string) string {
+		rendered, err := renderFieldTemplate(field, text, data)
+		if err != nil && renderErr == nil {
+			renderErr = &ExtractionError{Kind: ErrConfig, Err: err}
+		}
+		return rendered
+	}
+
+	if step.Description != "" {
+		transaction.Description = render("description", step.Description)
+	}
+	if step.Notes != "" {
+		transaction.Notes = render("notes", step.Notes)
+	}
+	if step.Category != "" {
+		transaction.Category = render("category", step.Category)
+	}
+	if step.Budget != "" {
+		transaction.Budget = render("budget", step.Budget)
+	}
+	if step.Bill != "" {
+		transaction.Bill = render("bill", step.Bill)
+	}
+	for _, tagTemplate := range step.Tags {
+		tag := render("tags", tagTemplate)
+		if tag != "" && !slices.Contains(transaction.Tags, tag) {
+			transaction.Tags = append(transaction.Tags, tag)
+		}
+	}
+	return renderErr
+}
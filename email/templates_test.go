@@ -0,0 +1,65 @@
+package email
+
+import (
+	"errors"
+	"firefly-iii-email-scanner/common"
+	"strings"
+	"testing"
+)
+
+func TestProcessEmail_StepFields(t *testing.T) {
+	config := common.EmailProcessingConfig{
+		ProcessingSteps: []common.ProcessingStep{
+			{
+				OptionName:    "Chase",
+				Discriminator: common.Discriminator{Type: "plainTextBodyRegex", Regex: "purchase"},
+				ExtractionSteps: []common.ExtractionStep{
+					{Regex: `A (?P<amount>\S+) purchase at (?P<destinationAccount>.+) with card (?P<cardLast4>\d{4})(?: by (?P<cardholder>.+))?$`},
+					{Regex: `Memo: (?P<description>.+)$`},
+				},
+				Description: "{{.Destination}} ({{.CardLast4}})",
+				Notes:       "Was: {{.Description}}",
+				Category:    "Dining",
+				Tags:        []string{"chase", "{{.Cardholder}}"},
+			},
+		},
+	}
+
+	transaction := processSingleTransaction(t, &ParsedEmail{PlainText: "A $4.50 purchase at Blue Bottle with card 1234 by Jane\nMemo: coffee"}, config)
+	if transaction == nil {
+		t.Fatalf("processEmail returned nil")
+	}
+	if transaction.Description != "Blue Bottle (1234)" {
+		t.Errorf("Expected the templated description, got %q", transaction.Description)
+	}
+	if transaction.Notes != "Was: coffee" {
+		t.Errorf("Expected the notes to see the extracted description, got %q", transaction.Notes)
+	}
+	if transaction.Category != "Dining" {
+		t.Errorf("Expected the static category, got %q", transaction.Category)
+	}
+	if strings.Join(transaction.Tags, ",") != "chase,Jane" {
+		t.Errorf("Expected tags chase,Jane, got %v", transaction.Tags)
+	}
+
+	transaction = processSingleTransaction(t, &ParsedEmail{PlainText: "A $4.50 purchase at Blue Bottle with card 1234\nMemo: coffee"}, config)
+	if strings.Join(transaction.Tags, ",") != "chase" {
+		t.Errorf("Expected an empty tag to be left out, got %v", transaction.Tags)
+	}
+}
+
+func TestProcessEmail_InvalidStepTemplate(t *testing.T) {
+	config := common.EmailProcessingConfig{
+		ProcessingSteps: []common.ProcessingStep{
+			{
+				Discriminator: common.Discriminator{Type: "plainTextBodyRegex", Regex: "purchase"},
+				Description:   "{{.Merchant}}",
+			},
+		},
+	}
+
+	_, err := processEmail(&ParsedEmail{PlainText: "A purchase"}, config)
+	if !errors.Is(err, ErrConfig) {
+		t.Errorf("Expected a template referring to an unknown field to be a configuration error, got %v", err)
+	}
+}
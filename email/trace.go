@@ -0,0 +1,150 @@
+package email
+
+import (
+	"firefly-iii-email-scanner/common"
+	"fmt"
+	"regexp"
+)
+
+// What happened when a configuration was run against an email, for working
+// out why a processing step does or does not extract what was expected.
+type Trace struct {
+	// The processing steps whose discriminators were checked, in order. Only
+	// the last can have matched, as no steps are checked after one matches.
+	Steps []StepTrace
+	// The transactions extracted from the email, as processing it would.
+	Transactions []common.TransactionInfo
+	// Why no transactions were extracted, if none were.
+	Err error
+}
+
+// A processing step whose discriminator was checked against the email.
+type StepTrace struct {
+	// Where the step is in the configuration, e.g. "processing step 2 (Chase)".
+	Name    string
+	Matched bool
+	// Why the discriminator could not be checked, if it could not.
+	Err error
+	// The extraction steps run, if the discriminator matched.
+	Extractions []ExtractionTrace
+}
+
+// An extraction step run against the email.
+type ExtractionTrace struct {
+	// Where the extraction step is in the processing step, e.g. "extraction step 1".
+	Name  string
+	Type  string
+	Regex string
+	// The matches of the regex. Only the first match is used, except for the
+	// repeat step, which uses them all. Empty if the regex was not found.
+	Matches []RegexMatch
+	// Why the regex could not be run, if it could not.
+	Err error
+}
+
+// A match of an extraction step's regex.
+type RegexMatch struct {
+	Text   string
+	Groups []RegexGroup
+}
+
+// A group captured by a match of an extraction step's regex.
+type RegexGroup struct {
+	Number int
+	// The name of the group, if it has one.
+	Name  string
+	Value string
+	// The target fields the group sets.
+	TargetFields []string
+}
+
+// Runs the configuration against the email as processing it would, and
+// records which discriminators matched and what each extraction regex found.
+func TraceEmail(email *ParsedEmail, config common.EmailProcessingConfig) Trace {
+	var trace Trace
+	for i, step := range config.ProcessingSteps {
+		matched, err := matchesDiscriminator(step.Discriminator, email)
+		stepTrace := StepTrace{Name: DescribeStep(i, step), Matched: matched, Err: err}
+		if matched {
+			stepTrace.Extractions = traceProcessingStep(step, email)
+		}
+		trace.Steps = append(trace.Steps, stepTrace)
+		if matched || err != nil {
+			break
+		}
+	}
+
+	trace.Transactions, trace.Err = processEmail(email, config)
+	return trace
+}
+
+func traceProcessingStep(step common.ProcessingStep, email *ParsedEmail) []ExtractionTrace {
+	var traces []ExtractionTrace
+	for i, extractionStep := range step.ExtractionSteps {
+		traces = append(traces, traceExtraction(fmt.Sprintf("extraction step %d", i+1), extractionStep, email, false))
+	}
+
+	if step.Repeat == nil {
+		return traces
+	}
+
+	repeat := traceExtraction("repeat", step.Repeat.ExtractionStep, email, true)
+	traces = append(traces, repeat)
+	for i, match := range repeat.Matches {
+		row := &ParsedEmail{Header: email.Header, PlainText: match.Text, Html: match.Text, Received: email.Received}
+		for j, extractionStep := range step.Repeat.ExtractionSteps {
+			traces = append(traces, traceExtraction(fmt.Sprintf("repeat %d, extraction step %d", i+1, j+1), extractionStep, row, false))
+		}
+	}
+	return traces
+}
+
+// Runs an extraction step's regex against the email, recording its first
+// match, or every match if all is set.
+func traceExtraction(name string, step common.ExtractionStep, email *ParsedEmail, all bool) ExtractionTrace {
+	trace := ExtractionTrace{Name: name, Type: step.Type, Regex: step.Regex}
+	if step.Type == "envelopeDate" {
+		trace.Regex = ""
+		trace.Matches = []RegexMatch{{Text: email.Header.Get("Date")}}
+		return trace
+	}
+
+	texts, err := extractionTexts(step, email)
+	if err != nil {
+		trace.Err = err
+		return trace
+	}
+	re, err := compileExtractionRegex(step)
+	if err != nil {
+		trace.Err = err
+		return trace
+	}
+
+	targetFields := resolveTargetFields(step, re)
+	for _, text := range texts {
+		if all {
+			for _, matches := range re.FindAllStringSubmatch(text, -1) {
+				trace.Matches = append(trace.Matches, newRegexMatch(re, matches, targetFields))
+			}
+		} else if matches := re.FindStringSubmatch(text); matches != nil {
+			trace.Matches = append(trace.Matches, newRegexMatch(re, matches, targetFields))
+			break
+		}
+	}
+	return trace
+}
+
+func newRegexMatch(re *regexp.Regexp, matches []string, targetFields []common.TargetField) RegexMatch {
+	match := RegexMatch{Text: matches[0]}
+	for i := 1; i < len(matches); i++ {
+		group := RegexGroup{Number: i, Name: re.SubexpNames()[i], Value: matches[i]}
+		for _, targetField := range targetFields {
+			if (targetField.GroupName != "" && re.SubexpIndex(targetField.GroupName) == i) ||
+				(targetField.GroupName == "" && targetField.GroupNumber == i) {
+				group.TargetFields = append(group.TargetFields, targetField.TargetField)
+			}
+		}
+		match.Groups = append(match.Groups, group)
+	}
+	return match
+}
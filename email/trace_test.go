@@ -0,0 +1,77 @@
+package email
+
+import (
+	"errors"
+	"firefly-iii-email-scanner/common"
+	"slices"
+	"testing"
+)
+
+func TestTraceEmail(t *testing.T) {
+	config := common.EmailProcessingConfig{
+		ProcessingSteps: []common.ProcessingStep{
+			{
+				OptionName:    "Refund",
+				Discriminator: common.Discriminator{Type: "plainTextBodyRegex", Regex: "refund"},
+			},
+			{
+				OptionName:    "Digest",
+				Discriminator: common.Discriminator{Type: "plainTextBodyRegex", Regex: "Daily"},
+				ExtractionSteps: []common.ExtractionStep{
+					{
+						Regex:        `ending in (\d{4})`,
+						TargetFields: []common.TargetField{{GroupNumber: 1, TargetField: "cardLast4"}},
+					},
+				},
+				Repeat: &common.RepeatingExtraction{
+					ExtractionStep: common.ExtractionStep{Regex: `^(?P<amount>\$\S+) at (?P<destinationAccount>.+)$`},
+				},
+			},
+			{
+				OptionName:    "Never checked",
+				Discriminator: common.Discriminator{Type: "plainTextBodyRegex", Regex: ".*"},
+			},
+		},
+	}
+
+	trace := TraceEmail(&ParsedEmail{PlainText: "Daily activity, card ending in 1234\n$4.50 at Blue Bottle\n$12.00 at Safeway"}, config)
+	if len(trace.Steps) != 2 || trace.Steps[0].Matched || !trace.Steps[1].Matched {
+		t.Fatalf("Expected the second step to be the first that matched, got %+v", trace.Steps)
+	}
+
+	extractions := trace.Steps[1].Extractions
+	if len(extractions) != 2 {
+		t.Fatalf("Expected the extraction step and the repeat step, got %+v", extractions)
+	}
+	card := extractions[0].Matches
+	if len(card) != 1 || card[0].Groups[0].Value != "1234" || !slices.Equal(card[0].Groups[0].TargetFields, []string{"cardLast4"}) {
+		t.Errorf("Expected group 1 to capture the card for cardLast4, got %+v", card)
+	}
+	rows := extractions[1].Matches
+	if len(rows) != 2 || rows[1].Groups[0].Name != "amount" || rows[1].Groups[1].Value != "Safeway" {
+		t.Errorf("Expected both rows with their named groups, got %+v", rows)
+	}
+
+	if trace.Err != nil || len(trace.Transactions) != 2 || trace.Transactions[1].CardLast4 != "1234" {
+		t.Errorf("Expected the transactions processing would extract, got %+v (%v)", trace.Transactions, trace.Err)
+	}
+}
+
+func TestTraceEmail_RegexNotFound(t *testing.T) {
+	config := common.EmailProcessingConfig{
+		ProcessingSteps: []common.ProcessingStep{
+			{
+				Discriminator:   common.Discriminator{Type: "plainTextBodyRegex", Regex: "Charged"},
+				ExtractionSteps: []common.ExtractionStep{{Regex: `(?P<amount>\$\S+) at`}},
+			},
+		},
+	}
+
+	trace := TraceEmail(&ParsedEmail{PlainText: "Charged lots"}, config)
+	if len(trace.Steps) != 1 || len(trace.Steps[0].Extractions) != 1 || len(trace.Steps[0].Extractions[0].Matches) != 0 {
+		t.Errorf("Expected the extraction step to have no matches, got %+v", trace.Steps)
+	}
+	if !errors.Is(trace.Err, ErrRegexNotFound) {
+		t.Errorf("Expected ErrRegexNotFound, got %v", trace.Err)
+	}
+}
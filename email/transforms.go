@@ -0,0 +1,179 @@
+package email
+
+import (
+	"firefly-iii-email-scanner/common"
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// The prefixes payment processors add to the merchant name on card
+// statements, e.g. "SQ *BLUE BOTTLE" for a Square payment.
+var paymentProcessorPrefixes = []string{
+	"SQ *",     // Square
+	"SQ*",      // Square
+	"TST*",     // Toast
+	"TST *",    // Toast
+	"PAYPAL *", // PayPal
+	"PP*",      // PayPal
+	"SP *",     // Shopify
+	"SP*",      // Shopify
+	"DD *",     // DoorDash
+	"IC*",      // Instacart
+	"BT*",      // Braintree
+	"WPY*",     // WePay
+	"EB *",     // Eventbrite
+	"FS *",     // FastSpring
+	"2CO*",     // 2Checkout
+	"CLR*",     // Clover
+	"ZTL*",     // Zettle
+}
+
+// The built-in normalizers for the normalize transform, by name. Each is a
+// chain of other transforms.
+var normalizers = map[string][]common.Transform{
+	// Removes the prefix a payment processor adds to the merchant name.
+	"paymentProcessor": {
+		{Type: "trim"},
+		{Type: "stripPrefixes"},
+	},
+	// Removes a store number and anything after it, such as the location,
+	// e.g. "BLUE BOTTLE COFF 0042 OAKLAND CA" becomes "BLUE BOTTLE COFF".
+	"storeNumber": {
+		{Type: "replace", Regex: `\s+(#\s*)?\d{3,}\b.*$`},
+		{Type: "trim"},
+	},
+	// Removes an order identifier after the merchant name, e.g.
+	// "AMZN Mktp US*2K4AB12C3" becomes "AMZN Mktp US".
+	"orderId": {
+		{Type: "replace", Regex: `\s*\*\s*[A-Z0-9]{6,}$`},
+		{Type: "trim"},
+	},
+	// All of the above, with the result in title case, e.g.
+	// "SQ *BLUE BOTTLE COFF 0042 OAKLAND CA" becomes "Blue Bottle Coff".
+	"merchant": {
+		{Type: "normalize", Name: "paymentProcessor"},
+		{Type: "normalize", Name: "orderId"},
+		{Type: "normalize", Name: "storeNumber"},
+		{Type: "titlecase"},
+	},
+}
+
+// Applies the transforms to an extracted value, in order.
+func applyTransforms(transforms []common.Transform, value string) (string, error) {
+	for _, transform := range transforms {
+		var err error
+		value, err = applyTransform(transform, value)
+		if err != nil {
+			return "", err
+		}
+	}
+	return value, nil
+}
+
+// Applies a single transform to an extracted value.
+//
+// The supported types are:
+//   - trim: removes spaces around the value and collapses runs of spaces within it
+//   - lowercase, uppercase: changes the case of the value
+//   - titlecase: capitalizes the first letter of each word and lowers the rest
+//   - replace: replaces every match of `regex` with `replacement`
+//   - stripPrefixes: removes the first of `prefixes` the value starts with, ignoring case
+//   - truncate: keeps at most `length` characters
+//   - lookup: replaces the value with the entry of `values` whose key is the value, or failing that the longest key the value starts with, ignoring case
+//   - normalize: applies the built-in normalizer named by `name`
+func applyTransform(transform common.Transform, value string) (string, error) {
+	switch transform.Type {
+	case "trim":
+		return strings.Join(strings.Fields(value), " "), nil
+	case "lowercase":
+		return strings.ToLower(value), nil
+	case "uppercase":
+		return strings.ToUpper(value), nil
+	case "titlecase":
+		return titleCase(value), nil
+	case "replace":
+		re, err := regexp.Compile(transform.Regex)
+		if err != nil {
+			return "", fmt.Errorf("replace regex `%s` does not compile: %w", transform.Regex, err)
+		}
+		return re.ReplaceAllString(value, transform.Replacement), nil
+	case "stripPrefixes":
+		prefixes := transform.Prefixes
+		if len(prefixes) == 0 {
+			prefixes = paymentProcessorPrefixes
+		}
+		for _, prefix := range prefixes {
+			if len(value) >= len(prefix) && strings.EqualFold(value[:len(prefix)], prefix) {
+				return strings.TrimSpace(value[len(prefix):]), nil
+			}
+		}
+		return value, nil
+	case "truncate":
+		if transform.Length <= 0 {
+			return "", fmt.Errorf("truncate needs a length greater than 0")
+		}
+		if utf8.RuneCountInString(value) <= transform.Length {
+			return value, nil
+		}
+		return strings.TrimSpace(string([]rune(value)[:transform.Length])), nil
+	case "lookup":
+		return lookup(transform.Values, value), nil
+	case "normalize":
+		chain, ok := normalizers[transform.Name]
+		if !ok {
+			return "", fmt.Errorf("unknown normalizer %q", transform.Name)
+		}
+		return applyTransforms(chain, value)
+	}
+
+	return "", fmt.Errorf("unknown transform type %q", transform.Type)
+}
+
+// Returns the value the lookup table maps the value to, or the value itself
+// if there is none. A key equal to the value is preferred, and otherwise the
+// longest key the value starts with is used, so that "BLUE BOTTLE" maps
+// "BLUE BOTTLE COFF" as well.
+func lookup(values map[string]string, value string) string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	slices.SortFunc(keys, func(a, b string) int {
+		if len(a) != len(b) {
+			return len(b) - len(a)
+		}
+		return strings.Compare(a, b)
+	})
+
+	for _, key := range keys {
+		if strings.EqualFold(key, value) {
+			return values[key]
+		}
+	}
+	for _, key := range keys {
+		if len(value) >= len(key) && strings.EqualFold(value[:len(key)], key) {
+			return values[key]
+		}
+	}
+	return value
+}
+
+// Capitalizes the first letter of each word and lowers the rest, e.g.
+// "BLUE BOTTLE" becomes "Blue Bottle".
+func titleCase(value string) string {
+	var result strings.Builder
+	startOfWord := true
+	for _, r := range value {
+		if startOfWord {
+			result.WriteRune(unicode.ToUpper(r))
+		} else {
+			result.WriteRune(unicode.ToLower(r))
+		}
+		startOfWord = unicode.IsSpace(r)
+	}
+	return result.String()
+}
@@ -0,0 +1,81 @@
+package email
+
+import (
+	"firefly-iii-email-scanner/common"
+	"testing"
+)
+
+func TestApplyTransforms(t *testing.T) {
+	tests := []struct {
+		name       string
+		transforms []common.Transform
+		value      string
+		expected   string
+	}{
+		{"trim", []common.Transform{{Type: "trim"}}, "  BLUE   BOTTLE \n", "BLUE BOTTLE"},
+		{"titlecase", []common.Transform{{Type: "titlecase"}}, "BLUE BOTTLE", "Blue Bottle"},
+		{"replace", []common.Transform{{Type: "replace", Regex: `^(\w+) COFF$`, Replacement: "$1 Coffee"}}, "BLUE COFF", "BLUE Coffee"},
+		{"default prefixes", []common.Transform{{Type: "stripPrefixes"}}, "tst* Taqueria", "Taqueria"},
+		{"custom prefixes", []common.Transform{{Type: "stripPrefixes", Prefixes: []string{"POS "}}}, "POS SAFEWAY", "SAFEWAY"},
+		{"truncate", []common.Transform{{Type: "truncate", Length: 6}}, "Blue Bottle", "Blue B"},
+		{"lookup exact", []common.Transform{{Type: "lookup", Values: map[string]string{"amzn mktp us": "Amazon"}}}, "AMZN Mktp US", "Amazon"},
+		{"lookup prefix", []common.Transform{{Type: "lookup", Values: map[string]string{"BLUE": "Blue", "BLUE BOTTLE": "Blue Bottle Coffee"}}}, "BLUE BOTTLE COFF", "Blue Bottle Coffee"},
+		{"lookup miss", []common.Transform{{Type: "lookup", Values: map[string]string{"BLUE": "Blue"}}}, "SAFEWAY", "SAFEWAY"},
+		{"merchant", []common.Transform{{Type: "normalize", Name: "merchant"}}, "SQ *BLUE BOTTLE COFF 0042 OAKLAND CA", "Blue Bottle Coff"},
+		{"merchant order id", []common.Transform{{Type: "normalize", Name: "merchant"}}, "PAYPAL *AMZN Mktp US*2K4AB12C3", "Amzn Mktp Us"},
+		{
+			"chain",
+			[]common.Transform{{Type: "normalize", Name: "paymentProcessor"}, {Type: "lookup", Values: map[string]string{"BLUE BOTTLE": "Blue Bottle Coffee"}}},
+			"SQ *BLUE BOTTLE COFF",
+			"Blue Bottle Coffee",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			value, err := applyTransforms(test.transforms, test.value)
+			if err != nil {
+				t.Fatalf("applyTransforms returned an error: %v", err)
+			}
+			if value != test.expected {
+				t.Errorf("Expected %q, got %q", test.expected, value)
+			}
+		})
+	}
+}
+
+func TestApplyTransforms_Invalid(t *testing.T) {
+	for _, transform := range []common.Transform{
+		{Type: "reverse"},
+		{Type: "normalize", Name: "unknown"},
+		{Type: "replace", Regex: "("},
+		{Type: "truncate"},
+	} {
+		if _, err := applyTransforms([]common.Transform{transform}, "value"); err == nil {
+			t.Errorf("Expected an error for %+v", transform)
+		}
+	}
+}
+
+func TestProcessEmail_TransformsDestination(t *testing.T) {
+	config := common.EmailProcessingConfig{
+		ProcessingSteps: []common.ProcessingStep{
+			{
+				Discriminator: common.Discriminator{Type: "plainTextBodyRegex", Regex: "Merchant"},
+				ExtractionSteps: []common.ExtractionStep{
+					{
+						Regex: `Merchant: (.+)$`,
+						TargetFields: []common.TargetField{
+							{GroupNumber: 1, TargetField: "destinationAccount", Transforms: []common.Transform{{Type: "normalize", Name: "merchant"}}},
+						},
+					},
+				},
+			},
+		},
+	}
+
+	transaction := processSingleTransaction(t, &ParsedEmail{PlainText: "Merchant: SQ *BLUE BOTTLE COFF 0042 OAKLAND CA"}, config)
+	if transaction == nil || transaction.DestinationName != "Blue Bottle Coff" {
+		t.Errorf("Expected the normalized merchant Blue Bottle Coff, got %+v", transaction)
+	}
+}
@@ -0,0 +1,216 @@
+package email
+
+import (
+	"firefly-iii-email-scanner/common"
+	"fmt"
+	"regexp"
+	"slices"
+	"time"
+)
+
+// The types of discriminator `matchesDiscriminator` supports.
+var discriminatorTypes = []string{"plainTextBodyRegex", "htmlBodyRegex", "subjectRegex", "headerRegex", "recipientRegex", "all", "any", "not"}
+
+// The types of extraction step `extract` supports. No type is the same as
+// plainTextBodyRegex.
+var extractionStepTypes = []string{"", "plainTextBodyRegex", "htmlBodyRegex", "subjectRegex", "headerRegex", "envelopeDate"}
+
+// A time which differs from Go's reference time in every element, so that
+// formatting it with a layout which has no date or time elements returns the
+// layout unchanged.
+var layoutCheckTime = time.Date(2009, time.November, 10, 23, 48, 59, 0, time.UTC)
+
+// Checks an email processing configuration without running it against an
+// email, and returns every problem found: regexes which do not compile,
+// groups which do not exist, unknown types and target fields, invalid time
+// zones, date layouts, locales, transforms and templates, and processing steps
+// with no way to find their source account.
+func ValidateConfig(config common.EmailProcessingConfig) []error {
+	var problems []error
+	if config.FromEmail == "" {
+		problems = append(problems, fmt.Errorf("fromEmail is required"))
+	}
+	for i, step := range config.ProcessingSteps {
+		for _, err := range validateProcessingStep(step) {
+			problems = append(problems, fmt.Errorf("%s: %w", DescribeStep(i, step), err))
+		}
+	}
+	return problems
+}
+
+// Describes where a processing step is in the configuration, e.g.
+// "processing step 2 (Chase)".
+func DescribeStep(i int, step common.ProcessingStep) string {
+	if step.OptionName == "" {
+		return fmt.Sprintf("processing step %d", i+1)
+	}
+	return fmt.Sprintf("processing step %d (%s)", i+1, step.OptionName)
+}
+
+func validateProcessingStep(step common.ProcessingStep) []error {
+	problems := prefixProblems("discriminator", validateDiscriminator(step.Discriminator))
+
+	if step.TransactionType != "" {
+		if _, err := common.ParseTransactionType(step.TransactionType); err != nil {
+			problems = append(problems, fmt.Errorf("transactionType: %w", err))
+		}
+	}
+
+	if step.SourceAccountId == 0 && step.SourceAccountName == "" && !extractsTargetField(step, "accountNumberSuffix") {
+		problems = append(problems, fmt.Errorf("no source account: set sourceAccountId or sourceAccountName, or extract accountNumberSuffix"))
+	}
+
+	for i, extractionStep := range step.ExtractionSteps {
+		problems = append(problems, prefixProblems(fmt.Sprintf("extraction step %d", i+1), validateExtractionStep(extractionStep, false))...)
+	}
+
+	if step.Repeat != nil {
+		problems = append(problems, prefixProblems("repeat", validateExtractionStep(step.Repeat.ExtractionStep, true))...)
+		for i, extractionStep := range step.Repeat.ExtractionSteps {
+			problems = append(problems, prefixProblems(fmt.Sprintf("repeat extraction step %d", i+1), validateExtractionStep(extractionStep, false))...)
+		}
+	}
+
+	type fieldTemplate struct {
+		field string
+		text  string
+	}
+	templates := []fieldTemplate{
+		{"description", step.Description},
+		{"notes", step.Notes},
+		{"category", step.Category},
+		{"budget", step.Budget},
+		{"bill", step.Bill},
+	}
+	for _, tag := range step.Tags {
+		templates = append(templates, fieldTemplate{"tags", tag})
+	}
+	for _, t := range templates {
+		if t.text == "" {
+			continue
+		}
+		// Rendering with empty values finds references to unknown values as
+		// well as templates which do not compile
+		if _, err := renderFieldTemplate(t.field, t.text, templateData{}); err != nil {
+			problems = append(problems, err)
+		}
+	}
+
+	return problems
+}
+
+// Reports whether any of the processing step's extraction steps, including
+// repeated ones, sets the target field, either as a listed target field or as
+// a named group.
+func extractsTargetField(step common.ProcessingStep, name string) bool {
+	extractionSteps := slices.Clone(step.ExtractionSteps)
+	if step.Repeat != nil {
+		extractionSteps = append(extractionSteps, step.Repeat.ExtractionStep)
+		extractionSteps = append(extractionSteps, step.Repeat.ExtractionSteps...)
+	}
+
+	for _, extractionStep := range extractionSteps {
+		targetFields := extractionStep.TargetFields
+		if re, err := regexp.Compile(extractionStep.Regex); err == nil {
+			targetFields = resolveTargetFields(extractionStep, re)
+		}
+		if slices.ContainsFunc(targetFields, func(f common.TargetField) bool { return f.TargetField == name }) {
+			return true
+		}
+	}
+	return false
+}
+
+func validateDiscriminator(d common.Discriminator) []error {
+	if !slices.Contains(discriminatorTypes, d.Type) {
+		return []error{fmt.Errorf("unknown type %q", d.Type)}
+	}
+
+	switch d.Type {
+	case "all", "any", "not":
+		if len(d.Discriminators) == 0 {
+			return []error{fmt.Errorf("%s has no discriminators", d.Type)}
+		}
+		var problems []error
+		for i, child := range d.Discriminators {
+			problems = append(problems, prefixProblems(fmt.Sprintf("%s %d", d.Type, i+1), validateDiscriminator(child))...)
+		}
+		return problems
+	}
+
+	var problems []error
+	if d.Type == "headerRegex" && d.Header == "" {
+		problems = append(problems, fmt.Errorf("header is required for a headerRegex discriminator"))
+	}
+	if _, err := regexp.Compile(d.Regex); err != nil {
+		problems = append(problems, fmt.Errorf("regex `%s` does not compile: %w", d.Regex, err))
+	}
+	return problems
+}
+
+func validateExtractionStep(step common.ExtractionStep, repeated bool) []error {
+	if !slices.Contains(extractionStepTypes, step.Type) {
+		return []error{fmt.Errorf("unknown type %q", step.Type)}
+	}
+	if step.Type == "envelopeDate" {
+		if repeated {
+			return []error{fmt.Errorf("an envelopeDate extraction step cannot be repeated")}
+		}
+		return nil
+	}
+
+	var problems []error
+	if step.Type == "headerRegex" && step.Header == "" {
+		problems = append(problems, fmt.Errorf("header is required for a headerRegex extraction step"))
+	}
+	if _, err := compileExtractionRegex(step); err != nil {
+		problems = append(problems, err)
+	}
+	for _, targetField := range step.TargetFields {
+		problems = append(problems, prefixProblems("target field "+targetField.TargetField, validateTargetField(targetField))...)
+	}
+	return problems
+}
+
+func validateTargetField(targetField common.TargetField) []error {
+	if !isTargetFieldName(targetField.TargetField) {
+		return []error{fmt.Errorf("unknown target field %q", targetField.TargetField)}
+	}
+
+	var problems []error
+	if _, err := applyTransforms(targetField.Transforms, ""); err != nil {
+		problems = append(problems, fmt.Errorf("invalid transforms: %w", err))
+	}
+
+	switch targetField.TargetField {
+	case "amount", "foreignAmount":
+		if _, err := targetField.GetAmountFormat(); err != nil {
+			problems = append(problems, err)
+		}
+	case "transactionDate", "bookDate", "processDate":
+		if targetField.TimeZone == nil || *targetField.TimeZone == "" {
+			problems = append(problems, fmt.Errorf("timeZone is required"))
+		} else if _, err := time.LoadLocation(*targetField.TimeZone); err != nil {
+			problems = append(problems, fmt.Errorf("invalid time zone %q: %w", *targetField.TimeZone, err))
+		}
+		if targetField.Locale != nil && *targetField.Locale != "" {
+			if _, err := common.TranslateDateNames("", *targetField.Locale); err != nil {
+				problems = append(problems, err)
+			}
+		}
+		for _, layout := range dateLayouts(targetField) {
+			if layoutCheckTime.Format(layout) == layout {
+				problems = append(problems, fmt.Errorf("date layout %q has no date elements, which are written as in Go's reference time \"Mon Jan 2 15:04:05 2006\"", layout))
+			}
+		}
+	}
+	return problems
+}
+
+// Prefixes each problem with where in the configuration it was found.
+func prefixProblems(location string, problems []error) []error {
+	for i, err := range problems {
+		problems[i] = fmt.Errorf("%s: %w", location, err)
+	}
+	return problems
+}
@@ -0,0 +1,156 @@
+package email
+
+import (
+	"firefly-iii-email-scanner/common"
+	"strings"
+	"testing"
+)
+
+func TestValidateConfig_Valid(t *testing.T) {
+	timeZone := "America/New_York"
+	format := "Jan 2, 2006"
+	config := common.EmailProcessingConfig{
+		FromEmail: "alerts@example.com",
+		ProcessingSteps: []common.ProcessingStep{
+			{
+				OptionName:      "Card",
+				SourceAccountId: 1,
+				Discriminator: common.Discriminator{Type: "all", Discriminators: []common.Discriminator{
+					{Type: "subjectRegex", Regex: "Purchase"},
+					{Type: "headerRegex", Header: "X-Alert", Regex: "card"},
+				}},
+				ExtractionSteps: []common.ExtractionStep{
+					{Regex: `(?P<amount>\$\S+) at (?P<destinationAccount>.+)$`},
+					{
+						Regex: `on (.+)$`,
+						TargetFields: []common.TargetField{
+							{GroupNumber: 1, TargetField: "transactionDate", Format: &format, TimeZone: &timeZone},
+						},
+					},
+				},
+				Description: "{{.Destination}} ({{.CardLast4}})",
+				Tags:        []string{"{{.Step}}"},
+			},
+		},
+	}
+
+	if problems := ValidateConfig(config); len(problems) != 0 {
+		t.Errorf("Expected no problems, got %v", problems)
+	}
+}
+
+func TestValidateConfig_Problems(t *testing.T) {
+	badZone := "Americas/Denver"
+	badFormat := "MM/DD/YYYY"
+	badLocale := "xx-XX"
+	config := common.EmailProcessingConfig{
+		ProcessingSteps: []common.ProcessingStep{
+			{
+				OptionName: "Card",
+				Discriminator: common.Discriminator{Type: "any", Discriminators: []common.Discriminator{
+					{Type: "subjectRegex", Regex: "("},
+					{Type: "bodyRegex"},
+				}},
+				TransactionType: "spend",
+				ExtractionSteps: []common.ExtractionStep{
+					{
+						Regex: `Charged (\S+)`,
+						TargetFields: []common.TargetField{
+							{GroupNumber: 2, TargetField: "amount"},
+							{GroupNumber: 1, TargetField: "merchant"},
+						},
+					},
+					{
+						Regex: `on (.+)$`,
+						TargetFields: []common.TargetField{
+							{GroupNumber: 1, TargetField: "transactionDate", Format: &badFormat, TimeZone: &badZone, Locale: &badLocale},
+							{GroupNumber: 1, TargetField: "bookDate"},
+							{GroupNumber: 1, TargetField: "description", Transforms: []common.Transform{{Type: "reverse"}}},
+						},
+					},
+					{Type: "footerRegex"},
+				},
+				Repeat:   &common.RepeatingExtraction{ExtractionStep: common.ExtractionStep{Type: "envelopeDate"}},
+				Category: "{{.Merchant}}",
+			},
+		},
+	}
+
+	expected := []string{
+		"fromEmail is required",
+		"processing step 1 (Card): discriminator: any 1: regex `(` does not compile",
+		`processing step 1 (Card): discriminator: any 2: unknown type "bodyRegex"`,
+		"processing step 1 (Card): transactionType:",
+		"processing step 1 (Card): no source account",
+		"processing step 1 (Card): extraction step 1: regex `Charged (\\S+)` has no group 2 for target field amount",
+		`processing step 1 (Card): extraction step 1: target field merchant: unknown target field "merchant"`,
+		`processing step 1 (Card): extraction step 2: target field transactionDate: invalid time zone "Americas/Denver"`,
+		"processing step 1 (Card): extraction step 2: target field transactionDate: no month and weekday names are known",
+		`processing step 1 (Card): extraction step 2: target field transactionDate: date layout "MM/DD/YYYY" has no date elements`,
+		"processing step 1 (Card): extraction step 2: target field bookDate: timeZone is required",
+		"processing step 1 (Card): extraction step 2: target field description: invalid transforms",
+		`processing step 1 (Card): extraction step 3: unknown type "footerRegex"`,
+		"processing step 1 (Card): repeat: an envelopeDate extraction step cannot be repeated",
+		"processing step 1 (Card): template for category failed",
+	}
+
+	problems := ValidateConfig(config)
+	if len(problems) != len(expected) {
+		t.Errorf("Expected %d problems, got %d: %v", len(expected), len(problems), problems)
+	}
+	for i := 0; i < min(len(problems), len(expected)); i++ {
+		if !strings.HasPrefix(problems[i].Error(), expected[i]) {
+			t.Errorf("Expected problem %d to start with %q, got %q", i+1, expected[i], problems[i])
+		}
+	}
+}
+
+func TestValidateConfig_SourceAccount(t *testing.T) {
+	tests := []struct {
+		name  string
+		step  common.ProcessingStep
+		valid bool
+	}{
+		{"none", common.ProcessingStep{ExtractionSteps: []common.ExtractionStep{{Regex: `(?P<amount>\$\S+)`}}}, false},
+		{"sourceAccountId", common.ProcessingStep{SourceAccountId: 3}, true},
+		{"sourceAccountName", common.ProcessingStep{SourceAccountName: "Checking"}, true},
+		{"target field", common.ProcessingStep{ExtractionSteps: []common.ExtractionStep{
+			{Regex: `ending in (\d{4})`, TargetFields: []common.TargetField{{GroupNumber: 1, TargetField: "accountNumberSuffix"}}},
+		}}, true},
+		{"named group", common.ProcessingStep{ExtractionSteps: []common.ExtractionStep{{Regex: `ending in (?P<accountNumberSuffix>\d{4})`}}}, true},
+		{"repeated named group", common.ProcessingStep{Repeat: &common.RepeatingExtraction{
+			ExtractionStep: common.ExtractionStep{Regex: `(?P<accountNumberSuffix>\d{4}): (?P<amount>\$\S+)`},
+		}}, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test.step.Discriminator = common.Discriminator{Type: "subjectRegex", Regex: "Alert"}
+			config := common.EmailProcessingConfig{FromEmail: "alerts@example.com", ProcessingSteps: []common.ProcessingStep{test.step}}
+			problems := ValidateConfig(config)
+			if test.valid && len(problems) != 0 {
+				t.Errorf("Expected no problems, got %v", problems)
+			}
+			if !test.valid && (len(problems) != 1 || !strings.Contains(problems[0].Error(), "no source account")) {
+				t.Errorf("Expected a problem with the source account, got %v", problems)
+			}
+		})
+	}
+}
+
+func TestValidateConfig_Presets(t *testing.T) {
+	for _, name := range common.PresetNames() {
+		t.Run(name, func(t *testing.T) {
+			config := common.EmailProcessingConfig{
+				FromEmail:       "alerts@example.com",
+				ProcessingSteps: []common.ProcessingStep{{Preset: name, SourceAccountId: 1}},
+			}
+			if err := config.ApplyPresets(); err != nil {
+				t.Fatal(err)
+			}
+			if problems := ValidateConfig(config); len(problems) != 0 {
+				t.Errorf("Expected no problems, got %v", problems)
+			}
+		})
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"firefly-iii-email-scanner/common"
 	"firefly-iii-email-scanner/util"
 	"fmt"
+	"log"
 	"net/http"
 	"os"
 	"regexp"
@@ -132,7 +133,8 @@ func getRecentTransactions() ([]TransactionRead, error) {
 
 // Retrieves all (relevant) accounts from Firefly.
 //
-// It excludes inactive, revenue, reconciliation and initial balance type accounts.
+// It excludes inactive, reconciliation and initial balance type accounts. Revenue
+// accounts are included so that the payers of deposits can be matched.
 func getAllAccounts() ([]AccountRead, error) {
 	var allAccounts []AccountRead
 	var page int32 = 1
@@ -158,7 +160,6 @@ func getAllAccounts() ([]AccountRead, error) {
 		for _, account := range resp.ApplicationvndApiJSON200.Data {
 			if (account.Attributes.Active == nil || *account.Attributes.Active) &&
 				account.Attributes.Type != "initial-balance" &&
-				account.Attributes.Type != "revenue" &&
 				account.Attributes.Type != "reconciliation" {
 				allAccounts = append(allAccounts, account)
 			}
@@ -231,8 +232,20 @@ func cleanString(s string) string {
 	return re.ReplaceAllString(s, "")
 }
 
-// Attempts to find an account that matches the given name
-func getMatchingAccount(name string) *AccountRead {
+// Reports whether the account can be the other party of a transaction of the
+// given type. Deposits come from revenue accounts, or from another asset
+// account in the case of a transfer. Everything else goes to any account
+// other than a revenue account.
+func isCounterpartyAccount(account AccountRead, transactionType common.TransactionType) bool {
+	if transactionType == common.Deposit {
+		return account.Attributes.Type == ShortAccountTypePropertyRevenue || account.Attributes.Type == ShortAccountTypePropertyAsset
+	}
+	return account.Attributes.Type != ShortAccountTypePropertyRevenue
+}
+
+// Attempts to find an account that matches the given name and can be the
+// other party of a transaction of the given type.
+func GetMatchingAccount(name string, transactionType common.TransactionType) *AccountRead {
 	const threshold = 3 // Adjust this threshold as needed
 	var bestMatch *AccountRead
 	var bestDistance = threshold + 1
@@ -243,6 +256,9 @@ func getMatchingAccount(name string) *AccountRead {
 	cleanName := cleanString(name)
 
 	for _, account := range accounts {
+		if !isCounterpartyAccount(account, transactionType) {
+			continue
+		}
 		cleanAccountName := cleanAccountNames[account.Id]
 
 		lcs := longestCommonSubstring(cleanName, cleanAccountName)
@@ -269,6 +285,113 @@ func getMatchingAccount(name string) *AccountRead {
 	return nil
 }
 
+// Reports whether money can be held in or owed on the account, so that it
+// can be the configured account of a transaction.
+func isOwnAccount(account AccountRead) bool {
+	switch account.Attributes.Type {
+	case ShortAccountTypePropertyAsset, ShortAccountTypePropertyLiability, ShortAccountTypePropertyLiabilities:
+		return true
+	}
+	return false
+}
+
+// Returns the ID of the asset or liability account with the given name,
+// ignoring case.
+func getOwnAccountByName(name string) (int, error) {
+	for _, account := range accounts {
+		if isOwnAccount(account) && strings.EqualFold(strings.TrimSpace(account.Attributes.Name), strings.TrimSpace(name)) {
+			return strconv.Atoi(account.Id)
+		}
+	}
+	return 0, fmt.Errorf("no asset or liability account is named %q", name)
+}
+
+// Returns an error unless there is an account with the ID and it is an asset
+// or liability account, so that it can be configured as the account
+// transactions are about.
+func CheckOwnAccount(id int) error {
+	for _, account := range accounts {
+		if account.Id != strconv.Itoa(id) {
+			continue
+		}
+		if !isOwnAccount(account) {
+			return fmt.Errorf("account %d (%s) is a %s account, not an asset or liability account", id, account.Attributes.Name, account.Attributes.Type)
+		}
+		return nil
+	}
+	return fmt.Errorf("there is no account with ID %d", id)
+}
+
+// Returns an error unless there is an asset or liability account with the
+// name, ignoring case.
+func CheckOwnAccountName(name string) error {
+	_, err := getOwnAccountByName(name)
+	return err
+}
+
+// Returns the ID of the asset or liability account whose account number or
+// IBAN ends with the given digits, or 0 if there is none. It is an error for
+// more than one account to match.
+func getOwnAccountByNumberSuffix(suffix string) (int, error) {
+	var matches []AccountRead
+	for _, account := range accounts {
+		if !isOwnAccount(account) {
+			continue
+		}
+		for _, number := range []*string{account.Attributes.AccountNumber, account.Attributes.Iban} {
+			if number != nil && strings.HasSuffix(cleanString(*number), suffix) {
+				matches = append(matches, account)
+				break
+			}
+		}
+	}
+
+	switch len(matches) {
+	case 0:
+		return 0, nil
+	case 1:
+		return strconv.Atoi(matches[0].Id)
+	}
+
+	names := make([]string, len(matches))
+	for i, account := range matches {
+		names[i] = account.Attributes.Name
+	}
+	return 0, fmt.Errorf("the account number ending in %s is ambiguous, as it matches the accounts %s", suffix, strings.Join(names, ", "))
+}
+
+// Returns the ID of the Firefly account the transaction is about.
+//
+// An account number suffix extracted from the email takes precedence, and is
+// looked up in the configured account numbers and then in the account number
+// and IBAN of each asset and liability account. If it is not found there, or
+// there is none, the account configured on the processing step is used,
+// by name if it has one.
+func ResolveSourceAccount(t common.TransactionInfo, accountNumbers map[string]string) (int, error) {
+	if t.AccountNumberSuffix != "" {
+		if reference, ok := accountNumbers[t.AccountNumberSuffix]; ok {
+			if id, err := strconv.Atoi(reference); err == nil {
+				return id, nil
+			}
+			return getOwnAccountByName(reference)
+		}
+
+		id, err := getOwnAccountByNumberSuffix(t.AccountNumberSuffix)
+		if err != nil || id != 0 {
+			return id, err
+		}
+		log.Printf("No account has a number ending in %s, so the configured account is used", t.AccountNumberSuffix)
+	}
+
+	if t.SourceAccountName != "" {
+		return getOwnAccountByName(t.SourceAccountName)
+	}
+	if t.SourceAccountId == 0 {
+		return 0, fmt.Errorf("no account is configured for processing step %s and none was found in the email", t.ProcessingStep)
+	}
+	return t.SourceAccountId, nil
+}
+
 // Returns the smaller of two integers
 func min(a, b int) int {
 	if a < b {
@@ -277,67 +400,145 @@ func min(a, b int) int {
 	return b
 }
 
+// Returns the transaction info with a negative amount, such as "-$4.50" or
+// "(4.50)", treated as a deposit if its type is not known, as that is how
+// banks write credits and refunds. Amounts are sent to Firefly without their
+// sign, so the direction is carried by the type.
+func WithSignedType(t common.TransactionInfo) common.TransactionInfo {
+	if t.Type == common.Unspecified && t.Amount.IsNegative() {
+		t.Type = common.Deposit
+	}
+	return t
+}
+
 // Attempts to find an existing Firefly transaction that matches the given transaction info.
 // If none is found, nil is returned.
 func GetExistingTransaction(t common.TransactionInfo) *TransactionRead {
+	t = WithSignedType(t)
 	for _, or := range recentTransactions {
 		o := or.Attributes
-		parsedAmount, err := common.ParseMoney(o.Transactions[0].Amount)
+		parsedAmount, err := common.ParseAmount(o.Transactions[0].Amount, common.DefaultAmountFormat)
 		if err != nil {
 			continue
 		}
+		if o.Transactions[0].CurrencyCode != nil {
+			parsedAmount.Currency = *o.Transactions[0].CurrencyCode
+		}
 
 		if util.CloseDay(o.Transactions[0].Date, t.TransactionDate, 3, 3) &&
-			parsedAmount == fmt.Sprintf("%d.%02d", t.Amount.Dollars, t.Amount.Cents) {
+			sameDirection(o.Transactions[0], t) &&
+			(parsedAmount.Equal(t.Amount.Abs()) || sameForeignAmount(o.Transactions[0], t)) {
 			return &or
 		}
 	}
 	return nil
 }
 
+// Reports whether money moves the same way in the existing transaction as in
+// the transaction info. A refund has the same amount as the purchase it
+// refunds, so a deposit only matches deposits. Transaction info without a
+// known type never matches a deposit, as it is a withdrawal or transfer.
+func sameDirection(existing TransactionSplit, t common.TransactionInfo) bool {
+	return (t.Type == common.Deposit) == (existing.Type == Deposit)
+}
+
+// Reports whether the existing transaction has the same foreign amount as the
+// transaction info. The foreign amount is what was actually charged, so it
+// identifies a purchase even when the converted amount in the email differs
+// from what was recorded in Firefly, e.g. because the exchange rate changed
+// before the transaction settled.
+func sameForeignAmount(existing TransactionSplit, t common.TransactionInfo) bool {
+	if t.ForeignAmount == nil || t.ForeignAmount.IsZero() || existing.ForeignAmount == nil {
+		return false
+	}
+
+	foreignAmount, err := common.ParseAmount(*existing.ForeignAmount, common.DefaultAmountFormat)
+	if err != nil {
+		return false
+	}
+	if existing.ForeignCurrencyCode != nil {
+		foreignAmount.Currency = *existing.ForeignCurrencyCode
+	}
+
+	return foreignAmount.Equal(t.ForeignAmount.Abs())
+}
+
 // Creates a transaction in Firefly according to the information provided.
 func CreateTransaction(transaction common.TransactionInfo, dryRun bool) (int, *string, error) {
 	noName := noNameName
+	transaction = WithSignedType(transaction)
 
 	// Set up the context with a timeout
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
-	sourceId := strconv.Itoa(transaction.SourceAccountId)
-	matchingDestinationAccount := getMatchingAccount(transaction.DestinationName)
+	accountId := strconv.Itoa(transaction.SourceAccountId)
+	matchingAccount := GetMatchingAccount(transaction.DestinationName, transaction.Type)
 	var matchingAccountName *string
 
 	var order int32 = 0
 	body := StoreTransactionJSONRequestBody{
 		Transactions: []TransactionSplitStore{
 			{
-				Date:            transaction.TransactionDate,
-				Amount:          transaction.Amount.String(),
-				Description:     fmt.Sprintf("Uncategorized transaction to %s", transaction.DestinationName),
-				SourceId:        &sourceId,
-				Order:           &order,
-				DestinationId:   nil,
-				DestinationName: nil,
+				Date:   transaction.TransactionDate,
+				Amount: transaction.Amount.Abs().String(),
+				Order:  &order,
 			},
 		},
 	}
+	split := &body.Transactions[0]
+
+	if transaction.Amount.Currency != "" {
+		split.CurrencyCode = &transaction.Amount.Currency
+	}
 
-	// Determine the transaction type based on the matching account
-	if matchingDestinationAccount == nil {
-		body.Transactions[0].DestinationName = &noName
+	if transaction.ForeignAmount != nil && !transaction.ForeignAmount.IsZero() {
+		if transaction.ForeignAmount.Currency == "" {
+			log.Printf("Not sending the foreign amount %s to Firefly because its currency is unknown", transaction.ForeignAmount.String())
+		} else {
+			foreignAmount := transaction.ForeignAmount.Abs().String()
+			split.ForeignAmount = &foreignAmount
+			split.ForeignCurrencyCode = &transaction.ForeignAmount.Currency
+		}
+	}
+
+	if matchingAccount == nil {
 		matchingAccountName = &noName
-		body.Transactions[0].Type = Withdrawal
 	} else {
-		body.Transactions[0].DestinationId = &matchingDestinationAccount.Id
-		matchingAccountName = &matchingDestinationAccount.Attributes.Name
+		matchingAccountName = &matchingAccount.Attributes.Name
+	}
 
-		if matchingDestinationAccount.Attributes.Type == "asset" {
-			body.Transactions[0].Type = Transfer
+	// Money moving between two asset accounts is always a transfer. Otherwise
+	// the type is the one the email or configuration gave, or a withdrawal.
+	if matchingAccount != nil && matchingAccount.Attributes.Type == ShortAccountTypePropertyAsset {
+		split.Type = Transfer
+	} else if transaction.Type != common.Unspecified {
+		split.Type = toFireflyType(transaction.Type)
+	} else {
+		split.Type = Withdrawal
+	}
+
+	// The configured account receives deposits and pays for everything else
+	if transaction.Type == common.Deposit {
+		split.Description = fmt.Sprintf("Uncategorized transaction from %s", transaction.DestinationName)
+		split.DestinationId = &accountId
+		if matchingAccount == nil {
+			split.SourceName = &noName
+		} else {
+			split.SourceId = &matchingAccount.Id
+		}
+	} else {
+		split.Description = fmt.Sprintf("Uncategorized transaction to %s", transaction.DestinationName)
+		split.SourceId = &accountId
+		if matchingAccount == nil {
+			split.DestinationName = &noName
 		} else {
-			body.Transactions[0].Type = Withdrawal
+			split.DestinationId = &matchingAccount.Id
 		}
 	}
 
+	setMetadata(split, transaction)
+
 	if dryRun {
 		return 0, matchingAccountName, nil
 	}
@@ -367,6 +568,48 @@ func CreateTransaction(transaction common.TransactionInfo, dryRun bool) (int, *s
 	return transactionID, matchingAccountName, nil
 }
 
+// Copies the optional details extracted from the email onto the split. The
+// card and cardholder have no Firefly field of their own, so they are added
+// to the notes.
+func setMetadata(split *TransactionSplitStore, transaction common.TransactionInfo) {
+	if transaction.Description != "" {
+		split.Description = transaction.Description
+	}
+
+	var notes []string
+	if transaction.Notes != "" {
+		notes = append(notes, transaction.Notes)
+	}
+	if transaction.CardLast4 != "" {
+		notes = append(notes, fmt.Sprintf("Card: ending in %s", transaction.CardLast4))
+	}
+	if transaction.Cardholder != "" {
+		notes = append(notes, fmt.Sprintf("Cardholder: %s", transaction.Cardholder))
+	}
+	if len(notes) > 0 {
+		joined := strings.Join(notes, "\n")
+		split.Notes = &joined
+	}
+
+	if transaction.Category != "" {
+		split.CategoryName = &transaction.Category
+	}
+	if transaction.Budget != "" {
+		split.BudgetName = &transaction.Budget
+	}
+	if transaction.Bill != "" {
+		split.BillName = &transaction.Bill
+	}
+	if len(transaction.Tags) > 0 {
+		split.Tags = &transaction.Tags
+	}
+	if transaction.Reference != "" {
+		split.ExternalId = &transaction.Reference
+	}
+	split.BookDate = transaction.BookDate
+	split.ProcessDate = transaction.ProcessDate
+}
+
 func toFireflyType(t common.TransactionType) TransactionTypeProperty {
 	switch t {
 	case common.Transfer:
@@ -0,0 +1,233 @@
+package firefly
+
+import (
+	"firefly-iii-email-scanner/common"
+	"testing"
+	"time"
+)
+
+func newTestTransaction(id string, amount string, foreignAmount *string, foreignCurrency *string, date time.Time) TransactionRead {
+	usd := "USD"
+	return TransactionRead{
+		Id: id,
+		Attributes: Transaction{
+			Transactions: []TransactionSplit{
+				{
+					Amount:              amount,
+					CurrencyCode:        &usd,
+					ForeignAmount:       foreignAmount,
+					ForeignCurrencyCode: foreignCurrency,
+					Date:                date,
+				},
+			},
+		},
+	}
+}
+
+func TestGetExistingTransaction_MatchesForeignAmount(t *testing.T) {
+	date := time.Date(2024, 3, 15, 0, 0, 0, 0, time.UTC)
+	foreignAmount := "45.000000000000"
+	eur := "EUR"
+
+	recentTransactions = []TransactionRead{
+		newTestTransaction("1", "10.000000000000", nil, nil, date),
+		newTestTransaction("2", "48.500000000000", &foreignAmount, &eur, date),
+	}
+	defer func() { recentTransactions = nil }()
+
+	// The converted amount differs from what was recorded, but the foreign amount is the same.
+	info := common.TransactionInfo{
+		Amount:          common.NewMoney(4891, 2, "USD"),
+		ForeignAmount:   &common.Money{Units: 4500, Scale: 2, Currency: "EUR"},
+		TransactionDate: date.AddDate(0, 0, 1),
+	}
+	match := GetExistingTransaction(info)
+	if match == nil || match.Id != "2" {
+		t.Fatalf("Expected transaction 2 to match on its foreign amount, got %+v", match)
+	}
+
+	info.ForeignAmount.Currency = "GBP"
+	if match := GetExistingTransaction(info); match != nil {
+		t.Errorf("Expected no match for a foreign amount in a different currency, got %s", match.Id)
+	}
+
+	info = common.TransactionInfo{
+		Amount:          common.NewMoney(10, 0, ""),
+		TransactionDate: date,
+	}
+	match = GetExistingTransaction(info)
+	if match == nil || match.Id != "1" {
+		t.Errorf("Expected transaction 1 to match on its amount, got %+v", match)
+	}
+}
+
+func TestGetExistingTransaction_RefundDoesNotMatchPurchase(t *testing.T) {
+	date := time.Date(2024, 3, 15, 0, 0, 0, 0, time.UTC)
+	purchase := newTestTransaction("1", "12.000000000000", nil, nil, date)
+	purchase.Attributes.Transactions[0].Type = Withdrawal
+	recentTransactions = []TransactionRead{purchase}
+	defer func() { recentTransactions = nil }()
+
+	refund := common.TransactionInfo{
+		Amount:          common.NewMoney(1200, 2, "USD"),
+		TransactionDate: date,
+		Type:            common.Deposit,
+	}
+	if match := GetExistingTransaction(refund); match != nil {
+		t.Errorf("Expected a refund not to match the purchase, got %s", match.Id)
+	}
+
+	refund.Type = common.Unspecified
+	if match := GetExistingTransaction(refund); match == nil {
+		t.Errorf("Expected a transaction of unknown type to match the purchase")
+	}
+}
+
+func TestGetExistingTransaction_NegativeAmountIsDeposit(t *testing.T) {
+	date := time.Date(2024, 3, 15, 0, 0, 0, 0, time.UTC)
+	purchase := newTestTransaction("1", "4.500000000000", nil, nil, date)
+	purchase.Attributes.Transactions[0].Type = Withdrawal
+	refund := newTestTransaction("2", "4.500000000000", nil, nil, date)
+	refund.Attributes.Transactions[0].Type = Deposit
+	recentTransactions = []TransactionRead{purchase, refund}
+	defer func() { recentTransactions = nil }()
+
+	credit := common.TransactionInfo{
+		Amount:          common.NewMoney(-450, 2, "USD"),
+		TransactionDate: date,
+	}
+	if match := GetExistingTransaction(credit); match == nil || match.Id != "2" {
+		t.Errorf("Expected a negative amount of unknown type to match the deposit, got %+v", match)
+	}
+
+	if resolved := WithSignedType(credit); resolved.Type != common.Deposit {
+		t.Errorf("Expected a negative amount of unknown type to be a deposit, got %s", resolved.Type)
+	}
+	credit.Type = common.Withdrawal
+	if resolved := WithSignedType(credit); resolved.Type != common.Withdrawal {
+		t.Errorf("Expected a configured type to be kept, got %s", resolved.Type)
+	}
+}
+
+func TestGetMatchingAccount_DepositsComeFromRevenueAccounts(t *testing.T) {
+	accounts = []AccountRead{
+		{Id: "1", Attributes: Account{Name: "Acme Payroll", Type: ShortAccountTypePropertyExpense}},
+		{Id: "2", Attributes: Account{Name: "Acme Payroll", Type: ShortAccountTypePropertyRevenue}},
+	}
+	cleanAccountNames = map[string]string{"1": "AcmePayroll", "2": "AcmePayroll"}
+	defer func() { accounts, cleanAccountNames = nil, nil }()
+
+	if account := GetMatchingAccount("ACME PAYROLL", common.Deposit); account == nil || account.Id != "2" {
+		t.Errorf("Expected the revenue account for a deposit, got %+v", account)
+	}
+	if account := GetMatchingAccount("ACME PAYROLL", common.Withdrawal); account == nil || account.Id != "1" {
+		t.Errorf("Expected the expense account for a withdrawal, got %+v", account)
+	}
+}
+
+func TestSetMetadata(t *testing.T) {
+	split := TransactionSplitStore{Description: "Uncategorized transaction to Blue Bottle"}
+	setMetadata(&split, common.TransactionInfo{
+		Description: "Coffee",
+		Notes:       "Morning",
+		CardLast4:   "1234",
+		Cardholder:  "Jane Doe",
+		Category:    "Dining",
+		Tags:        []string{"coffee"},
+		Reference:   "A1B2C3",
+	})
+
+	if split.Description != "Coffee" {
+		t.Errorf("Expected the extracted description, got %q", split.Description)
+	}
+	if split.Notes == nil || *split.Notes != "Morning\nCard: ending in 1234\nCardholder: Jane Doe" {
+		t.Errorf("Unexpected notes %v", split.Notes)
+	}
+	if split.CategoryName == nil || *split.CategoryName != "Dining" {
+		t.Errorf("Expected category Dining, got %v", split.CategoryName)
+	}
+	if split.Tags == nil || len(*split.Tags) != 1 {
+		t.Errorf("Expected one tag, got %v", split.Tags)
+	}
+	if split.ExternalId == nil || *split.ExternalId != "A1B2C3" {
+		t.Errorf("Expected external ID A1B2C3, got %v", split.ExternalId)
+	}
+	if split.BudgetName != nil || split.BillName != nil {
+		t.Errorf("Expected no budget or bill")
+	}
+}
+
+func TestResolveSourceAccount(t *testing.T) {
+	checkingNumber := "000123451234"
+	iban := "DE89 3704 0044 0532 0130 00"
+	loanNumber := "43000"
+	accounts = []AccountRead{
+		{Id: "3", Attributes: Account{Name: "Checking", Type: ShortAccountTypePropertyAsset, AccountNumber: &checkingNumber}},
+		{Id: "4", Attributes: Account{Name: "Girokonto", Type: ShortAccountTypePropertyAsset, Iban: &iban}},
+		{Id: "5", Attributes: Account{Name: "Visa", Type: ShortAccountTypePropertyLiability}},
+		{Id: "6", Attributes: Account{Name: "Visa", Type: ShortAccountTypePropertyExpense}},
+		{Id: "7", Attributes: Account{Name: "Loan", Type: ShortAccountTypePropertyLiabilities, AccountNumber: &loanNumber}},
+	}
+	defer func() { accounts = nil }()
+
+	accountNumbers := map[string]string{"9999": "visa", "8888": "12"}
+	tests := []struct {
+		name     string
+		info     common.TransactionInfo
+		expected int
+	}{
+		{"account number", common.TransactionInfo{AccountNumberSuffix: "1234", SourceAccountId: 1}, 3},
+		{"iban", common.TransactionInfo{AccountNumberSuffix: "013000"}, 4},
+		{"configured name", common.TransactionInfo{AccountNumberSuffix: "9999"}, 5},
+		{"configured id", common.TransactionInfo{AccountNumberSuffix: "8888"}, 12},
+		{"unknown suffix", common.TransactionInfo{AccountNumberSuffix: "7777", SourceAccountId: 1}, 1},
+		{"step name", common.TransactionInfo{SourceAccountName: "Checking"}, 3},
+		{"step id", common.TransactionInfo{SourceAccountId: 1}, 1},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			id, err := ResolveSourceAccount(test.info, accountNumbers)
+			if err != nil {
+				t.Fatalf("ResolveSourceAccount returned an error: %v", err)
+			}
+			if id != test.expected {
+				t.Errorf("Expected account %d, got %d", test.expected, id)
+			}
+		})
+	}
+
+	if _, err := ResolveSourceAccount(common.TransactionInfo{SourceAccountName: "Savings"}, nil); err == nil {
+		t.Errorf("Expected an error for an unknown account name")
+	}
+	if _, err := ResolveSourceAccount(common.TransactionInfo{AccountNumberSuffix: "3000"}, nil); err == nil {
+		t.Errorf("Expected an error for a suffix matching several accounts")
+	}
+}
+
+func TestCheckOwnAccount(t *testing.T) {
+	accounts = []AccountRead{
+		{Id: "3", Attributes: Account{Name: "Checking", Type: ShortAccountTypePropertyAsset}},
+		{Id: "5", Attributes: Account{Name: "Visa", Type: ShortAccountTypePropertyLiability}},
+		{Id: "6", Attributes: Account{Name: "Blue Bottle", Type: ShortAccountTypePropertyExpense}},
+	}
+	defer func() { accounts = nil }()
+
+	for _, id := range []int{3, 5} {
+		if err := CheckOwnAccount(id); err != nil {
+			t.Errorf("Expected account %d to be accepted, got %v", id, err)
+		}
+	}
+	for _, id := range []int{6, 9} {
+		if err := CheckOwnAccount(id); err == nil {
+			t.Errorf("Expected account %d to be rejected", id)
+		}
+	}
+
+	if err := CheckOwnAccountName("checking"); err != nil {
+		t.Errorf("Expected the name to be found ignoring case, got %v", err)
+	}
+	if err := CheckOwnAccountName("Blue Bottle"); err == nil {
+		t.Errorf("Expected an expense account's name to be rejected")
+	}
+}
@@ -1,17 +1,40 @@
 package main
 
 import (
+	"errors"
+	"firefly-iii-email-scanner/archive"
 	"firefly-iii-email-scanner/common"
 	"firefly-iii-email-scanner/email"
 	"firefly-iii-email-scanner/firefly"
 	"firefly-iii-email-scanner/mattermost"
+	"firefly-iii-email-scanner/state"
 	"flag"
 	"fmt"
 	"log"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 )
 
+// Subcommands, run as `firefly-iii-email-scanner <command> [flags]`. Without
+// a command, the scanner processes new emails.
+var commands = map[string]func(args []string){
+	"anonymize":       runAnonymize,
+	"replay":          runReplay,
+	"suggest-rule":    runSuggestRule,
+	"test-rule":       runTestRule,
+	"validate-config": runValidateConfig,
+}
+
 func main() {
+	if len(os.Args) > 1 {
+		if command, ok := commands[os.Args[1]]; ok {
+			command(os.Args[2:])
+			return
+		}
+	}
+
 	// Parse command line flags
 	dryRunFlag := flag.Bool("dry-run", false, "Run in dry-run mode: skip Firefly write operations and prefix notifier messages with 'Test'")
 	flag.Parse()
@@ -45,99 +68,251 @@ func main() {
 		notifier = &NoOpNotifier{}
 	}
 
-	transactions := email.GetTransactions(config.ProcessEmails)
+	var source email.Source
+	if config.Source == nil || *config.Source == "imap" {
+		source, err = email.NewImapSource()
+	} else if *config.Source == "graph" {
+		source, err = email.NewGraphSource(config.Graph)
+	} else if *config.Source == "jmap" {
+		source, err = email.NewJmapSource(config.Jmap)
+	} else if *config.Source == "pop3" {
+		source, err = email.NewPop3Source(config.Pop3)
+	} else {
+		log.Fatalf("Unknown source type: %s. Please choose one of: [imap|graph|jmap|pop3] or leave blank for imap", *config.Source)
+	}
+	if err != nil {
+		log.Fatalf("Failed to initialize mail source: %v", err)
+	}
+	defer source.Close()
+
+	emailArchive, err := archive.Open(config.GetArchiveDir())
+	if err != nil {
+		log.Fatalf("Failed to open email archive: %v", err)
+	}
+	source = email.WithArchive(source, emailArchive)
+
+	store, err := state.Open(config.GetStateFile())
+	if err != nil {
+		log.Fatalf("Failed to open state store: %v", err)
+	}
+	defer store.Close()
+
+	// Records the outcome for an email so that it is never processed twice.
+	saveRecord := func(t common.EmailTransactionInfo, outcome state.Outcome, transactionId string) {
+		if dryRun {
+			return
+		}
+		record := state.Record{
+			MessageId:     t.MailId,
+			ContentHash:   t.ContentHash,
+			Outcome:       outcome,
+			TransactionId: transactionId,
+		}
+		if err := store.Put(record); err != nil {
+			log.Fatalf("Failed to record outcome for email %s: %v", t.MailId, err)
+		}
+	}
+
+	transactions, err := email.GetTransactions(source, config.ProcessEmails)
+	if err != nil {
+		log.Fatalf("Failed to get transactions: %v", err)
+	}
 	for _, t := range transactions {
-		if t.Info != nil {
-			info := *t.Info
-			foundMatch := firefly.GetExistingTransaction(info)
+		previous, err := store.Get(t.MailId, t.ContentHash)
+		if err != nil {
+			log.Fatalf("Failed to check state for email %s: %v", t.MailId, err)
+		}
 
-			if foundMatch == nil {
-				log.Printf("Found no close matches for $%d.%02d to %s on %s", info.Amount.Dollars, info.Amount.Cents, info.DestinationName, info.TransactionDate)
-				newTransactionId, matchedAccountName, err := firefly.CreateTransaction(info, dryRun)
+		if previous != nil && previous.Done() {
+			log.Printf("Skipping email %s, which was already %s as transaction %s on %s", t.MailId, previous.Outcome, previous.TransactionId, previous.ProcessedAt.Format(time.RFC3339))
+		} else if len(t.Transactions) > 0 {
+			// The email is only recorded and marked as processed once all of
+			// its transactions are in Firefly. Any that were created before a
+			// failure are matched rather than created again on the next run.
+			outcome := state.Matched
+			var transactionIds []string
+			failed := false
+			for _, info := range t.Transactions {
+				info.SourceAccountId, err = firefly.ResolveSourceAccount(info, config.AccountNumbers)
+				if err != nil {
+					log.Printf("Failed to find the account for a transaction from email %s: %v", t.MailId, err)
+					notifyFailedTransaction(notifier, t, info, err)
+					failed = true
+					continue
+				}
 
+				transactionOutcome, transactionId, err := handleTransaction(info, notifier, fireflyUrl, dryRun)
 				if err != nil {
-					log.Fatal(err)
+					log.Printf("Failed to create a transaction from email %s: %v", t.MailId, err)
+					notifyFailedTransaction(notifier, t, info, err)
+					failed = true
+					continue
 				}
+				if transactionOutcome == state.Created {
+					outcome = state.Created
+				}
+				transactionIds = append(transactionIds, transactionId)
+			}
+			if failed {
+				continue
+			}
+			saveRecord(t, outcome, strings.Join(transactionIds, ","))
+		} else {
+			saveRecord(t, state.Unparsable, "")
+			log.Printf("Could not parse email %s: %v", t.MailId, t.Err)
+
+			explanation := "This may be a bug or it may be an irrelevant email."
+			if t.Err != nil && !errors.Is(t.Err, email.ErrNoStepMatched) {
+				explanation = "A processing step matched it but failed, so the email processing configuration may need fixing."
+			}
+			message := fmt.Sprintf(`## Unparsable Email
 
-				url := fmt.Sprintf("%s/transactions/show/%d", fireflyUrl, newTransactionId)
+An email was received that could not be parsed. %s
 
-				prefix := ""
-				if dryRun {
-					prefix = "Test "
-				}
+**ID**: %s
+**Message ID**: %s
+**Reason**: %v`,
+				explanation,
+				t.Id,
+				t.MailId,
+				t.Err)
 
-				message := fmt.Sprintf(`## %s[New Transaction Created From Email](%s)
+			if err := notifier.Notify(message); err != nil {
+				log.Println(err)
+			}
+		}
+
+		if !dryRun {
+			if err := source.MarkProcessed(t.Id); err != nil {
+				log.Printf("Failed to mark email %s as processed: %v", t.Id, err)
+			}
+		}
+	}
+}
+
+// Finds or creates the Firefly transaction for a transaction extracted from
+// an email, and notifies about it. Returns whether it was created or matched,
+// and the ID of the Firefly transaction.
+func handleTransaction(info common.TransactionInfo, notifier common.Notifier, fireflyUrl string, dryRun bool) (state.Outcome, string, error) {
+	// So that notifications name the payer of a credit as its source
+	info = firefly.WithSignedType(info)
+	foundMatch := firefly.GetExistingTransaction(info)
+
+	if foundMatch == nil {
+		log.Printf("Found no close matches for %s to %s on %s", info.Amount.Display(), info.DestinationName, info.TransactionDate)
+		newTransactionId, matchedAccountName, err := firefly.CreateTransaction(info, dryRun)
+
+		if err != nil {
+			return "", "", err
+		}
+
+		url := fmt.Sprintf("%s/transactions/show/%d", fireflyUrl, newTransactionId)
+
+		prefix := ""
+		if dryRun {
+			prefix = "Test "
+		}
+
+		message := fmt.Sprintf(`## %s[New Transaction Created From Email](%s)
 
 Please confirm:
 
-**Destination**: %s -> %s
-**Amount**: $%d.%02d
+**%s**: %s -> %s
+**Amount**: %s
 **Date**: %s`,
-					prefix,
-					url,
-					info.DestinationName,
-					*matchedAccountName,
-					info.Amount.Dollars,
-					info.Amount.Cents,
-					info.TransactionDate.Format("Jan 02 , 2006"))
-
-				if err := notifier.Notify(message); err != nil {
-					log.Println(err)
-				}
-			} else {
-				log.Printf("Close match found for $%d.%02d to %s", info.Amount.Dollars, info.Amount.Cents, info.DestinationName)
-				groupTitle := foundMatch.Attributes.GroupTitle
-
-				var title string
-				if groupTitle == nil {
-					title = foundMatch.Attributes.Transactions[0].Description
-				} else {
-					title = *groupTitle
-				}
+			prefix,
+			url,
+			counterpartyLabel(info),
+			info.DestinationName,
+			*matchedAccountName,
+			formatAmount(info),
+			info.TransactionDate.Format("Jan 02 , 2006"))
+
+		if err := notifier.Notify(message); err != nil {
+			log.Println(err)
+		}
+		return state.Created, strconv.Itoa(newTransactionId), nil
+	}
+
+	log.Printf("Close match found for %s to %s", info.Amount.Display(), info.DestinationName)
+	groupTitle := foundMatch.Attributes.GroupTitle
+
+	var title string
+	if groupTitle == nil {
+		title = foundMatch.Attributes.Transactions[0].Description
+	} else {
+		title = *groupTitle
+	}
 
-				foundDate := foundMatch.Attributes.Transactions[0].Date
+	foundDate := foundMatch.Attributes.Transactions[0].Date
 
-				foundAccount := foundMatch.Attributes.Transactions[0].DestinationName
-				url := fmt.Sprintf("%s/transactions/show/%s", fireflyUrl, foundMatch.Id)
+	foundAccount := foundMatch.Attributes.Transactions[0].DestinationName
+	if info.Type == common.Deposit {
+		foundAccount = foundMatch.Attributes.Transactions[0].SourceName
+	}
+	url := fmt.Sprintf("%s/transactions/show/%s", fireflyUrl, foundMatch.Id)
 
-				message := fmt.Sprintf(`## New Transaction Email Matched
+	message := fmt.Sprintf(`## New Transaction Email Matched
 
 Found an existing Firefly transaction [%s](%s).
 
 Please confirm:
 
-**Destination**: %s (%s)
-**Amount**: $%d.%02d,
+**%s**: %s (%s)
+**Amount**: %s,
 **Date**: %s`,
-					title,
-					url,
-					info.DestinationName,
-					*foundAccount,
-					info.Amount.Dollars,
-					info.Amount.Cents,
-					foundDate.Format("Jan 02, 2006"))
-
-				if err := notifier.Notify(message); err != nil {
-					log.Println(err)
-				}
-			}
-		} else {
-			message := fmt.Sprintf(`## Unparsable Email
+		title,
+		url,
+		counterpartyLabel(info),
+		info.DestinationName,
+		*foundAccount,
+		formatAmount(info),
+		foundDate.Format("Jan 02, 2006"))
 
-An email was received that could not be parsed. This may be a bug or it may be an irrelevant email.
+	if err := notifier.Notify(message); err != nil {
+		log.Println(err)
+	}
+	return state.Matched, foundMatch.Id, nil
+}
 
-**UID**: %d
-**Message ID**: %s`,
-				t.Uid,
-				t.MailId)
+// Notifies that a transaction from an email could not be added to Firefly.
+// The email is left unprocessed so that it is retried on the next run.
+func notifyFailedTransaction(notifier common.Notifier, t common.EmailTransactionInfo, info common.TransactionInfo, err error) {
+	info = firefly.WithSignedType(info)
+	message := fmt.Sprintf(`## Failed To Add Transaction From Email
 
-			if err := notifier.Notify(message); err != nil {
-				log.Println(err)
-			}
-		}
+A transaction from an email could not be added to Firefly. The email will be retried on the next run, which will send "matched" notices again for any of its transactions that were already created.
 
-		if !dryRun {
-			email.MarkRead(t.Uid)
-		}
+**ID**: %s
+**Message ID**: %s
+**Amount**: %s
+**%s**: %s
+**Reason**: %v`,
+		t.Id,
+		t.MailId,
+		formatAmount(info),
+		counterpartyLabel(info),
+		info.DestinationName,
+		err)
+
+	if err := notifier.Notify(message); err != nil {
+		log.Println(err)
+	}
+}
+
+// Returns what to call the other party of a transaction in notifications.
+func counterpartyLabel(info common.TransactionInfo) string {
+	if info.Type == common.Deposit {
+		return "Source"
+	}
+	return "Destination"
+}
+
+// Formats the amount of a transaction for notifications, including the
+// foreign amount if there is one.
+func formatAmount(info common.TransactionInfo) string {
+	if info.ForeignAmount == nil || info.ForeignAmount.IsZero() {
+		return info.Amount.Display()
 	}
+	return fmt.Sprintf("%s (%s)", info.Amount.Display(), info.ForeignAmount.Display())
 }
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"firefly-iii-email-scanner/archive"
+	"firefly-iii-email-scanner/common"
+	"firefly-iii-email-scanner/email"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Runs a new configuration over the archived emails and prints how the
+// extracted transactions differ from those of the current configuration.
+func runReplay(args []string) {
+	flags := flag.NewFlagSet("replay", flag.ExitOnError)
+	newConfigFile := flags.String("config", "", "The new configuration file to replay the archive with (required)")
+	baselineConfigFile := flags.String("baseline", "config.yaml", "The configuration file to compare against")
+	archiveDir := flags.String("archive", "", "The archive directory. Defaults to the baseline configuration's archiveDir")
+	showAll := flags.Bool("all", false, "Also list emails whose results did not change")
+	verbose := flags.Bool("verbose", false, "Show log output from processing each email")
+	flags.Parse(args)
+
+	if *newConfigFile == "" {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	baseline, err := common.GetConfig(*baselineConfigFile)
+	if err != nil {
+		log.Fatalf("Failed to load baseline config: %v", err)
+	}
+	newConfig, err := common.GetConfig(*newConfigFile)
+	if err != nil {
+		log.Fatalf("Failed to load new config: %v", err)
+	}
+
+	if *archiveDir == "" {
+		*archiveDir = baseline.GetArchiveDir()
+	}
+	a, err := archive.Open(*archiveDir)
+	if err != nil {
+		log.Fatalf("Failed to open archive: %v", err)
+	}
+
+	hashes, err := a.List()
+	if err != nil {
+		log.Fatalf("Failed to list archive: %v", err)
+	}
+
+	if !*verbose {
+		log.SetOutput(io.Discard)
+	}
+
+	changed := 0
+	for _, hash := range hashes {
+		content, err := a.Get(hash)
+		if err != nil {
+			fmt.Printf("%s: failed to read archived email: %v\n", hash, err)
+			continue
+		}
+
+		msg := email.RawMessage{Id: hash, Body: content}
+		before, beforeErr := replayMessage(msg, baseline.ProcessEmails)
+		after, afterErr := replayMessage(msg, newConfig.ProcessEmails)
+
+		diffs := diffTransactionInfo(before, after)
+		if beforeErr != afterErr {
+			diffs = append(diffs, fieldDiff{"error", beforeErr, afterErr})
+		}
+
+		if len(diffs) == 0 && !*showAll {
+			continue
+		}
+		if len(diffs) > 0 {
+			changed++
+		}
+
+		messageId := ""
+		if before != nil {
+			messageId = before.MailId
+		} else if after != nil {
+			messageId = after.MailId
+		}
+		fmt.Printf("%s %s\n", hash[:12], messageId)
+		if len(diffs) == 0 {
+			fmt.Println("  (unchanged)")
+		}
+		for _, d := range diffs {
+			fmt.Printf("  %-16s %s -> %s\n", d.field+":", d.before, d.after)
+		}
+	}
+
+	fmt.Printf("\n%d of %d archived emails changed\n", changed, len(hashes))
+}
+
+// Processes an archived email with the given configuration, returning the
+// reason if no transactions could be extracted.
+func replayMessage(msg email.RawMessage, configs []common.EmailProcessingConfig) (*common.EmailTransactionInfo, string) {
+	info := email.ProcessRawMessage(msg, configs)
+	if info != nil && info.Err != nil {
+		return info, info.Err.Error()
+	}
+	return info, ""
+}
+
+type fieldDiff struct {
+	field  string
+	before string
+	after  string
+}
+
+// Compares the fields of the transactions extracted from the same email.
+// When the email has several transactions, they are compared in order and
+// each field is prefixed with the transaction's position, e.g. "#2 amount".
+func diffTransactionInfo(before *common.EmailTransactionInfo, after *common.EmailTransactionInfo) []fieldDiff {
+	beforeTransactions := transactionsOf(before)
+	afterTransactions := transactionsOf(after)
+	count := max(len(beforeTransactions), len(afterTransactions), 1)
+
+	var diffs []fieldDiff
+	for i := 0; i < count; i++ {
+		b := describeTransaction(beforeTransactions, i)
+		a := describeTransaction(afterTransactions, i)
+
+		prefix := ""
+		if count > 1 {
+			prefix = fmt.Sprintf("#%d ", i+1)
+		}
+		for j := range b {
+			if b[j].value != a[j].value {
+				diffs = append(diffs, fieldDiff{prefix + b[j].field, b[j].value, a[j].value})
+			}
+		}
+	}
+	return diffs
+}
+
+func transactionsOf(t *common.EmailTransactionInfo) []common.TransactionInfo {
+	if t == nil {
+		return nil
+	}
+	return t.Transactions
+}
+
+type describedField struct {
+	field string
+	value string
+}
+
+// Describes the transaction at the given position, or a missing transaction
+// if there are not that many.
+func describeTransaction(transactions []common.TransactionInfo, i int) []describedField {
+	if i < len(transactions) {
+		return describeInfo(transactions[i])
+	}
+
+	fields := describeInfo(common.TransactionInfo{})
+	for j := range fields {
+		fields[j].value = "-"
+		if fields[j].field == "step" {
+			fields[j].value = "(no match)"
+		}
+	}
+	return fields
+}
+
+func describeInfo(info common.TransactionInfo) []describedField {
+	foreignAmount := "-"
+	if info.ForeignAmount != nil {
+		foreignAmount = info.ForeignAmount.Display()
+	}
+	date := "-"
+	if !info.TransactionDate.IsZero() {
+		date = info.TransactionDate.Format(time.RFC3339)
+	}
+	return []describedField{
+		{"amount", info.Amount.Display()},
+		{"foreignAmount", foreignAmount},
+		{"date", date},
+		{"destination", strconv.Quote(info.DestinationName)},
+		{"sourceAccount", describeSourceAccount(info)},
+		{"accountNumber", strconv.Quote(info.AccountNumberSuffix)},
+		{"type", info.Type.String()},
+		{"description", strconv.Quote(info.Description)},
+		{"notes", strconv.Quote(info.Notes)},
+		{"category", strconv.Quote(info.Category)},
+		{"budget", strconv.Quote(info.Budget)},
+		{"tags", strconv.Quote(strings.Join(info.Tags, ", "))},
+		{"bill", strconv.Quote(info.Bill)},
+		{"bookDate", describeDate(info.BookDate)},
+		{"processDate", describeDate(info.ProcessDate)},
+		{"cardLast4", strconv.Quote(info.CardLast4)},
+		{"cardholder", strconv.Quote(info.Cardholder)},
+		{"reference", strconv.Quote(info.Reference)},
+		{"step", strconv.Quote(info.ProcessingStep)},
+	}
+}
+
+func describeSourceAccount(info common.TransactionInfo) string {
+	if info.SourceAccountName != "" {
+		return strconv.Quote(info.SourceAccountName)
+	}
+	return strconv.Itoa(info.SourceAccountId)
+}
+
+func describeDate(date *time.Time) string {
+	if date == nil {
+		return "-"
+	}
+	return date.Format(time.RFC3339)
+}
@@ -0,0 +1,116 @@
+package state
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// The outcome of processing an email.
+type Outcome string
+
+const (
+	// A new Firefly transaction was created from the email.
+	Created Outcome = "created"
+	// The email matched a transaction that already existed in Firefly.
+	Matched Outcome = "matched"
+	// No transaction information could be extracted from the email.
+	Unparsable Outcome = "unparsable"
+)
+
+var messagesBucket = []byte("messages")
+
+// A local record of which emails have been processed, so that an email is
+// never turned into a transaction twice, even if its read status is reset.
+type Store struct {
+	db *bolt.DB
+}
+
+// What happened when an email was processed.
+type Record struct {
+	MessageId   string  `json:"messageId"`
+	ContentHash string  `json:"contentHash"`
+	Outcome     Outcome `json:"outcome"`
+	// The ID of the Firefly transaction, or the IDs separated by commas for an
+	// email which listed several transactions.
+	TransactionId string    `json:"transactionId,omitempty"`
+	ProcessedAt   time.Time `json:"processedAt"`
+}
+
+// Reports whether the email this record is for should not be processed
+// again, because it already produced or matched a Firefly transaction.
+func (r *Record) Done() bool {
+	return r.Outcome == Created || r.Outcome == Matched
+}
+
+// Opens the store at the given path, creating it if it does not exist.
+// A call to `Open` should be followed by a call to `Close`.
+func Open(path string) (*Store, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open state store %s: %w", path, err)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(messagesBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to initialize state store: %w", err)
+	}
+
+	return &Store{db: db}, nil
+}
+
+// Closes the underlying database.
+func (s *Store) Close() error {
+	return s.db.Close()
+}
+
+// Builds the key an email is stored under from its Message-ID and the hash
+// of its content. Both are used because some senders reuse Message-IDs and
+// some emails have none.
+func key(messageId string, contentHash string) []byte {
+	return []byte(messageId + "\x00" + contentHash)
+}
+
+// Returns the record for the given email, or nil if it has never been processed.
+func (s *Store) Get(messageId string, contentHash string) (*Record, error) {
+	var record *Record
+	err := s.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(messagesBucket).Get(key(messageId, contentHash))
+		if data == nil {
+			return nil
+		}
+		record = &Record{}
+		return json.Unmarshal(data, record)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read state for %s: %w", messageId, err)
+	}
+	return record, nil
+}
+
+// Saves the record, replacing any previous record for the same email.
+// If the processed time is not set, the current time is used.
+func (s *Store) Put(record Record) error {
+	if record.ProcessedAt.IsZero() {
+		record.ProcessedAt = time.Now().UTC()
+	}
+
+	data, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("failed to marshal state record: %w", err)
+	}
+
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(messagesBucket).Put(key(record.MessageId, record.ContentHash), data)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to write state for %s: %w", record.MessageId, err)
+	}
+	return nil
+}
@@ -0,0 +1,59 @@
+package state
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestStore_PersistsRecords(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.db")
+
+	store, err := Open(path)
+	if err != nil {
+		t.Fatalf("Open returned an error: %v", err)
+	}
+
+	record, err := store.Get("<abc@mybank.com>", "hash")
+	if err != nil {
+		t.Fatalf("Get returned an error: %v", err)
+	}
+	if record != nil {
+		t.Fatalf("Expected no record for an unprocessed email, got %+v", record)
+	}
+
+	if err := store.Put(Record{MessageId: "<abc@mybank.com>", ContentHash: "hash", Outcome: Created, TransactionId: "42"}); err != nil {
+		t.Fatalf("Put returned an error: %v", err)
+	}
+	if err := store.Close(); err != nil {
+		t.Fatalf("Close returned an error: %v", err)
+	}
+
+	store, err = Open(path)
+	if err != nil {
+		t.Fatalf("Open returned an error: %v", err)
+	}
+	defer store.Close()
+
+	record, err = store.Get("<abc@mybank.com>", "hash")
+	if err != nil {
+		t.Fatalf("Get returned an error: %v", err)
+	}
+	if record == nil || !record.Done() || record.TransactionId != "42" || record.ProcessedAt.IsZero() {
+		t.Errorf("Expected the created record to be persisted, got %+v", record)
+	}
+
+	record, err = store.Get("<abc@mybank.com>", "other-hash")
+	if err != nil {
+		t.Fatalf("Get returned an error: %v", err)
+	}
+	if record != nil {
+		t.Errorf("Expected different content to be a different email, got %+v", record)
+	}
+}
+
+func TestRecord_UnparsableIsNotDone(t *testing.T) {
+	record := Record{Outcome: Unparsable}
+	if record.Done() {
+		t.Errorf("Expected unparsable emails to be processed again")
+	}
+}
@@ -0,0 +1,544 @@
+// Package suggest drafts a processing step for a bank alert from a sample of
+// it, by finding the spans of text which look like its amount, date and
+// merchant, so that new users have a starting point rather than having to
+// write regexes from scratch.
+package suggest
+
+import (
+	"firefly-iii-email-scanner/common"
+	"firefly-iii-email-scanner/email"
+	"fmt"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"gopkg.in/yaml.v3"
+)
+
+// The time zone suggested for dates, which alerts rarely say in a form Go
+// can load.
+const defaultTimeZone = "UTC"
+
+var (
+	// A currency symbol followed by a number, or a number followed by a
+	// currency symbol or code, e.g. "$1,234.56" or "1.234,56 €".
+	amountRegex = regexp.MustCompile(`[$£€¥] ?\d{1,3}(?:[,.]?\d{3})*(?:[.,]\d{2})?|\d{1,3}(?:[,. ]?\d{3})*[.,]\d{2} ?(?:€|EUR|USD|GBP|CHF|CAD|AUD)`)
+	// Words which introduce the amount of a transaction, as opposed to, say,
+	// an alert threshold or an available balance.
+	amountKeywordRegex = regexp.MustCompile(`(?i)\b(amount|charge|charged|purchase|transaction|payment|paid|spent|withdrawal|debit|deposit|total|betrag)\b`)
+	// A line which gives the merchant after a label, e.g. "Merchant: BLUE BOTTLE".
+	merchantLabelRegex = regexp.MustCompile(`(?mi)^[ \t]*(merchant|payee|description|store|where|recipient|to|händler|empfänger)[ \t]*:[ \t]*(\S.*?)[ \t\r]*$`)
+	// The merchant after a preposition, e.g. "at BLUE BOTTLE on" or "with AMAZON".
+	merchantPhraseRegex = regexp.MustCompile(`(?m)\b(at|with|to|from) ([A-Z0-9*#&'][^\n]*?)(\s+(?:on|has|was|is|for|using)\b|[,;]|\.(?:\s|$)|$)`)
+	digitsRegex         = regexp.MustCompile(`[0-9]+`)
+)
+
+// The pattern a merchant is captured with. It is not used in discriminators,
+// as merchant names differ between alerts.
+const merchantPattern = ".+?"
+
+// A way of writing dates, with a regex which finds them and the Go layouts
+// they are parsed with. When there are several layouts, the first which
+// parses the date is used, and the others are mentioned as alternatives.
+type dateFormat struct {
+	regex   *regexp.Regexp
+	pattern string
+	layouts []string
+}
+
+func newDateFormat(pattern string, layouts ...string) dateFormat {
+	return dateFormat{regexp.MustCompile(`\b` + pattern + `\b`), pattern, layouts}
+}
+
+// The ways of writing dates that are recognized, most specific first.
+var dateFormats = []dateFormat{
+	newDateFormat(`[A-Z][a-z]{3,8} \d{1,2}, \d{4}`, "January 2, 2006"),
+	newDateFormat(`[A-Z][a-z]{2} \d{1,2}, \d{4}`, "Jan 2, 2006"),
+	newDateFormat(`\d{1,2} [A-Z][a-z]{3,8} \d{4}`, "2 January 2006"),
+	newDateFormat(`\d{1,2} [A-Z][a-z]{2} \d{4}`, "2 Jan 2006"),
+	newDateFormat(`\d{4}-\d{2}-\d{2}`, "2006-01-02"),
+	newDateFormat(`\d{2}/\d{2}/\d{4}`, "01/02/2006", "02/01/2006"),
+	newDateFormat(`\d{1,2}/\d{1,2}/\d{4}`, "1/2/2006", "2/1/2006"),
+	newDateFormat(`\d{2}/\d{2}/\d{2}`, "01/02/06", "02/01/06"),
+	newDateFormat(`\d{2}\.\d{2}\.\d{4}`, "02.01.2006"),
+	newDateFormat(`\d{2}/\d{2}`, "01/02", "02/01"),
+}
+
+// A span of the subject or body which holds a value.
+type span struct {
+	// The extraction step type which searches the text the span is in.
+	stepType string
+	text     string
+	start    int
+	end      int
+	// The regex the value is captured with.
+	pattern string
+}
+
+func (s span) value() string {
+	return s.text[s.start:s.end]
+}
+
+// A processing step suggested for an email, along with what it was based on.
+type Suggestion struct {
+	Config common.EmailProcessingConfig
+	// What was found for each field, e.g. "amount" to "$42.17", and the
+	// layout the date is parsed with as "layout".
+	found map[string]string
+	// Notes on the fields that could not be found, or whose values are
+	// guesses, to add to the YAML.
+	notes map[string]string
+}
+
+// Drafts a processing step for the email: a discriminator which tells its
+// format apart from the sender's other emails, and extraction steps for the
+// amount, the date and the merchant, where they can be found.
+func Suggest(e *email.ParsedEmail) (*Suggestion, error) {
+	subject := e.Subject()
+	body := e.Body()
+	bodyType := "plainTextBodyRegex"
+	if e.PlainText == "" {
+		bodyType = "htmlBodyRegex"
+	}
+	if strings.TrimSpace(subject) == "" && strings.TrimSpace(body) == "" {
+		return nil, fmt.Errorf("the email has no subject or text")
+	}
+	texts := []span{{stepType: "subjectRegex", text: subject}, {stepType: bodyType, text: body}}
+
+	s := &Suggestion{found: make(map[string]string), notes: make(map[string]string)}
+	step := common.ProcessingStep{OptionName: optionName(e)}
+
+	amount, ok := findAmount(texts)
+	var found []span
+	if ok {
+		var format common.AmountFormat
+		amount.pattern, format = amountPattern(amount.value())
+		found = append(found, amount)
+		extractionStep := common.ExtractionStep{
+			Type:  amount.stepType,
+			Regex: contextBefore(amount, found) + "(?P<amount>" + amount.pattern + ")",
+		}
+		if format != common.DefaultAmountFormat {
+			extractionStep.TargetFields = []common.TargetField{
+				{GroupName: "amount", TargetField: "amount", DecimalSeparator: &format.DecimalSeparator, GroupSeparator: &format.GroupSeparators},
+			}
+		}
+		step.ExtractionSteps = append(step.ExtractionSteps, extractionStep)
+		s.found["amount"] = amount.value()
+	} else {
+		s.notes["amount"] = "No amount was found; add a step with an amount group"
+	}
+
+	merchant, ok := findMerchant(texts, amount)
+	if ok {
+		merchant.pattern = merchantPattern
+		found = append(found, merchant)
+		targetField := common.TargetField{GroupName: "destinationAccount", TargetField: "destinationAccount"}
+		if isUpperCase(merchant.value()) {
+			targetField.Transforms = []common.Transform{{Type: "normalize", Name: "merchant"}}
+		}
+		step.ExtractionSteps = append(step.ExtractionSteps, common.ExtractionStep{
+			Type:         merchant.stepType,
+			Regex:        contextBefore(merchant, found) + "(?P<destinationAccount>" + merchant.pattern + ")" + contextAfter(merchant),
+			TargetFields: []common.TargetField{targetField},
+		})
+		s.found["merchant"] = merchant.value()
+	} else {
+		s.notes["merchant"] = "No merchant was found; add a step with a destinationAccount group"
+	}
+
+	date, format, layout, ok := findDate(texts, found)
+	if ok {
+		date.pattern = format.pattern
+		found = append(found, date)
+		timeZone := defaultTimeZone
+		step.ExtractionSteps = append(step.ExtractionSteps, common.ExtractionStep{
+			Type:  date.stepType,
+			Regex: contextBefore(date, found) + "(?P<transactionDate>" + date.pattern + ")",
+			TargetFields: []common.TargetField{
+				{GroupName: "transactionDate", TargetField: "transactionDate", Format: &layout, TimeZone: &timeZone},
+			},
+		})
+		s.found["date"] = date.value()
+		s.found["layout"] = layout
+		for _, alternative := range format.layouts {
+			if _, err := time.Parse(alternative, date.value()); err == nil && alternative != layout {
+				s.notes["format"] = fmt.Sprintf("%q could also be %q; check which the bank uses", layout, alternative)
+				break
+			}
+		}
+	} else {
+		step.ExtractionSteps = append(step.ExtractionSteps, common.ExtractionStep{Type: "envelopeDate"})
+		s.notes["envelopeDate"] = "No date was found, so the email's date is used"
+	}
+
+	step.Discriminator = discriminator(texts, found)
+
+	from := ""
+	if addresses, err := e.Header.AddressList("From"); err == nil && len(addresses) > 0 {
+		from = addresses[0].Address
+	}
+	s.Config = common.EmailProcessingConfig{FromEmail: from, ProcessingSteps: []common.ProcessingStep{step}}
+	return s, nil
+}
+
+func optionName(e *email.ParsedEmail) string {
+	if addresses, err := e.Header.AddressList("From"); err == nil && len(addresses) > 0 && addresses[0].Name != "" {
+		return addresses[0].Name + " alert"
+	}
+	return "Alert"
+}
+
+// Returns the first amount introduced by a keyword such as "charge" or
+// "amount", looking in the subject first, or failing that the first amount.
+func findAmount(texts []span) (span, bool) {
+	var first *span
+	for _, t := range texts {
+		for _, match := range amountRegex.FindAllStringIndex(t.text, -1) {
+			amount := span{stepType: t.stepType, text: t.text, start: match[0], end: match[1]}
+			if first == nil {
+				first = &amount
+			}
+			lineStart := strings.LastIndex(t.text[:match[0]], "\n") + 1
+			lineEnd := strings.Index(t.text[match[1]:], "\n")
+			if lineEnd < 0 {
+				lineEnd = len(t.text)
+			} else {
+				lineEnd += match[1]
+			}
+			if amountKeywordRegex.MatchString(t.text[lineStart:lineEnd]) {
+				return amount, true
+			}
+		}
+	}
+	if first == nil {
+		return span{}, false
+	}
+	return *first, true
+}
+
+// Returns the merchant: the value of a line labelled "Merchant:" or similar,
+// or failing that the name after "at" or "with" nearest the amount.
+func findMerchant(texts []span, amount span) (span, bool) {
+	for _, t := range texts {
+		for _, match := range merchantLabelRegex.FindAllStringSubmatchIndex(t.text, -1) {
+			merchant := span{stepType: t.stepType, text: t.text, start: match[4], end: match[5]}
+			if !strings.Contains(merchant.value(), "@") && !amountRegex.MatchString(merchant.value()) {
+				return merchant, true
+			}
+		}
+	}
+
+	// Look near the amount first, preferring after it, as in "A charge of
+	// $4.50 at BLUE BOTTLE", to before it, as in "at BLUE BOTTLE, a purchase
+	// of $4.50"
+	if amount.text != "" {
+		var before, after *span
+		for _, match := range merchantPhraseRegex.FindAllStringSubmatchIndex(amount.text, -1) {
+			merchant := span{stepType: amount.stepType, text: amount.text, start: match[4], end: match[5]}
+			if merchant.start >= amount.end && after == nil {
+				after = &merchant
+			} else if merchant.end <= amount.start {
+				before = &merchant
+			}
+		}
+		if after != nil {
+			return *after, true
+		}
+		if before != nil {
+			return *before, true
+		}
+	}
+	for _, t := range texts {
+		if match := merchantPhraseRegex.FindStringSubmatchIndex(t.text); match != nil {
+			return span{stepType: t.stepType, text: t.text, start: match[4], end: match[5]}, true
+		}
+	}
+	return span{}, false
+}
+
+// Returns the first date which does not overlap an amount or merchant
+// already found, with the way it is written and the layout which parses it.
+func findDate(texts []span, found []span) (span, dateFormat, string, bool) {
+	for _, t := range texts {
+		for _, format := range dateFormats {
+			for _, match := range format.regex.FindAllStringIndex(t.text, -1) {
+				date := span{stepType: t.stepType, text: t.text, start: match[0], end: match[1]}
+				if overlaps(date, found) {
+					continue
+				}
+				for _, layout := range format.layouts {
+					if _, err := time.Parse(layout, date.value()); err == nil {
+						return date, format, layout, true
+					}
+				}
+			}
+		}
+	}
+	return span{}, dateFormat{}, "", false
+}
+
+func overlaps(s span, others []span) bool {
+	for _, other := range others {
+		if other.text == s.text && s.start < other.end && other.start < s.end {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns a regex for the literal text just before a span on its line: up to
+// three words, stopping at any value already found, with their digits
+// generalized. It is anchored to the start of the line if it reaches it.
+func contextBefore(s span, found []span) string {
+	lineStart := strings.LastIndex(s.text[:s.start], "\n") + 1
+	start := lineStart
+	for _, other := range found {
+		if other.text == s.text && other.end <= s.start && other.end > start {
+			start = other.end
+		}
+	}
+
+	before := s.text[start:s.start]
+	if s.stepType == "htmlBodyRegex" {
+		// Start at the tag the value is in, e.g. "<td>"
+		if tag := strings.LastIndex(before, "<"); tag >= 0 {
+			return quoteContext(before[tag:])
+		}
+	}
+	if words := strings.SplitAfter(before, " "); len(words) > 4 {
+		return quoteContext(strings.Join(words[len(words)-4:], ""))
+	}
+	if start == lineStart {
+		return "^" + quoteContext(before)
+	}
+	return quoteContext(before)
+}
+
+// Returns a regex for what ends a merchant name: the literal text after it,
+// up to the end of the next word, or the end of the line.
+func contextAfter(s span) string {
+	rest := s.text[s.end:]
+	if rest == "" || rest[0] == '\n' || rest[0] == '\r' {
+		return `\s*$`
+	}
+	if rest[0] == ',' || rest[0] == '.' || rest[0] == ';' {
+		return regexp.QuoteMeta(rest[:1])
+	}
+	spaces := len(rest) - len(strings.TrimLeft(rest, " "))
+	end := strings.IndexFunc(rest[spaces:], func(r rune) bool { return !unicode.IsLetter(r) })
+	if end < 0 {
+		return quoteContext(rest)
+	}
+	return quoteContext(rest[:spaces+end])
+}
+
+// Quotes literal text for a regex, with any digits generalized so that, say,
+// a card number does not have to match.
+func quoteContext(text string) string {
+	return digitsRegex.ReplaceAllString(regexp.QuoteMeta(text), `\d+`)
+}
+
+// Returns a regex for amounts written like the given one, e.g.
+// `\$[\d,]+\.\d{2}` for "$1,234.56", `[\d.]+,\d{2} €` for "1.234,56 €" or
+// `[\d ]+,\d{2} EUR` for "1 234,56 EUR", and the separators it is written with.
+func amountPattern(amount string) (string, common.AmountFormat) {
+	numberStart := strings.IndexFunc(amount, unicode.IsDigit)
+	numberEnd := strings.LastIndexFunc(amount, unicode.IsDigit) + 1
+	prefix, number, suffix := amount[:numberStart], amount[numberStart:numberEnd], amount[numberEnd:]
+
+	format := common.DefaultAmountFormat
+	whole, fraction := number, ""
+	if len(number) > 3 && (number[len(number)-3] == ',' || number[len(number)-3] == '.') {
+		format.DecimalSeparator = number[len(number)-3 : len(number)-2]
+		whole, fraction = number[:len(number)-3], `\`+format.DecimalSeparator+`\d{2}`
+	}
+	if i := strings.IndexFunc(whole, func(r rune) bool { return !unicode.IsDigit(r) }); i >= 0 {
+		format.GroupSeparators = whole[i : i+1]
+	} else if format.DecimalSeparator == "," {
+		format.GroupSeparators = "."
+	}
+	// A dot between groups with no decimal part, e.g. "€1.234"
+	if format.GroupSeparators == format.DecimalSeparator {
+		format.DecimalSeparator = ","
+	}
+
+	pattern := `[\d` + regexp.QuoteMeta(format.GroupSeparators) + `]+` + fraction
+	return regexp.QuoteMeta(prefix) + pattern + regexp.QuoteMeta(suffix), format
+}
+
+// Returns a discriminator for the email's format: the subject, with the
+// values found in it generalized, up to the merchant if it is there. If the
+// subject is mostly values, a line of the body which has no digits, and so is
+// likely the same in every alert, is used instead.
+func discriminator(texts []span, found []span) common.Discriminator {
+	subject := texts[0]
+	var inSubject []span
+	for _, s := range found {
+		if s.text == subject.text && s.stepType == subject.stepType {
+			inSubject = append(inSubject, s)
+		} else if i := strings.Index(subject.text, s.value()); i >= 0 {
+			// The value was found in the body, but the subject repeats it
+			inSubject = append(inSubject, span{stepType: subject.stepType, text: subject.text, start: i, end: i + len(s.value()), pattern: s.pattern})
+		}
+	}
+	slices.SortFunc(inSubject, func(a, b span) int { return a.start - b.start })
+
+	regex := "^"
+	literal := ""
+	last := 0
+	for _, s := range inSubject {
+		regex += quoteContext(subject.text[last:s.start])
+		literal += subject.text[last:s.start]
+		last = len(subject.text)
+		if s.pattern == merchantPattern {
+			break
+		}
+		regex += s.pattern
+		last = s.end
+	}
+	regex += quoteContext(subject.text[last:])
+	literal += subject.text[last:]
+	if len(strings.Fields(literal)) >= 2 {
+		return common.Discriminator{Type: "subjectRegex", Regex: regex}
+	}
+
+	body := texts[1]
+	for _, line := range strings.Split(body.text, "\n") {
+		line = strings.TrimSpace(line)
+		if len(strings.Fields(line)) >= 3 && !digitsRegex.MatchString(line) && !strings.ContainsAny(line, "<>") {
+			return common.Discriminator{Type: body.stepType, Regex: regexp.QuoteMeta(line)}
+		}
+	}
+	return common.Discriminator{Type: "subjectRegex", Regex: regex}
+}
+
+func isUpperCase(text string) bool {
+	return strings.ToUpper(text) == text && strings.ToLower(text) != text
+}
+
+// Returns the suggestion as a process_emails entry, with comments on what to
+// check and fill in.
+func (s *Suggestion) YAML() ([]byte, error) {
+	var document yaml.Node
+	if err := document.Encode([]common.EmailProcessingConfig{s.Config}); err != nil {
+		return nil, err
+	}
+	prune(&document)
+
+	entry := document.Content[0]
+	entry.HeadComment = "Suggested from a sample email. Check each regex against a few more alerts\n" +
+		"with test-rule, as only one sample was seen."
+	step := value(entry, "processingSteps").Content[0]
+	insertAfter(step, "optionName", "sourceAccountId", "0",
+		"The ID of the Firefly account the alerts are about, or give sourceAccountName instead")
+
+	var annotate func(node *yaml.Node)
+	annotate = func(node *yaml.Node) {
+		if node.Kind == yaml.MappingNode {
+			for i := 0; i+1 < len(node.Content); i += 2 {
+				key, val := node.Content[i], node.Content[i+1]
+				switch key.Value {
+				case "regex":
+					val.Style = yaml.DoubleQuotedStyle
+				case "timeZone":
+					key.LineComment = "The time zone the bank writes dates in, e.g. America/New_York"
+				case "format":
+					key.LineComment = s.notes["format"]
+				case "type":
+					key.LineComment = s.notes[val.Value]
+				}
+			}
+		}
+		for _, child := range node.Content {
+			annotate(child)
+		}
+	}
+	annotate(entry)
+
+	extractionSteps := value(step, "extractionSteps")
+	for _, field := range []string{"amount", "merchant"} {
+		if note := s.notes[field]; note != "" {
+			extractionSteps.FootComment += note + "\n"
+		}
+	}
+	extractionSteps.FootComment = strings.TrimSuffix(extractionSteps.FootComment, "\n")
+
+	return yaml.Marshal(&document)
+}
+
+// Removes the fields which are not set, so that only what was suggested is
+// written.
+func prune(node *yaml.Node) {
+	if node.Kind == yaml.MappingNode {
+		var content []*yaml.Node
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			prune(node.Content[i+1])
+			if !isEmpty(node.Content[i+1]) {
+				content = append(content, node.Content[i], node.Content[i+1])
+			}
+		}
+		node.Content = content
+		return
+	}
+	for _, child := range node.Content {
+		prune(child)
+	}
+}
+
+func isEmpty(node *yaml.Node) bool {
+	switch node.Kind {
+	case yaml.ScalarNode:
+		return node.Tag == "!!null" || node.Value == "" || (node.Tag == "!!int" && node.Value == "0") || (node.Tag == "!!bool" && node.Value == "false")
+	case yaml.MappingNode, yaml.SequenceNode:
+		return len(node.Content) == 0
+	}
+	return false
+}
+
+// Returns the value of a key of a mapping, or nil if it has none.
+func value(mapping *yaml.Node, key string) *yaml.Node {
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		if mapping.Content[i].Value == key {
+			return mapping.Content[i+1]
+		}
+	}
+	return nil
+}
+
+// Adds a key to a mapping after another key, or at the start if the mapping
+// does not have it.
+func insertAfter(mapping *yaml.Node, after string, key string, val string, comment string) {
+	position := 0
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		if mapping.Content[i].Value == after {
+			position = i + 2
+		}
+	}
+	pair := []*yaml.Node{
+		{Kind: yaml.ScalarNode, Tag: "!!str", Value: key, LineComment: comment},
+		{Kind: yaml.ScalarNode, Tag: "!!int", Value: val},
+	}
+	mapping.Content = append(mapping.Content[:position], append(pair, mapping.Content[position:]...)...)
+}
+
+// Describes what was found, for showing alongside the YAML, e.g.
+// `amount: "$42.17"`.
+func (s *Suggestion) Describe() []string {
+	var lines []string
+	for _, field := range []string{"amount", "date", "merchant"} {
+		found, ok := s.found[field]
+		switch {
+		case !ok:
+			lines = append(lines, fmt.Sprintf("%s: not found", field))
+		case field == "date":
+			lines = append(lines, fmt.Sprintf("%s: %s, parsed as %s", field, strconv.Quote(found), strconv.Quote(s.found["layout"])))
+		default:
+			lines = append(lines, fmt.Sprintf("%s: %s", field, strconv.Quote(found)))
+		}
+	}
+	return lines
+}
@@ -0,0 +1,151 @@
+package suggest
+
+import (
+	"firefly-iii-email-scanner/common"
+	"firefly-iii-email-scanner/email"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-message/mail"
+	"gopkg.in/yaml.v3"
+)
+
+func newEmail(subject string, plainText string) *email.ParsedEmail {
+	var header mail.Header
+	header.SetAddressList("From", []*mail.Address{{Name: "Example Bank", Address: "alerts@examplebank.com"}})
+	header.SetSubject(subject)
+	header.SetDate(time.Date(2024, time.March, 14, 19, 2, 11, 0, time.UTC))
+	return &email.ParsedEmail{Header: header, PlainText: plainText}
+}
+
+func TestSuggest(t *testing.T) {
+	sample := newEmail("Your Example Card transaction",
+		"Hello Alex,\n\nA charge of $1,234.56 at SQ *BLUE BOTTLE COFF 0042 OAKLAND CA has been authorized on Mar 14, 2024 at 6:58 PM ET.\n")
+
+	suggestion, err := Suggest(sample)
+	if err != nil {
+		t.Fatalf("Suggest returned an error: %v", err)
+	}
+	step := suggestion.Config.ProcessingSteps[0]
+	if step.Discriminator.Type != "subjectRegex" || step.Discriminator.Regex != "^Your Example Card transaction" {
+		t.Errorf("Expected a subject discriminator, got %+v", step.Discriminator)
+	}
+	if suggestion.Config.FromEmail != "alerts@examplebank.com" {
+		t.Errorf("Expected the sender's address, got %q", suggestion.Config.FromEmail)
+	}
+
+	trace := email.TraceEmail(sample, suggestion.Config)
+	if trace.Err != nil {
+		t.Fatalf("The suggestion does not extract a transaction: %v", trace.Err)
+	}
+	transaction := trace.Transactions[0]
+	if transaction.Amount.Display() != "$1234.56" {
+		t.Errorf("Expected amount $1234.56, got %s", transaction.Amount.Display())
+	}
+	if transaction.DestinationName != "Blue Bottle Coff" {
+		t.Errorf("Expected the normalized merchant, got %q", transaction.DestinationName)
+	}
+	if date := transaction.TransactionDate.Format("2006-01-02"); date != "2024-03-14" {
+		t.Errorf("Expected date 2024-03-14, got %s", date)
+	}
+}
+
+func TestSuggest_ValuesInSubject(t *testing.T) {
+	sample := newEmail("Your $42.17 transaction with AMZN Mktp US*2K4AB12C3",
+		"Account: Chase Freedom Unlimited (...5678)\nMerchant: AMZN Mktp US*2K4AB12C3\n")
+
+	suggestion, err := Suggest(sample)
+	if err != nil {
+		t.Fatalf("Suggest returned an error: %v", err)
+	}
+	step := suggestion.Config.ProcessingSteps[0]
+	expected := `^Your \$[\d,]+\.\d{2} transaction with `
+	if step.Discriminator.Regex != expected {
+		t.Errorf("Expected discriminator `%s`, got `%s`", expected, step.Discriminator.Regex)
+	}
+	if last := step.ExtractionSteps[len(step.ExtractionSteps)-1]; last.Type != "envelopeDate" {
+		t.Errorf("Expected the email's date to be used, got %+v", last)
+	}
+
+	trace := email.TraceEmail(sample, suggestion.Config)
+	if trace.Err != nil {
+		t.Fatalf("The suggestion does not extract a transaction: %v", trace.Err)
+	}
+	if transaction := trace.Transactions[0]; transaction.Amount.Display() != "$42.17" || transaction.DestinationName != "AMZN Mktp US*2K4AB12C3" {
+		t.Errorf("Expected $42.17 at AMZN Mktp US*2K4AB12C3, got %s at %q", transaction.Amount.Display(), transaction.DestinationName)
+	}
+}
+
+func TestSuggest_CommaDecimalAmount(t *testing.T) {
+	sample := newEmail("Kartenzahlung", "Kartenzahlung mit Ihrer Debitkarte\nBetrag: 1.234,56 €\nHändler: Bäckerei Beispiel\nDatum: 2024-03-03\n")
+
+	suggestion, err := Suggest(sample)
+	if err != nil {
+		t.Fatalf("Suggest returned an error: %v", err)
+	}
+	trace := email.TraceEmail(sample, suggestion.Config)
+	if trace.Err != nil {
+		t.Fatalf("The suggestion does not extract a transaction: %v", trace.Err)
+	}
+	if amount := trace.Transactions[0].Amount.String(); amount != "1234.56" {
+		t.Errorf("Expected amount 1234.56, got %s", amount)
+	}
+}
+
+func TestSuggest_SpaceGroupedAmount(t *testing.T) {
+	sample := newEmail("Kartenzahlung", "Kartenzahlung mit Ihrer Debitkarte\nBetrag: 1 234,56 EUR\nHändler: Bäckerei Beispiel\nDatum: 2024-03-03\n")
+
+	suggestion, err := Suggest(sample)
+	if err != nil {
+		t.Fatalf("Suggest returned an error: %v", err)
+	}
+	targetFields := suggestion.Config.ProcessingSteps[0].ExtractionSteps[0].TargetFields
+	if len(targetFields) != 1 || *targetFields[0].GroupSeparator != " " || *targetFields[0].DecimalSeparator != "," {
+		t.Errorf("Expected the separators of the sample to be set, got %+v", targetFields)
+	}
+	trace := email.TraceEmail(sample, suggestion.Config)
+	if trace.Err != nil {
+		t.Fatalf("The suggestion does not extract a transaction: %v", trace.Err)
+	}
+	if amount := trace.Transactions[0].Amount.String(); amount != "1234.56" {
+		t.Errorf("Expected amount 1234.56, got %s", amount)
+	}
+}
+
+func TestSuggestion_YAML(t *testing.T) {
+	sample := newEmail("Withdrawal alert", "$1,250.00 came out of your account.\nTo: GREENVIEW PROPERTY MGMT\nDate: 01/02/24\n")
+
+	suggestion, err := Suggest(sample)
+	if err != nil {
+		t.Fatalf("Suggest returned an error: %v", err)
+	}
+	out, err := suggestion.YAML()
+	if err != nil {
+		t.Fatalf("YAML returned an error: %v", err)
+	}
+
+	text := string(out)
+	for _, expected := range []string{
+		`regex: "^(?P<amount>\\$[\\d,]+\\.\\d{2})"`,
+		"sourceAccountId: 0 # The ID of the Firefly account",
+		`format: 01/02/06 # "01/02/06" could also be "02/01/06"`,
+	} {
+		if !strings.Contains(text, expected) {
+			t.Errorf("Expected the YAML to contain %q, got\n%s", expected, text)
+		}
+	}
+	if strings.Contains(text, "null") || strings.Contains(text, `""`) {
+		t.Errorf("Expected unset fields to be left out, got\n%s", text)
+	}
+
+	var configs []common.EmailProcessingConfig
+	if err := yaml.Unmarshal(out, &configs); err != nil {
+		t.Fatalf("The YAML does not parse: %v", err)
+	}
+	// The source account is left for the user to fill in
+	problems := email.ValidateConfig(configs[0])
+	if len(problems) != 1 || !strings.Contains(problems[0].Error(), "no source account") {
+		t.Errorf("Expected only the source account to be missing, got %v", problems)
+	}
+}
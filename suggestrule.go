@@ -0,0 +1,74 @@
+package main
+
+import (
+	"firefly-iii-email-scanner/email"
+	"firefly-iii-email-scanner/suggest"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+)
+
+// Drafts a process_emails entry from a sample alert, for the user to check
+// and complete, and shows what it extracts from the sample.
+func runSuggestRule(args []string) {
+	flags := flag.NewFlagSet("suggest-rule", flag.ExitOnError)
+	verbose := flags.Bool("verbose", false, "Show log output from processing the email")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: firefly-iii-email-scanner suggest-rule [flags] [sample.eml]")
+		fmt.Fprintln(flags.Output(), "The email is read from standard input if no file is given.")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	var body []byte
+	var err error
+	if path := flags.Arg(0); path != "" && path != "-" {
+		body, err = os.ReadFile(path)
+	} else {
+		body, err = io.ReadAll(os.Stdin)
+	}
+	if err != nil {
+		log.Fatalf("Failed to read email: %v", err)
+	}
+
+	parsed, err := email.ParseRawMessage(email.RawMessage{Body: body})
+	if err != nil {
+		log.Fatalf("Failed to parse email: %v", err)
+	}
+	suggestion, err := suggest.Suggest(parsed)
+	if err != nil {
+		log.Fatalf("Failed to suggest a rule: %v", err)
+	}
+	out, err := suggestion.YAML()
+	if err != nil {
+		log.Fatalf("Failed to write the suggested rule: %v", err)
+	}
+	os.Stdout.Write(out)
+
+	// What was found and extracted goes to standard error, so that the YAML
+	// can be redirected to a file
+	fmt.Fprintln(os.Stderr, "Found:")
+	for _, line := range suggestion.Describe() {
+		fmt.Fprintf(os.Stderr, "  %s\n", line)
+	}
+
+	if !*verbose {
+		log.SetOutput(io.Discard)
+	}
+	trace := email.TraceEmail(parsed, suggestion.Config)
+	if trace.Err != nil {
+		fmt.Fprintf(os.Stderr, "\nThe suggested rule does not extract a transaction from the sample: %v\n", trace.Err)
+		os.Exit(1)
+	}
+	for i, info := range trace.Transactions {
+		if info.TransactionDate.IsZero() {
+			info.TransactionDate = parsed.Date().UTC()
+		}
+		fmt.Fprintf(os.Stderr, "\nThe suggested rule extracts transaction %d:\n", i+1)
+		for _, field := range describeInfo(info) {
+			fmt.Fprintf(os.Stderr, "  %-16s %s\n", field.field+":", field.value)
+		}
+	}
+}
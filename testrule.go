@@ -0,0 +1,156 @@
+package main
+
+import (
+	"firefly-iii-email-scanner/common"
+	"firefly-iii-email-scanner/email"
+	"firefly-iii-email-scanner/firefly"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+)
+
+// Runs the configuration against a sample email and prints what each
+// processing step matched and extracted, without writing anything.
+func runTestRule(args []string) {
+	flags := flag.NewFlagSet("test-rule", flag.ExitOnError)
+	configFile := flags.String("config", "config.yaml", "The configuration file to test")
+	offline := flags.Bool("offline", false, "Skip looking up the accounts in Firefly")
+	verbose := flags.Bool("verbose", false, "Show log output from processing the email")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: firefly-iii-email-scanner test-rule [flags] [sample.eml]")
+		fmt.Fprintln(flags.Output(), "The email is read from standard input if no file is given.")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	config, err := common.GetConfig(*configFile)
+	if err != nil {
+		log.Fatalf("Failed to load config: %v", err)
+	}
+
+	var body []byte
+	if path := flags.Arg(0); path != "" && path != "-" {
+		body, err = os.ReadFile(path)
+	} else {
+		body, err = io.ReadAll(os.Stdin)
+	}
+	if err != nil {
+		log.Fatalf("Failed to read email: %v", err)
+	}
+
+	parsed, err := email.ParseRawMessage(email.RawMessage{Body: body})
+	if err != nil {
+		log.Fatalf("Failed to parse email: %v", err)
+	}
+	fmt.Printf("From:    %s\n", parsed.Header.Get("From"))
+	fmt.Printf("Subject: %s\n", parsed.Subject())
+	fmt.Printf("Date:    %s\n\n", parsed.Header.Get("Date"))
+
+	emailConfig := email.ConfigForSender(parsed, config.ProcessEmails)
+	if emailConfig == nil {
+		fmt.Println("No process_emails entry has a fromEmail matching the sender")
+		os.Exit(1)
+	}
+
+	if !*verbose {
+		log.SetOutput(io.Discard)
+	}
+	trace := email.TraceEmail(parsed, *emailConfig)
+	printTrace(trace)
+
+	if trace.Err != nil {
+		fmt.Printf("\nNo transactions extracted: %v\n", trace.Err)
+		os.Exit(1)
+	}
+
+	if !*offline {
+		if err := firefly.Init(); err != nil {
+			log.SetOutput(os.Stderr)
+			log.Fatalf("Failed to initialize Firefly client: %v", err)
+		}
+		defer firefly.Cleanup()
+	}
+
+	for i, info := range trace.Transactions {
+		if info.TransactionDate.IsZero() {
+			// As when processing, the email's date is used if none was extracted
+			info.TransactionDate = parsed.Date().UTC()
+		}
+
+		fmt.Printf("\nTransaction %d\n", i+1)
+		for _, field := range describeInfo(info) {
+			fmt.Printf("  %-22s %s\n", field.field+":", field.value)
+		}
+		if !*offline {
+			printFireflyAccounts(os.Stdout, info, config.AccountNumbers)
+		}
+	}
+}
+
+func printTrace(trace email.Trace) {
+	for _, step := range trace.Steps {
+		switch {
+		case step.Err != nil:
+			fmt.Printf("%s: %v\n", step.Name, step.Err)
+		case step.Matched:
+			fmt.Printf("%s: matched\n", step.Name)
+		default:
+			fmt.Printf("%s: no match\n", step.Name)
+		}
+
+		for _, extraction := range step.Extractions {
+			extractionType := extraction.Type
+			if extractionType == "" {
+				extractionType = "plainTextBodyRegex"
+			}
+			if extraction.Regex != "" {
+				fmt.Printf("  %s: %s `%s`\n", extraction.Name, extractionType, extraction.Regex)
+			} else {
+				fmt.Printf("  %s: %s\n", extraction.Name, extractionType)
+			}
+
+			if extraction.Err != nil {
+				fmt.Printf("    %v\n", extraction.Err)
+				continue
+			}
+			if len(extraction.Matches) == 0 {
+				fmt.Println("    not found")
+			}
+			for _, match := range extraction.Matches {
+				fmt.Printf("    match %s\n", strconv.Quote(match.Text))
+				for _, group := range match.Groups {
+					name := strconv.Itoa(group.Number)
+					if group.Name != "" {
+						name += " (" + group.Name + ")"
+					}
+					target := ""
+					for _, field := range group.TargetFields {
+						target += " -> " + field
+					}
+					fmt.Printf("      group %s = %s%s\n", name, strconv.Quote(group.Value), target)
+				}
+			}
+		}
+	}
+}
+
+// Prints the Firefly accounts the transaction would be recorded against.
+func printFireflyAccounts(w io.Writer, info common.TransactionInfo, accountNumbers map[string]string) {
+	if id, err := firefly.ResolveSourceAccount(info, accountNumbers); err != nil {
+		fmt.Fprintf(w, "  %-22s %v\n", "fireflyAccount:", err)
+	} else {
+		fmt.Fprintf(w, "  %-22s %d\n", "fireflyAccount:", id)
+	}
+
+	// As when processing, a negative amount with no type is a deposit
+	info = firefly.WithSignedType(info)
+	label := "firefly" + counterpartyLabel(info) + ":"
+	if account := firefly.GetMatchingAccount(info.DestinationName, info.Type); account != nil {
+		fmt.Fprintf(w, "  %-22s %s (%s account %s)\n", label, account.Attributes.Name, account.Attributes.Type, account.Id)
+	} else {
+		fmt.Fprintf(w, "  %-22s no close match, so a new account %s would be created\n", label, strconv.Quote(info.DestinationName))
+	}
+}
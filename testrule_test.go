@@ -0,0 +1,47 @@
+package main
+
+import (
+	"bytes"
+	"firefly-iii-email-scanner/common"
+	"firefly-iii-email-scanner/firefly"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestPrintFireflyAccounts_NegativeAmountIsDeposit(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/vnd.api+json")
+		pagination := `"meta": {"pagination": {"current_page": 1, "total_pages": 1}}`
+		switch r.URL.Path {
+		case "/api/v1/accounts":
+			w.Write([]byte(`{"data": [
+				{"type": "accounts", "id": "1", "attributes": {"name": "Checking", "type": "asset"}},
+				{"type": "accounts", "id": "5", "attributes": {"name": "Acme Store", "type": "expense"}},
+				{"type": "accounts", "id": "6", "attributes": {"name": "Acme Store", "type": "revenue"}}
+			], ` + pagination + `}`))
+		default:
+			w.Write([]byte(`{"data": [], ` + pagination + `}`))
+		}
+	}))
+	defer server.Close()
+
+	t.Setenv("FIREFLY_URL", server.URL)
+	if err := firefly.Init(); err != nil {
+		t.Fatalf("Failed to initialize Firefly client: %v", err)
+	}
+	defer firefly.Cleanup()
+
+	info := common.TransactionInfo{
+		Amount:          common.NewMoney(-1200, 2, "USD"),
+		DestinationName: "Acme Store",
+		SourceAccountId: 1,
+	}
+	var out bytes.Buffer
+	printFireflyAccounts(&out, info, nil)
+
+	if !strings.Contains(out.String(), "fireflySource:") || !strings.Contains(out.String(), "(revenue account 6)") {
+		t.Errorf("Expected the refund to be matched to the revenue account, got\n%s", out.String())
+	}
+}
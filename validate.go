@@ -0,0 +1,93 @@
+package main
+
+import (
+	"firefly-iii-email-scanner/common"
+	"firefly-iii-email-scanner/email"
+	"firefly-iii-email-scanner/firefly"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+)
+
+// Checks a configuration file for mistakes which would otherwise only show up
+// when a matching email arrives, and that the Firefly accounts it refers to
+// exist.
+func runValidateConfig(args []string) {
+	flags := flag.NewFlagSet("validate-config", flag.ExitOnError)
+	configFile := flags.String("config", "config.yaml", "The configuration file to validate")
+	offline := flags.Bool("offline", false, "Skip checking the configured accounts in Firefly")
+	flags.Parse(args)
+
+	config, err := common.GetConfig(*configFile)
+	if err != nil {
+		log.Fatalf("Failed to load config: %v", err)
+	}
+
+	var problems []string
+	for _, emailConfig := range config.ProcessEmails {
+		for _, err := range email.ValidateConfig(emailConfig) {
+			problems = append(problems, fmt.Sprintf("%s: %v", emailConfig.FromEmail, err))
+		}
+	}
+
+	if !*offline {
+		if err := firefly.Init(); err != nil {
+			log.Fatalf("Failed to initialize Firefly client: %v", err)
+		}
+		problems = append(problems, checkAccounts(config)...)
+		firefly.Cleanup()
+	}
+
+	if len(problems) > 0 {
+		for _, problem := range problems {
+			fmt.Println(problem)
+		}
+		fmt.Printf("\n%d problems found in %s\n", len(problems), *configFile)
+		os.Exit(1)
+	}
+	fmt.Printf("%s is valid\n", *configFile)
+}
+
+// Checks that the accounts the processing steps and account numbers refer to
+// are asset or liability accounts in Firefly.
+func checkAccounts(config *common.Config) []string {
+	var problems []string
+	for _, emailConfig := range config.ProcessEmails {
+		for i, step := range emailConfig.ProcessingSteps {
+			location := fmt.Sprintf("%s: %s", emailConfig.FromEmail, email.DescribeStep(i, step))
+			if step.SourceAccountId != 0 {
+				if err := firefly.CheckOwnAccount(step.SourceAccountId); err != nil {
+					problems = append(problems, fmt.Sprintf("%s: sourceAccountId: %v", location, err))
+				}
+			}
+			if step.SourceAccountName != "" {
+				if err := firefly.CheckOwnAccountName(step.SourceAccountName); err != nil {
+					problems = append(problems, fmt.Sprintf("%s: sourceAccountName: %v", location, err))
+				}
+			}
+		}
+	}
+
+	suffixes := make([]string, 0, len(config.AccountNumbers))
+	for suffix := range config.AccountNumbers {
+		suffixes = append(suffixes, suffix)
+	}
+	sort.Strings(suffixes)
+	for _, suffix := range suffixes {
+		reference := config.AccountNumbers[suffix]
+		var err error
+		if id, convErr := strconv.Atoi(reference); convErr == nil {
+			err = firefly.CheckOwnAccount(id)
+		} else {
+			err = firefly.CheckOwnAccountName(reference)
+		}
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("accountNumbers: %s: %v", suffix, err))
+		}
+	}
+
+	return problems
+}